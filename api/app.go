@@ -0,0 +1,27 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed app
+var appFiles embed.FS
+
+// registerApp serves the web UI from /app. The files are static, so they are
+// served without authentication; the UI asks for credentials when the API
+// requires them.
+func (t *HTTPTransport) registerApp() {
+	files, err := fs.Sub(appFiles, "app")
+	if err != nil {
+		panic(err)
+	}
+
+	t.engine.StaticFS("/app", http.FS(files))
+	t.engine.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/app/")
+	})
+}
@@ -0,0 +1,273 @@
+// tracer-app talks to tracer-api through its public REST routes only. The
+// credential, an API key or token, is kept in local storage and sent as a
+// bearer token.
+
+const credentialKey = "tracer.credential";
+const reconnectDelay = 5000;
+
+const $ = (id) => document.getElementById(id);
+
+class Unauthenticated extends Error {}
+
+function headers(extra) {
+  const h = Object.assign({}, extra);
+  const credential = localStorage.getItem(credentialKey);
+  if (credential) {
+    h["Authorization"] = "Bearer " + credential;
+  }
+  return h;
+}
+
+async function api(method, path, body) {
+  const res = await fetch(path, {
+    method,
+    headers: headers(body ? { "Content-Type": "application/json" } : {}),
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  if (res.status === 401) {
+    showSignIn();
+    throw new Unauthenticated();
+  }
+  const data = await res.json().catch(() => ({}));
+  if (!res.ok) {
+    throw new Error(data.message || data.error || res.statusText);
+  }
+  return data;
+}
+
+// stream reads server-sent events from /v1/stream. EventSource can't send an
+// Authorization header, so the response body is parsed here instead.
+async function stream(onReading) {
+  const res = await fetch("/v1/stream", { headers: headers({ Accept: "text/event-stream" }) });
+  if (res.status === 401) {
+    showSignIn();
+    throw new Unauthenticated();
+  }
+  if (!res.ok) {
+    throw new Error(res.statusText);
+  }
+
+  setConnection("Live", "live");
+
+  const reader = res.body.getReader();
+  const decoder = new TextDecoder();
+  let buffer = "";
+
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      throw new Error("stream closed");
+    }
+    buffer += decoder.decode(value, { stream: true });
+
+    let end;
+    while ((end = buffer.indexOf("\n\n")) >= 0) {
+      const event = buffer.slice(0, end);
+      buffer = buffer.slice(end + 2);
+
+      let type = "message";
+      const data = [];
+      for (const line of event.split("\n")) {
+        if (line.startsWith("event:")) {
+          type = line.slice(6).trim();
+        } else if (line.startsWith("data:")) {
+          data.push(line.slice(5).trimStart());
+        }
+      }
+      if (type === "reading" && data.length > 0) {
+        onReading(JSON.parse(data.join("\n")));
+      }
+    }
+  }
+}
+
+async function keepStreaming() {
+  for (;;) {
+    try {
+      await stream(showReading);
+    } catch (err) {
+      if (err instanceof Unauthenticated) {
+        return;
+      }
+      setConnection("Reconnecting…", "error");
+    }
+    await new Promise((resolve) => setTimeout(resolve, reconnectDelay));
+  }
+}
+
+function setConnection(text, state) {
+  const el = $("connection");
+  el.textContent = text;
+  el.className = "pill " + (state || "");
+}
+
+function fixed(value, digits, unit) {
+  return value.toFixed(digits) + " " + unit;
+}
+
+function yesNo(value) {
+  return value ? "Yes" : "No";
+}
+
+function showReading(r) {
+  const batteryPower = r.batteryVoltage * r.batteryCurrent;
+
+  $("solar-power").textContent = fixed(r.solarPower, 0, "W");
+  $("solar-detail").textContent = fixed(r.solarVoltage, 1, "V") + " · " + fixed(r.solarCurrent, 1, "A");
+  $("battery-power").textContent = fixed(Math.abs(batteryPower), 0, "W");
+  $("battery-detail").textContent = fixed(r.batteryVoltage, 2, "V") + " · " + fixed(r.batteryCurrent, 1, "A");
+  $("load-power").textContent = fixed(r.loadPower, 0, "W");
+  $("load-detail").textContent = fixed(r.loadVoltage, 1, "V") + " · " + fixed(r.loadCurrent, 1, "A");
+
+  $("solar-arrow").classList.toggle("active", r.solarPower > 0);
+  $("load-arrow").classList.toggle("active", r.loadPower > 0);
+
+  $("soc").textContent = r.batterySOC + "%";
+  $("soc-fill").style.width = Math.min(r.batterySOC, 100) + "%";
+  $("battery-status").textContent =
+    batteryPower > 1 ? "Charging" : batteryPower < -1 ? "Discharging" : "Idle";
+  $("voltage-range").textContent =
+    fixed(r.minimumBatteryVoltageToday, 2, "V") + " – " + fixed(r.maximumBatteryVoltageToday, 2, "V");
+
+  $("generated-today").textContent = fixed(r.generatedEnergyToday, 2, "kWh");
+  $("consumed-today").textContent = fixed(r.consumedEnergyToday, 2, "kWh");
+  $("day").textContent = yesNo(r.day);
+
+  $("battery-temperature").textContent = fixed(r.batteryTemperature, 1, "°C");
+  $("device-temperature").textContent = fixed(r.deviceTemperature, 1, "°C");
+  $("over-temperature").textContent = yesNo(r.overTemperature);
+}
+
+// localISO formats date in local time with its UTC offset, so the controller's
+// clock is set to the household's time.
+function localISO(date) {
+  const pad = (n) => String(n).padStart(2, "0");
+  const offset = -date.getTimezoneOffset();
+  const sign = offset >= 0 ? "+" : "-";
+  return (
+    date.getFullYear() + "-" + pad(date.getMonth() + 1) + "-" + pad(date.getDate()) +
+    "T" + pad(date.getHours()) + ":" + pad(date.getMinutes()) + ":" + pad(date.getSeconds()) +
+    sign + pad(Math.floor(Math.abs(offset) / 60)) + ":" + pad(Math.abs(offset) % 60)
+  );
+}
+
+function setMessage(id, text, ok) {
+  const el = $(id);
+  el.textContent = text;
+  el.className = "message " + (ok ? "ok" : "error");
+}
+
+function showSystemTime(res) {
+  // The controller has no time zone; show its clock as it reads.
+  $("system-time").textContent = res.time.slice(0, 19).replace("T", " ");
+}
+
+function showBattery(res) {
+  $("battery-type").textContent = res.batteryType;
+  $("battery-capacity").textContent = res.batteryCapacity + " Ah";
+  $("capacity-input").value = res.batteryCapacity;
+}
+
+function showRatedData(res) {
+  const r = res.ratedData;
+  $("rated-solar").textContent = fixed(r.solarVoltage, 0, "V") + " · " + fixed(r.solarPower, 0, "W");
+  $("rated-battery").textContent = fixed(r.batteryVoltage, 0, "V") + " · " + fixed(r.batteryCurrent, 0, "A");
+  $("rated-load").textContent = fixed(r.loadCurrent, 0, "A");
+  $("charging-mode").textContent = r.chargingMode;
+}
+
+async function loadSystemTime() {
+  showSystemTime(await api("GET", "/v1/system-time"));
+}
+
+async function loadBattery() {
+  showBattery(await api("GET", "/v1/battery"));
+}
+
+// load fetches everything shown on the page in one batch, so the controller's
+// bus is only waited for once.
+async function load() {
+  const calls = [
+    ["getReading", (res) => showReading(res.reading)],
+    ["getSystemTime", showSystemTime],
+    ["getBatteryInformation", showBattery],
+    ["getRatedData", showRatedData],
+  ];
+  const res = await api("POST", "/v1/batch", { calls: calls.map(([method]) => ({ method })) });
+  res.results.forEach((result, i) => {
+    if (result.error) {
+      console.error(calls[i][0], result.error, result.message || "");
+      return;
+    }
+    calls[i][1](result.response);
+  });
+}
+
+function ignoreUnauthenticated(err) {
+  if (!(err instanceof Unauthenticated)) {
+    console.error(err);
+  }
+}
+
+function setInputToNow() {
+  $("system-time-input").value = localISO(new Date()).slice(0, 19);
+}
+
+$("system-time-now").addEventListener("click", setInputToNow);
+
+$("system-time-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const time = localISO(new Date($("system-time-input").value));
+  try {
+    await api("PUT", "/v1/system-time", { time });
+    setMessage("system-time-message", "Clock set.", true);
+    await loadSystemTime();
+  } catch (err) {
+    if (!(err instanceof Unauthenticated)) {
+      setMessage("system-time-message", err.message, false);
+    }
+  }
+});
+
+$("capacity-form").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const capacity = Number($("capacity-input").value);
+  try {
+    await api("PATCH", "/v1/battery", { capacity });
+    setMessage("capacity-message", "Capacity set.", true);
+    await loadBattery();
+  } catch (err) {
+    if (!(err instanceof Unauthenticated)) {
+      setMessage("capacity-message", err.message, false);
+    }
+  }
+});
+
+function showSignIn() {
+  $("sign-in").hidden = false;
+  setConnection("Signed out", "error");
+}
+
+$("sign-in-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  localStorage.setItem(credentialKey, $("credential").value);
+  $("credential").value = "";
+  $("sign-in").hidden = true;
+  start();
+});
+
+$("sign-out").addEventListener("click", () => {
+  localStorage.removeItem(credentialKey);
+  location.reload();
+});
+
+function start() {
+  $("sign-out").hidden = !localStorage.getItem(credentialKey);
+  setConnection("Connecting…");
+
+  load().catch(ignoreUnauthenticated);
+  keepStreaming();
+}
+
+setInputToNow();
+start();
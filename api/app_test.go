@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestApp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	auth := NewKeyAuthenticator(map[string]*Principal{"key": {Name: "alex", Role: RoleAdmin}})
+	if err := NewHTTPTransport(engine, &fakeAPI{}, nil, nil, auth, zap.NewNop()).Register(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/app/" {
+		t.Errorf("/ = %d to %q, want a redirect to /app/", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	// The UI is served without credentials even though the API needs them.
+	for path, contentType := range map[string]string{
+		"/app/":        "text/html",
+		"/app/app.js":  "javascript",
+		"/app/app.css": "text/css",
+	} {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Content-Type"), contentType) {
+			t.Errorf("%s = %d %q", path, res.StatusCode, res.Header.Get("Content-Type"))
+		}
+	}
+}
+
+// TestAppPaths checks every API path the UI calls is one the API serves.
+func TestAppPaths(t *testing.T) {
+	script, err := appFiles.ReadFile("app/app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	if err := NewHTTPTransport(engine, &fakeAPI{}, NewStreamHub(zap.NewNop()), nil, nil, zap.NewNop()).Register(); err != nil {
+		t.Fatal(err)
+	}
+	routes := make(map[string]bool)
+	for _, r := range engine.Routes() {
+		routes[r.Path] = true
+	}
+
+	for _, path := range regexp.MustCompile(`["'`+"`"+`](/v1/[\w/-]+)`).FindAllStringSubmatch(string(script), -1) {
+		if !routes[path[1]] {
+			t.Errorf("the UI calls %s, which the API doesn't serve", path[1])
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/alxyng/tracer/internal/transport"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleAdmin  Role = "admin"
+)
+
+// allows reports whether r grants everything required grants. Admins can do
+// everything viewers can.
+func (r Role) allows(required Role) bool {
+	return r == required || r == RoleAdmin
+}
+
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleViewer, RoleAdmin:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role %q", s)
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Name string
+	Role Role
+}
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator identifies the caller making r. It returns ErrNoCredentials
+// if r carries no credentials it understands.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Authenticators tries each authenticator in turn until one recognises the
+// request's credentials.
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(r *http.Request) (*Principal, error) {
+	for _, auth := range a {
+		p, err := auth.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// bearer returns the bearer token in r's Authorization header.
+func bearer(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// NewKeyAuthenticator creates a KeyAuthenticator accepting keys, a map of
+// API key to the principal it identifies.
+func NewKeyAuthenticator(keys map[string]*Principal) *KeyAuthenticator {
+	return &KeyAuthenticator{keys: keys}
+}
+
+// KeyAuthenticator accepts static API keys, sent in the X-API-Key header or
+// as a bearer token.
+type KeyAuthenticator struct {
+	keys map[string]*Principal
+}
+
+func (a *KeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearer(r)
+		if key == "" || strings.Count(key, ".") == 2 {
+			// Leave tokens to TokenAuthenticator.
+			return nil, ErrNoCredentials
+		}
+	}
+
+	for k, p := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return p, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Role      Role   `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var tokenEncoding = base64.RawURLEncoding
+
+// NewTokenAuthenticator creates a TokenAuthenticator verifying tokens with
+// secret.
+func NewTokenAuthenticator(secret []byte) *TokenAuthenticator {
+	return &TokenAuthenticator{secret: secret, now: time.Now}
+}
+
+// TokenAuthenticator accepts bearer tokens in JWT form, signed with HS256,
+// whose sub claim names the principal and role claim gives its role.
+type TokenAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// Sign issues a token for name with role, valid for ttl.
+func (a *TokenAuthenticator) Sign(name string, role Role, ttl time.Duration) (string, error) {
+	header, err := json.Marshal(&tokenHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	now := a.now()
+	claims, err := json.Marshal(&tokenClaims{
+		Subject:   name,
+		Role:      role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := tokenEncoding.EncodeToString(header) + "." + tokenEncoding.EncodeToString(claims)
+	return signed + "." + tokenEncoding.EncodeToString(a.mac(signed)), nil
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearer(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+
+	i := strings.LastIndex(token, ".")
+	signed, sig := token[:i], token[i+1:]
+
+	mac, err := tokenEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, a.mac(signed)) {
+		return nil, ErrInvalidCredentials
+	}
+
+	encodedHeader, encodedClaims, _ := strings.Cut(signed, ".")
+
+	var header tokenHeader
+	if err := decodeTokenPart(encodedHeader, &header); err != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidCredentials
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(encodedClaims, &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if claims.ExpiresAt == 0 || a.now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("%w: token expired", ErrInvalidCredentials)
+	}
+	role, err := ParseRole(string(claims.Role))
+	if err != nil || claims.Subject == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Principal{Name: claims.Subject, Role: role}, nil
+}
+
+func (a *TokenAuthenticator) mac(signed string) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(signed))
+	return h.Sum(nil)
+}
+
+func decodeTokenPart(s string, v any) error {
+	data, err := tokenEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// authorize returns middleware that rejects requests not authenticated with
+// at least role. Without an authenticator every request is allowed. The
+// principal, or the client's address if authentication is off, is added to
+// the request's context for the controller's audit log.
+func (t *HTTPTransport) authorize(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if t.auth == nil {
+			c.Request = c.Request.WithContext(withPrincipal(c.Request.Context(), c.Request.RemoteAddr))
+			c.Next()
+			return
+		}
+
+		p, err := t.auth.Authenticate(c.Request)
+		if errors.Is(err, ErrNoCredentials) {
+			c.Header("WWW-Authenticate", "Bearer")
+			writeError(c.Writer, http.StatusUnauthorized, "unauthenticated", "")
+			c.Abort()
+			return
+		}
+		if err != nil {
+			t.logger.Warn("rejecting request", zap.String("path", c.Request.URL.Path), zap.String("remoteAddr", c.Request.RemoteAddr), zap.Error(err))
+			c.Header("WWW-Authenticate", "Bearer")
+			writeError(c.Writer, http.StatusUnauthorized, "unauthenticated", err.Error())
+			c.Abort()
+			return
+		}
+		if !p.Role.allows(role) {
+			t.logger.Warn("forbidding request", zap.String("path", c.Request.URL.Path), zap.String("principal", p.Name), zap.String("role", string(p.Role)))
+			writeError(c.Writer, http.StatusForbidden, "forbidden", fmt.Sprintf("requires the %s role", role))
+			c.Abort()
+			return
+		}
+
+		c.Request = c.Request.WithContext(withPrincipal(c.Request.Context(), p.Name))
+		c.Next()
+
+		t.logger.Info("request",
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.String("principal", p.Name),
+			zap.Int("status", c.Writer.Status()))
+	}
+}
+
+// withPrincipal records who is making the request, both for signing requests
+// to a remote controller and for the audit log of an in-process one.
+func withPrincipal(ctx context.Context, name string) context.Context {
+	ctx = transport.WithPrincipal(ctx, name)
+	return transport.WithCaller(ctx, transport.Caller{Source: transport.SourceHTTP, Principal: name})
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func authRequest(header, value string) *http.Request {
+	r := httptest.NewRequest("GET", "/v1/system-time", nil)
+	if header != "" {
+		r.Header.Set(header, value)
+	}
+	return r
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	auth := NewTokenAuthenticator([]byte("secret"))
+	auth.now = func() time.Time { return now }
+
+	token, err := auth.Sign("alex", RoleAdmin, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := auth.Authenticate(authRequest("Authorization", "Bearer "+token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "alex" || p.Role != RoleAdmin {
+		t.Errorf("principal = %+v", p)
+	}
+
+	other := NewTokenAuthenticator([]byte("other"))
+	if _, err := other.Authenticate(authRequest("Authorization", "Bearer "+token)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong secret: err = %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	claims := tokenEncoding.EncodeToString([]byte(`{"sub":"alex","role":"admin","exp":9999999999}`))
+	tampered := parts[0] + "." + claims + "." + parts[2]
+	if _, err := auth.Authenticate(authRequest("Authorization", "Bearer "+tampered)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("tampered claims: err = %v", err)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := auth.Authenticate(authRequest("Authorization", "Bearer "+token)); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expired token: err = %v", err)
+	}
+
+	if _, err := auth.Authenticate(authRequest("", "")); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("no token: err = %v", err)
+	}
+}
+
+func TestKeyAuthenticator(t *testing.T) {
+	viewer := &Principal{Name: "grafana", Role: RoleViewer}
+	auth := NewKeyAuthenticator(map[string]*Principal{"k1": viewer})
+
+	for _, r := range []*http.Request{authRequest("X-API-Key", "k1"), authRequest("Authorization", "Bearer k1")} {
+		if p, err := auth.Authenticate(r); err != nil || p != viewer {
+			t.Errorf("principal = %v, err = %v", p, err)
+		}
+	}
+
+	if _, err := auth.Authenticate(authRequest("X-API-Key", "k2")); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown key: err = %v", err)
+	}
+	if _, err := auth.Authenticate(authRequest("Authorization", "Bearer a.b.c")); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("token left to TokenAuthenticator: err = %v", err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tokens := NewTokenAuthenticator([]byte("secret"))
+	auth := Authenticators{
+		NewKeyAuthenticator(map[string]*Principal{"viewer-key": {Name: "grafana", Role: RoleViewer}}),
+		tokens,
+	}
+	admin, err := tokens.Sign("alex", RoleAdmin, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	service := &fakeAPI{}
+	if err := NewHTTPTransport(engine, service, nil, nil, auth, zap.NewNop()).Register(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		value  string
+		status int
+	}{
+		{"no credentials", "GET", "/v1/system-time", "", "", http.StatusUnauthorized},
+		{"bad key", "GET", "/v1/system-time", "X-API-Key", "nope", http.StatusUnauthorized},
+		{"viewer reads", "GET", "/v1/system-time", "X-API-Key", "viewer-key", http.StatusOK},
+		{"viewer writes", "PATCH", "/v1/battery", "X-API-Key", "viewer-key", http.StatusForbidden},
+		{"admin writes", "PATCH", "/v1/battery", "Authorization", "Bearer " + admin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(`{"capacity": 100}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.status)
+			}
+		})
+	}
+}
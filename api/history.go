@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alxyng/tracer/history"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// historyParams are the query parameters of the history endpoints. Fields is
+// a comma separated list.
+type historyParams struct {
+	From      time.Time         `json:"from,omitempty"`
+	To        time.Time         `json:"to,omitempty"`
+	Fields    string            `json:"fields"`
+	Bucket    history.Bucket    `json:"bucket,omitempty"`
+	Aggregate history.Aggregate `json:"aggregate,omitempty"`
+	Limit     int               `json:"limit,omitempty"`
+	Format    string            `json:"format,omitempty"`
+}
+
+type historyRoute struct {
+	path        string
+	operationID string
+	summary     string
+	fields      []string
+	query       func(ctx context.Context, s history.Store, q *history.Query) (*history.Result, error)
+}
+
+var historyRoutes = []historyRoute{
+	{
+		path:        "/v1/history/readings",
+		operationID: "getReadingHistory",
+		summary:     "Query stored readings",
+		fields:      history.ReadingFields(),
+		query: func(ctx context.Context, s history.Store, q *history.Query) (*history.Result, error) {
+			return s.Readings(ctx, q)
+		},
+	},
+	{
+		path:        "/v1/history/daily-energy",
+		operationID: "getDailyEnergyHistory",
+		summary:     "Query stored daily energy totals",
+		fields:      history.DailyEnergyFields(),
+		query: func(ctx context.Context, s history.Store, q *history.Query) (*history.Result, error) {
+			return s.DailyEnergy(ctx, q)
+		},
+	},
+}
+
+func (t *HTTPTransport) registerHistory() {
+	for _, r := range historyRoutes {
+		t.handle("GET", r.path, false, t.createHistoryHandler(r))
+	}
+}
+
+// addHistoryPaths describes the history routes in doc.
+func addHistoryPaths(doc map[string]any) {
+	paths := doc["paths"].(map[string]map[string]any)
+	components := doc["components"].(map[string]any)["schemas"].(map[string]schema)
+
+	for _, r := range historyRoutes {
+		paths[r.path] = map[string]any{"get": historyOperation(r, components)}
+	}
+}
+
+func (t *HTTPTransport) createHistoryHandler(r historyRoute) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params historyParams
+		data, err := queryToJSON(reflect.TypeOf(params), c.Request)
+		if err == nil {
+			err = json.Unmarshal(data, &params)
+		}
+		if err != nil {
+			writeError(c.Writer, http.StatusBadRequest, "invalidRequest", err.Error())
+			return
+		}
+
+		csvFormat := params.Format == "csv" || (params.Format == "" && strings.Contains(c.GetHeader("Accept"), "text/csv"))
+		if params.Format != "" && params.Format != "csv" && params.Format != "json" {
+			writeError(c.Writer, http.StatusBadRequest, "invalidRequest", "format must be json or csv")
+			return
+		}
+
+		q := &history.Query{
+			From:      params.From,
+			To:        params.To,
+			Bucket:    params.Bucket,
+			Aggregate: params.Aggregate,
+			Limit:     params.Limit,
+		}
+		if params.Fields != "" {
+			q.Fields = strings.Split(params.Fields, ",")
+		}
+
+		result, err := r.query(c.Request.Context(), t.history, q)
+		if errors.Is(err, history.ErrInvalidQuery) {
+			writeError(c.Writer, http.StatusBadRequest, "invalidRequest", err.Error())
+			return
+		}
+		if err != nil {
+			t.logger.Error("error querying history", zap.String("path", r.path), zap.Error(err))
+			writeError(c.Writer, http.StatusInternalServerError, "internalError", "")
+			return
+		}
+
+		if csvFormat {
+			writeCSV(c.Writer, result)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// writeCSV writes result with a header row of time and the field names.
+// Missing values are left empty, and truncated results are marked with the
+// X-Truncated header.
+func writeCSV(w http.ResponseWriter, result *history.Result) {
+	w.Header().Set("Content-Type", "text/csv")
+	if result.Truncated {
+		w.Header().Set("X-Truncated", "true")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write(append([]string{"time"}, result.Fields...))
+
+	record := make([]string, len(result.Fields)+1)
+	for _, row := range result.Rows {
+		record[0] = row.Time.Format(time.RFC3339)
+		for i, v := range row.Values {
+			record[i+1] = ""
+			if v != nil {
+				record[i+1] = strconv.FormatFloat(*v, 'f', -1, 64)
+			}
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+}
+
+// historyOperation describes a history endpoint in the OpenAPI document.
+func historyOperation(r historyRoute, components map[string]schema) map[string]any {
+	params := queryParameters(reflect.TypeOf(historyParams{}), components)
+	for _, p := range params {
+		switch p["name"] {
+		case "fields":
+			p["required"] = true
+			p["description"] = "Comma separated fields, any of " + strings.Join(r.fields, ", ")
+		case "from":
+			p["description"] = "Start of the range, inclusive. Defaults to a day before to"
+		case "to":
+			p["description"] = "End of the range, exclusive. Defaults to now"
+		case "aggregate":
+			p["description"] = "How values are combined within a bucket"
+		case "format":
+			p["schema"] = schema{"type": "string", "enum": []string{"json", "csv"}}
+			p["description"] = "Response format. CSV is also returned if the request accepts text/csv"
+		}
+	}
+
+	return map[string]any{
+		"operationId": r.operationID,
+		"summary":     r.summary,
+		"parameters":  params,
+		"responses": map[string]any{
+			"200": map[string]any{
+				"description": "OK",
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(history.Result{}), components)},
+					"text/csv":         map[string]any{"schema": schema{"type": "string"}},
+				},
+			},
+			"default": map[string]any{
+				"description": "Error",
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(errorResponse{}), components)},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alxyng/tracer/history"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// fakeStore returns rows up to the query's limit and reports truncation as
+// the stores do.
+type fakeStore struct {
+	rows  int
+	query *history.Query
+}
+
+func (s *fakeStore) Readings(ctx context.Context, q *history.Query) (*history.Result, error) {
+	s.query = q
+	if len(q.Fields) == 0 {
+		return nil, &history.InvalidQueryError{Reason: "no fields selected"}
+	}
+
+	result := &history.Result{Fields: q.Fields, Rows: make([]history.Row, s.rows)}
+	if q.Limit > 0 && s.rows > q.Limit {
+		result.Rows = result.Rows[:q.Limit]
+		result.Truncated = true
+	}
+	return result, nil
+}
+
+func (s *fakeStore) DailyEnergy(ctx context.Context, q *history.Query) (*history.Result, error) {
+	return s.Readings(ctx, q)
+}
+
+func newHistoryServer(t *testing.T, store history.Store) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	if err := NewHTTPTransport(engine, &fakeAPI{}, nil, store, nil, zap.NewNop()).Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHistoryTruncated(t *testing.T) {
+	store := &fakeStore{rows: 3}
+	server := newHistoryServer(t, store)
+
+	res, err := http.Get(server.URL + "/v1/history/readings?fields=batteryVoltage&limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var result history.Result
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) != 2 || !result.Truncated {
+		t.Errorf("got %d rows, truncated %v, want 2 and true", len(result.Rows), result.Truncated)
+	}
+
+	res, err = http.Get(server.URL + "/v1/history/readings?fields=batteryVoltage&limit=2&format=csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("X-Truncated") != "true" {
+		t.Error("csv not marked as truncated")
+	}
+}
+
+func TestHistoryInvalid(t *testing.T) {
+	server := newHistoryServer(t, &fakeStore{})
+
+	for _, query := range []string{"", "?fields=batteryVoltage&format=xml", "?fields=batteryVoltage&limit=x"} {
+		res, err := http.Get(server.URL + "/v1/history/readings" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want 400", query, res.StatusCode)
+		}
+	}
+}
@@ -1,60 +1,138 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
-	"strings"
+	"reflect"
 	"time"
 
 	"github.com/alxyng/tracer/controller"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/alxyng/tracer/history"
+	"github.com/alxyng/tracer/internal/transport"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
-func NewHTTPTransport(engine *gin.Engine, mqttClient mqtt.Client, logger *zap.Logger) *HTTPTransport {
+// NewHTTPTransport creates an HTTPTransport serving service, which may be an
+// in-process controller.Service or a controller.Remote. If hub is not nil,
+// readings are streamed from /v1/stream, and if store is not nil stored
+// readings can be queried under /v1/history. If auth is not nil, callers
+// must authenticate, with the admin role to change settings.
+func NewHTTPTransport(engine *gin.Engine, service controller.API, hub *StreamHub, store history.Store, auth Authenticator, logger *zap.Logger) *HTTPTransport {
 	return &HTTPTransport{
-		engine:     engine,
-		mqttClient: mqttClient,
-		logger:     logger,
+		engine:  engine,
+		service: service,
+		hub:     hub,
+		history: store,
+		auth:    auth,
+		logger:  logger,
 	}
 }
 
 type HTTPTransport struct {
-	engine     *gin.Engine
-	mqttClient mqtt.Client
-	logger     *zap.Logger
+	engine  *gin.Engine
+	service controller.API
+	hub     *StreamHub
+	history history.Store
+	auth    Authenticator
+	logger  *zap.Logger
 }
 
-func (t *HTTPTransport) Register() {
-	t.engine.POST("/reading", gin.WrapF(t.createHandler(controller.TopicGetReading)))
-	t.engine.POST("/getSystemTime", gin.WrapF(t.createHandler(controller.TopicGetSystemTime)))
-	t.engine.POST("/setSystemTime", gin.WrapF(t.createHandler(controller.TopicSetSystemTime)))
-	t.engine.POST("/getBatteryInformation", gin.WrapF(t.createHandler(controller.TopicGetBatteryInformation)))
-	t.engine.POST("/setBatteryCapacity", gin.WrapF(t.createHandler(controller.TopicSetBatteryCapacity)))
+// rpc is a method of controller.API.
+type rpc struct {
+	name    string
+	request reflect.Type
+	call    func(ctx context.Context, service controller.API, req any) (any, error)
+
+	// timeout overrides requestTimeout.
+	timeout time.Duration
 }
 
-func (t *HTTPTransport) createHandler(topic string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		requestID := uuid.NewString()
-		done := make(chan []byte)
-
-		responseTopic := strings.Replace(topic, "request/#", "response/"+requestID, -1)
-		if token := t.mqttClient.Subscribe(responseTopic, 0, func(c mqtt.Client, msg mqtt.Message) {
-			done <- msg.Payload()
-		}); token.Wait() && token.Error() != nil {
-			t.logger.Error("error subscribing to response topic", zap.String("topic", responseTopic), zap.Error(token.Error()))
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
+func (m rpc) deadline() time.Duration {
+	if m.timeout > 0 {
+		return m.timeout
+	}
+	return requestTimeout
+}
+
+// requestOptions are read from every request alongside the request itself.
+type requestOptions struct {
+	// TimeoutMs is how long the caller is prepared to wait for a response.
+	TimeoutMs int64 `json:"timeoutMs"`
+}
+
+// timeout returns how long to allow a call to m.
+func (o requestOptions) timeout(m rpc) time.Duration {
+	if o.TimeoutMs > 0 {
+		return time.Duration(o.TimeoutMs) * time.Millisecond
+	}
+	return m.deadline()
+}
+
+// withTimeout allows m timeout rather than requestTimeout.
+func withTimeout(m rpc, timeout time.Duration) rpc {
+	m.timeout = timeout
+	return m
+}
 
-		defer func() {
-			if token := t.mqttClient.Unsubscribe(responseTopic); token.Wait() && token.Error() != nil {
-				t.logger.Error("error unsubscribing to response topic", zap.String("topic", responseTopic), zap.Error(token.Error()))
+// method describes f, a method expression such as controller.API.GetReading.
+func method[Req, Res any](name string, f func(controller.API, context.Context, *Req) (*Res, error)) rpc {
+	return rpc{
+		name:    name,
+		request: typeOf[Req](),
+		call: func(ctx context.Context, service controller.API, req any) (any, error) {
+			r, _ := req.(*Req)
+			if r == nil {
+				r = new(Req)
 			}
-		}()
+			return f(service, ctx, r)
+		},
+	}
+}
+
+func (t *HTTPTransport) Register() error {
+	t.post("/reading", method("getReading", controller.API.GetReading), false)
+	t.post("/getSystemTime", method("getSystemTime", controller.API.GetSystemTime), false)
+	t.post("/setSystemTime", method("setSystemTime", controller.API.SetSystemTime), true)
+	t.post("/getBatteryInformation", method("getBatteryInformation", controller.API.GetBatteryInformation), false)
+	t.post("/setBatteryCapacity", method("setBatteryCapacity", controller.API.SetBatteryCapacity), true)
+	t.post("/getChargingProfile", method("getChargingProfile", controller.API.GetChargingProfile), false)
+	t.post("/setChargingProfile", method("setChargingProfile", controller.API.SetChargingProfile), true)
+	t.post("/getWriteStatistics", method("getWriteStatistics", controller.API.GetWriteStatistics), false)
+	t.post("/exportSettings", withTimeout(method("exportSettings", controller.API.ExportSettings), controller.SettingsTimeout), false)
+	t.post("/importSettings", withTimeout(method("importSettings", controller.API.ImportSettings), controller.SettingsTimeout), true)
+	t.post("/getAuditLog", method("getAuditLog", controller.API.GetAuditLog), false)
 
+	if err := t.registerV1(); err != nil {
+		return err
+	}
+	t.registerApp()
+
+	return nil
+}
+
+// handle registers handler, requiring the admin role for requests that
+// change settings and the viewer role otherwise.
+func (t *HTTPTransport) handle(method, path string, admin bool, handler gin.HandlerFunc) {
+	role := RoleViewer
+	if admin {
+		role = RoleAdmin
+	}
+	t.engine.Handle(method, path, t.authorize(role), handler)
+}
+
+func (t *HTTPTransport) post(path string, m rpc, admin bool) {
+	t.handle("POST", path, admin, gin.WrapF(t.createHandler(m)))
+}
+
+// createHandler serves the original POST routes. They take the RPC's request
+// as the body and, as when they forwarded it over MQTT, respond with the
+// controller's errors in the body.
+func (t *HTTPTransport) createHandler(m rpc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		data, err := io.ReadAll(r.Body)
 		if err != nil {
 			t.logger.Error("error reading body", zap.Error(err))
@@ -62,19 +140,61 @@ func (t *HTTPTransport) createHandler(topic string) http.HandlerFunc {
 			return
 		}
 
-		requestTopic := strings.Replace(topic, "#", requestID, -1)
-		if token := t.mqttClient.Publish(requestTopic, 0, false, data); token.Wait() && token.Error() != nil {
-			t.logger.Error("error publishing to mqtt", zap.String("topic", "tracer/reading"), zap.Error(token.Error()))
+		req := reflect.New(m.request).Interface()
+		if err := json.Unmarshal(data, req); err != nil {
+			writeJSON(w, http.StatusOK, &errorResponse{Error: "error unmarshalling request"})
 			return
 		}
+		var opts requestOptions
+		if err := json.Unmarshal(data, &opts); err != nil {
+			writeJSON(w, http.StatusOK, &errorResponse{Error: "error unmarshalling request"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), opts.timeout(m))
+		defer cancel()
 
-		select {
-		case data := <-done:
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(data)
-		case <-time.After(5 * time.Second):
-			t.logger.Error("timed out waiting for mqtt reply")
+		res, err := m.call(ctx, t.service, req)
+		if errors.Is(err, transport.ErrTimeout) {
 			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
 		}
+		if err != nil {
+			code, message := t.errorCode(m, err)
+			writeJSON(w, http.StatusOK, &errorResponse{Error: code, Message: message})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// errorCode returns the code and message reported to callers for err. Errors
+// without a code are logged and reported as the controller reports them over
+// MQTT, so callers see the same error whether it is in-process or remote.
+func (t *HTTPTransport) errorCode(m rpc, err error) (code string, message string) {
+	var remote *controller.RemoteError
+	if errors.As(err, &remote) {
+		return remote.Code, remote.Message
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return transport.ErrorBusy, ""
+	}
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) {
+		return coded.ErrorCode(), err.Error()
+	}
+	t.logger.Error("error handling request", zap.String("method", m.name), zap.Error(err))
+	return transport.ErrorHandlingRequest, ""
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
 }
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/alxyng/tracer/controller"
+	"github.com/alxyng/tracer/history"
+)
+
+// schema is a JSON Schema object as used by OpenAPI 3.
+type schema map[string]any
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	durationType  = reflect.TypeOf(time.Duration(0))
+	rawType       = reflect.TypeOf(json.RawMessage{})
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaOverrides describes types whose JSON form can't be derived from
+// their Go type.
+var schemaOverrides = map[reflect.Type]schema{
+	reflect.TypeOf(controller.BatteryType(0)): {
+		"type": "string",
+		"enum": []string{
+			controller.BatteryTypeUserDefined.String(),
+			controller.BatteryTypeSealed.String(),
+			controller.BatteryTypeGel.String(),
+			controller.BatteryTypeFlooded.String(),
+		},
+	},
+	reflect.TypeOf(controller.ChargingMode(0)): {
+		"type": "string",
+		"enum": []string{
+			controller.ChargingModeNone.String(),
+			controller.ChargingModePWM.String(),
+			controller.ChargingModeMPPT.String(),
+		},
+	},
+	reflect.TypeOf(controller.Address(0)): {
+		"type":    "string",
+		"pattern": "^0x[0-9a-f]{4}$",
+	},
+	reflect.TypeOf(controller.HexBytes{}): {
+		"type":    "string",
+		"pattern": "^([0-9a-f]{2})*$",
+	},
+	reflect.TypeOf(history.Bucket("")): {
+		"type": "string",
+		"enum": []history.Bucket{history.BucketRaw, history.BucketMinute, history.BucketHour, history.BucketDay},
+	},
+	reflect.TypeOf(history.Aggregate("")): {
+		"type": "string",
+		"enum": []history.Aggregate{history.AggregateAvg, history.AggregateMin, history.AggregateMax, history.AggregateLast},
+	},
+}
+
+// openAPI builds an OpenAPI 3 document describing routes.
+func openAPI(routes []route) map[string]any {
+	components := map[string]schema{}
+	paths := map[string]map[string]any{}
+
+	errorSchema := schemaFor(reflect.TypeOf(errorResponse{}), components)
+
+	for _, r := range routes {
+		op := map[string]any{
+			"operationId": r.operationID,
+			"summary":     r.summary,
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "OK",
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": schemaFor(r.response, components)},
+					},
+				},
+				"default": map[string]any{
+					"description": "Error",
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": errorSchema},
+					},
+				},
+			},
+		}
+
+		if r.request != nil {
+			if r.method == "GET" {
+				op["parameters"] = queryParameters(r.request, components)
+			} else {
+				op["requestBody"] = map[string]any{
+					"required": true,
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": schemaFor(r.request, components)},
+					},
+				}
+			}
+		}
+
+		if paths[r.path] == nil {
+			paths[r.path] = map[string]any{}
+		}
+		paths[r.path][strings.ToLower(r.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Tracer API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": components,
+		},
+	}
+}
+
+func queryParameters(t reflect.Type, components map[string]schema) []map[string]any {
+	var params []map[string]any
+	for _, f := range jsonFields(t) {
+		params = append(params, map[string]any{
+			"name":     f.name,
+			"in":       "query",
+			"required": false,
+			"schema":   schemaFor(f.typ, components),
+		})
+	}
+	return params
+}
+
+// schemaFor returns the schema of t. Named structs are added to components
+// and referenced.
+func schemaFor(t reflect.Type, components map[string]schema) schema {
+	if s, ok := schemaOverrides[t]; ok {
+		return s
+	}
+
+	switch {
+	case t == timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return schema{"type": "integer", "format": "int64", "description": "Nanoseconds"}
+	case t == rawType:
+		return schema{}
+	case t.Implements(textMarshaler):
+		return schema{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem(), components)
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Float32:
+		return schema{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return schema{"type": "number", "format": "double"}
+	case reflect.Int, reflect.Int64:
+		return schema{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return schema{"type": "integer", "format": "int32"}
+	case reflect.Uint8:
+		return schema{"type": "integer", "minimum": 0, "maximum": 255}
+	case reflect.Uint16:
+		return schema{"type": "integer", "minimum": 0, "maximum": 65535}
+	case reflect.Uint32, reflect.Uint, reflect.Uint64:
+		return schema{"type": "integer", "format": "int64", "minimum": 0}
+	case reflect.Slice, reflect.Array:
+		return schema{"type": "array", "items": schemaFor(t.Elem(), components)}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": schemaFor(t.Elem(), components)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, components)
+		}
+		name := schemaName(t)
+		if _, ok := components[name]; !ok {
+			// Reserve the name first in case the type refers to itself.
+			components[name] = schema{}
+			components[name] = structSchema(t, components)
+		}
+		return schema{"$ref": "#/components/schemas/" + name}
+	}
+
+	return schema{}
+}
+
+// schemaName names t after its Go type, capitalised so unexported types
+// read like the others.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func structSchema(t reflect.Type, components map[string]schema) schema {
+	properties := map[string]schema{}
+	var required []string
+
+	for _, f := range jsonFields(t) {
+		properties[f.name] = schemaFor(f.typ, components)
+		// Flags such as dryRun default to false, so callers can leave them
+		// out.
+		if !f.omitempty && f.typ.Kind() != reflect.Bool {
+			required = append(required, f.name)
+		}
+	}
+
+	s := schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+type jsonField struct {
+	name      string
+	typ       reflect.Type
+	omitempty bool
+}
+
+// jsonFields lists the fields of t as encoding/json sees them, flattening
+// embedded structs.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(f.Type)...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, jsonField{
+			name:      name,
+			typ:       f.Type,
+			omitempty: strings.Contains(opts, "omitempty"),
+		})
+	}
+
+	return fields
+}
@@ -0,0 +1,383 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/alxyng/tracer/controller"
+	"github.com/alxyng/tracer/internal/transport"
+	"github.com/gin-gonic/gin"
+)
+
+const requestTimeout = 5 * time.Second
+
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+// batteryPatch is the body of PATCH /v1/battery. Only the capacity can be
+// changed.
+type batteryPatch struct {
+	Capacity *uint16 `json:"capacity,omitempty"`
+	DryRun   bool    `json:"dryRun"`
+}
+
+// route maps a REST endpoint onto an RPC. For GET routes the request is read
+// from the query string, otherwise from the body.
+type route struct {
+	method      string
+	path        string
+	operationID string
+	summary     string
+	rpc         rpc
+	admin       bool
+	request     reflect.Type
+	response    reflect.Type
+
+	// convert turns the decoded request into the RPC's request, if they
+	// differ.
+	convert func(req any) (any, error)
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+var routes = []route{
+	{
+		method:      "GET",
+		path:        "/v1/reading",
+		operationID: "getReading",
+		summary:     "Get the latest reading",
+		rpc:         method("getReading", controller.API.GetReading),
+		response:    typeOf[controller.GetReadingResponse](),
+	},
+	{
+		method:      "GET",
+		path:        "/v1/system-time",
+		operationID: "getSystemTime",
+		summary:     "Get the controller's clock",
+		rpc:         method("getSystemTime", controller.API.GetSystemTime),
+		response:    typeOf[controller.GetSystemTimeResponse](),
+	},
+	{
+		method:      "PUT",
+		path:        "/v1/system-time",
+		operationID: "setSystemTime",
+		summary:     "Set the controller's clock",
+		rpc:         method("setSystemTime", controller.API.SetSystemTime),
+		admin:       true,
+		request:     typeOf[controller.SetSystemTimeRequest](),
+		response:    typeOf[controller.SetSystemTimeResponse](),
+	},
+	{
+		method:      "GET",
+		path:        "/v1/battery",
+		operationID: "getBattery",
+		summary:     "Get the battery type and capacity",
+		rpc:         method("getBatteryInformation", controller.API.GetBatteryInformation),
+		response:    typeOf[controller.GetBatteryInformationResponse](),
+	},
+	{
+		method:      "PATCH",
+		path:        "/v1/battery",
+		operationID: "updateBattery",
+		summary:     "Change the battery capacity",
+		rpc:         method("setBatteryCapacity", controller.API.SetBatteryCapacity),
+		admin:       true,
+		request:     typeOf[batteryPatch](),
+		response:    typeOf[controller.SetBatteryCapacityResponse](),
+		convert: func(req any) (any, error) {
+			patch := req.(*batteryPatch)
+			if patch.Capacity == nil {
+				return nil, errors.New("capacity is required")
+			}
+			return &controller.SetBatteryCapacityRequest{Capacity: *patch.Capacity, DryRun: patch.DryRun}, nil
+		},
+	},
+	{
+		method:      "GET",
+		path:        "/v1/rated-data",
+		operationID: "getRatedData",
+		summary:     "Get the controller's rated input and output",
+		rpc:         method("getRatedData", controller.API.GetRatedData),
+		response:    typeOf[controller.GetRatedDataResponse](),
+	},
+	{
+		method:      "GET",
+		path:        "/v1/charging-profile",
+		operationID: "getChargingProfile",
+		summary:     "Get the battery voltage thresholds",
+		rpc:         method("getChargingProfile", controller.API.GetChargingProfile),
+		response:    typeOf[controller.GetChargingProfileResponse](),
+	},
+	{
+		method:      "PUT",
+		path:        "/v1/charging-profile",
+		operationID: "setChargingProfile",
+		summary:     "Set the battery voltage thresholds",
+		rpc:         method("setChargingProfile", controller.API.SetChargingProfile),
+		admin:       true,
+		request:     typeOf[controller.SetChargingProfileRequest](),
+		response:    typeOf[controller.SetChargingProfileResponse](),
+	},
+	{
+		method:      "GET",
+		path:        "/v1/settings",
+		operationID: "exportSettings",
+		summary:     "Export every writable setting",
+		rpc:         withTimeout(method("exportSettings", controller.API.ExportSettings), controller.SettingsTimeout),
+		response:    typeOf[controller.ExportSettingsResponse](),
+	},
+	{
+		method:      "PUT",
+		path:        "/v1/settings",
+		operationID: "importSettings",
+		summary:     "Apply the settings that differ from the controller",
+		rpc:         withTimeout(method("importSettings", controller.API.ImportSettings), controller.SettingsTimeout),
+		admin:       true,
+		request:     typeOf[controller.ImportSettingsRequest](),
+		response:    typeOf[controller.ImportSettingsResponse](),
+	},
+	{
+		method:      "GET",
+		path:        "/v1/write-statistics",
+		operationID: "getWriteStatistics",
+		summary:     "Get the number of register writes made",
+		rpc:         method("getWriteStatistics", controller.API.GetWriteStatistics),
+		response:    typeOf[controller.GetWriteStatisticsResponse](),
+	},
+	{
+		method:      "GET",
+		path:        "/v1/audit-log",
+		operationID: "getAuditLog",
+		summary:     "List recent setting changes, newest first",
+		rpc:         method("getAuditLog", controller.API.GetAuditLog),
+		request:     typeOf[controller.GetAuditLogRequest](),
+		response:    typeOf[controller.GetAuditLogResponse](),
+	},
+	{
+		method:      "POST",
+		path:        "/v1/batch",
+		operationID: "batch",
+		summary:     "Make several read-only calls at once",
+		rpc:         method("batch", controller.API.Batch),
+		request:     typeOf[controller.BatchRequest](),
+		response:    typeOf[controller.BatchResponse](),
+	},
+}
+
+// errorStatus maps the error codes returned by the controller to HTTP status
+// codes.
+var errorStatus = map[string]int{
+	"invalidRequest":              http.StatusBadRequest,
+	"writeRejected":               http.StatusTooManyRequests,
+	transport.ErrorBusy:           http.StatusServiceUnavailable,
+	transport.ErrorUnauthorized:   http.StatusForbidden,
+	"verificationFailed":          http.StatusBadGateway,
+	"transactionFailed":           http.StatusBadGateway,
+	"error unmarshalling request": http.StatusBadRequest,
+}
+
+func (t *HTTPTransport) registerV1() error {
+	// Build the document first so nothing is registered if it can't be.
+	doc := openAPI(routes)
+	if t.hub != nil {
+		doc["paths"].(map[string]map[string]any)["/v1/stream"] = map[string]any{"get": streamOperation()}
+	}
+	if t.history != nil {
+		addHistoryPaths(doc)
+	}
+	if t.auth != nil {
+		doc["components"].(map[string]any)["securitySchemes"] = map[string]any{
+			"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"},
+			"apiKey":     map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+		}
+		doc["security"] = []map[string][]string{{"bearerAuth": {}}, {"apiKey": {}}}
+	}
+
+	spec, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("building openapi document: %w", err)
+	}
+
+	for _, r := range routes {
+		t.handle(r.method, r.path, r.admin, gin.WrapF(t.createRESTHandler(r)))
+	}
+	if t.hub != nil {
+		t.handle("GET", "/v1/stream", false, gin.WrapH(t.hub))
+	}
+	if t.history != nil {
+		t.registerHistory()
+	}
+	t.engine.GET("/v1/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", spec)
+	})
+
+	return nil
+}
+
+func (t *HTTPTransport) createRESTHandler(r route) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rpcReq, opts, err := decodeRequest(r, req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalidRequest", err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), opts.timeout(r.rpc))
+		defer cancel()
+
+		res, err := r.rpc.call(ctx, t.service, rpcReq)
+		if errors.Is(err, transport.ErrTimeout) {
+			writeError(w, http.StatusGatewayTimeout, "timeout", "")
+			return
+		}
+		if err != nil {
+			code, message := t.errorCode(r.rpc, err)
+			status, ok := errorStatus[code]
+			if !ok {
+				status = http.StatusInternalServerError
+			}
+			writeError(w, status, code, message)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// decodeRequest reads the route's request from req and returns the request
+// of the RPC, or nil if the route takes none, along with the options set
+// alongside it.
+func decodeRequest(r route, req *http.Request) (any, requestOptions, error) {
+	var opts requestOptions
+
+	if r.method == "GET" {
+		if value := req.URL.Query().Get("timeoutMs"); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, opts, errors.New("timeoutMs must be a number")
+			}
+			opts.TimeoutMs = n
+		}
+	}
+
+	if r.request == nil {
+		return nil, opts, nil
+	}
+
+	var data []byte
+	if r.method == "GET" {
+		var err error
+		if data, err = queryToJSON(r.request, req); err != nil {
+			return nil, opts, err
+		}
+	} else {
+		var err error
+		if data, err = io.ReadAll(req.Body); err != nil {
+			return nil, opts, err
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, opts, errors.New("request body is required")
+		}
+		if data, err = takeOptions(data, &opts); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	// Decode strictly so typos in field names are reported rather than
+	// silently ignored.
+	v := reflect.New(r.request).Interface()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return nil, opts, err
+	}
+
+	if r.convert != nil {
+		req, err := r.convert(v)
+		return req, opts, err
+	}
+	return v, opts, nil
+}
+
+// takeOptions reads the request options from a JSON object and removes them
+// from it.
+func takeOptions(data []byte, opts *requestOptions) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		// Leave reporting the error to the strict decoder.
+		return data, nil
+	}
+
+	timeout, ok := fields["timeoutMs"]
+	if !ok {
+		return data, nil
+	}
+	if err := json.Unmarshal(timeout, &opts.TimeoutMs); err != nil {
+		return nil, errors.New("timeoutMs must be a number")
+	}
+	delete(fields, "timeoutMs")
+	return json.Marshal(fields)
+}
+
+// queryToJSON turns the query string into a JSON object with the fields of
+// t, converting numbers and booleans.
+func queryToJSON(t reflect.Type, req *http.Request) ([]byte, error) {
+	query := req.URL.Query()
+	fields := map[string]any{}
+
+	// timeoutMs is read by decodeRequest.
+	query.Del("timeoutMs")
+
+	for _, f := range jsonFields(t) {
+		value := query.Get(f.name)
+		if value == "" {
+			continue
+		}
+		query.Del(f.name)
+
+		switch f.typ.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, f.typ.Bits())
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", f.name)
+			}
+			fields[f.name] = n
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(value, 10, f.typ.Bits())
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number from 0 to %d", f.name, uint64(1)<<f.typ.Bits()-1)
+			}
+			fields[f.name] = n
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be true or false", f.name)
+			}
+			fields[f.name] = b
+		default:
+			fields[f.name] = value
+		}
+	}
+
+	for name := range query {
+		return nil, fmt.Errorf("unknown parameter %q", name)
+	}
+
+	return json.Marshal(fields)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, &errorResponse{Error: code, Message: message})
+}
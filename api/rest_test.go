@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/controller"
+	"github.com/alxyng/tracer/internal/transport"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// fakeAPI answers the calls the tests make and records their deadlines.
+type fakeAPI struct {
+	controller.API
+
+	err      error
+	deadline time.Duration
+	capacity uint16
+}
+
+func (f *fakeAPI) record(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		f.deadline = time.Until(deadline).Round(time.Second)
+	}
+}
+
+func (f *fakeAPI) GetSystemTime(ctx context.Context, req *controller.GetSystemTimeRequest) (*controller.GetSystemTimeResponse, error) {
+	f.record(ctx)
+	return &controller.GetSystemTimeResponse{}, f.err
+}
+
+func (f *fakeAPI) SetBatteryCapacity(ctx context.Context, req *controller.SetBatteryCapacityRequest) (*controller.SetBatteryCapacityResponse, error) {
+	f.record(ctx)
+	f.capacity = req.Capacity
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &controller.SetBatteryCapacityResponse{Changes: []controller.RegisterChange{}}, nil
+}
+
+func (f *fakeAPI) ImportSettings(ctx context.Context, req *controller.ImportSettingsRequest) (*controller.ImportSettingsResponse, error) {
+	f.record(ctx)
+	return &controller.ImportSettingsResponse{}, f.err
+}
+
+func newTestServer(t *testing.T, service controller.API) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	if err := NewHTTPTransport(engine, service, nil, nil, nil, zap.NewNop()).Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func do(t *testing.T, method, url, body string) (int, errorResponse) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var errRes errorResponse
+	json.NewDecoder(res.Body).Decode(&errRes)
+	return res.StatusCode, errRes
+}
+
+func TestRESTTimeout(t *testing.T) {
+	service := &fakeAPI{}
+	server := newTestServer(t, service)
+
+	status, _ := do(t, "PATCH", server.URL+"/v1/battery", `{"capacity": 100, "timeoutMs": 30000}`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if service.capacity != 100 || service.deadline != 30*time.Second {
+		t.Errorf("capacity = %d, deadline = %s, want 100 and 30s", service.capacity, service.deadline)
+	}
+
+	if status, _ := do(t, "GET", server.URL+"/v1/system-time?timeoutMs=20000", ""); status != http.StatusOK || service.deadline != 20*time.Second {
+		t.Errorf("status = %d, deadline = %s, want 200 and 20s", status, service.deadline)
+	}
+
+	if status, _ := do(t, "GET", server.URL+"/v1/system-time", ""); status != http.StatusOK || service.deadline != requestTimeout {
+		t.Errorf("status = %d, deadline = %s, want 200 and %s", status, service.deadline, requestTimeout)
+	}
+
+	if status, _ := do(t, "PUT", server.URL+"/v1/settings", `{"settings": {"version": 1}}`); status != http.StatusOK || service.deadline != controller.SettingsTimeout.Round(time.Second) {
+		t.Errorf("status = %d, deadline = %s, want 200 and %s", status, service.deadline, controller.SettingsTimeout)
+	}
+
+	// Other unknown fields are still rejected.
+	if status, res := do(t, "PATCH", server.URL+"/v1/battery", `{"capacity": 100, "capacty": 100}`); status != http.StatusBadRequest {
+		t.Errorf("status = %d (%+v), want 400", status, res)
+	}
+	if status, _ := do(t, "PATCH", server.URL+"/v1/battery", `{"capacity": 100, "timeoutMs": "soon"}`); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", status)
+	}
+}
+
+func TestRESTErrorStatus(t *testing.T) {
+	tests := []struct {
+		code   string
+		status int
+	}{
+		{transport.ErrorUnauthorized, http.StatusForbidden},
+		{"writeRejected", http.StatusTooManyRequests},
+		{transport.ErrorBusy, http.StatusServiceUnavailable},
+		{"invalidRequest", http.StatusBadRequest},
+		{"somethingElse", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			server := newTestServer(t, &fakeAPI{err: &controller.RemoteError{Code: tt.code}})
+
+			status, res := do(t, "PATCH", server.URL+"/v1/battery", `{"capacity": 100}`)
+			if status != tt.status || res.Error != tt.code {
+				t.Errorf("got %d %q, want %d %q", status, res.Error, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	server := newTestServer(t, &fakeAPI{})
+
+	res, err := http.Get(server.URL + "/v1/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var doc struct {
+		Paths map[string]map[string]any `json:"paths"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range routes {
+		if _, ok := doc.Paths[r.path][strings.ToLower(r.method)]; !ok {
+			t.Errorf("%s %s missing from document", r.method, r.path)
+		}
+	}
+}
+
+func TestQueryToJSON(t *testing.T) {
+	type params struct {
+		Count  uint16 `json:"count"`
+		Offset int8   `json:"offset"`
+		Flag   bool   `json:"flag"`
+		Name   string `json:"name"`
+	}
+
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{"count=65535&offset=-5&flag=true&name=x", `{"count":65535,"flag":true,"name":"x","offset":-5}`, false},
+		{"count=-1", "", true},
+		{"count=65536", "", true},
+		{"offset=200", "", true},
+		{"flag=maybe", "", true},
+		{"other=1", "", true},
+		{"timeoutMs=100", `{}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/?"+tt.query, nil)
+			data, err := queryToJSON(reflect.TypeOf(params{}), req)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %s, want error", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+// TestUncodedErrors checks an in-process controller's errors without a code
+// are reported as a remote controller reports them.
+func TestUncodedErrors(t *testing.T) {
+	server := newTestServer(t, &fakeAPI{err: errors.New("modbus: connection reset")})
+
+	status, res := do(t, "PATCH", server.URL+"/v1/battery", `{"capacity": 100}`)
+	if status != http.StatusInternalServerError || res.Error != transport.ErrorHandlingRequest || res.Message != "" {
+		t.Errorf("REST: got %d %+v", status, res)
+	}
+
+	status, res = do(t, "POST", server.URL+"/setBatteryCapacity", `{"capacity": 100}`)
+	if status != http.StatusOK || res.Error != transport.ErrorHandlingRequest {
+		t.Errorf("legacy: got %d %+v", status, res)
+	}
+
+	server = newTestServer(t, &fakeAPI{err: context.DeadlineExceeded})
+	if status, res := do(t, "POST", server.URL+"/setBatteryCapacity", `{"capacity": 100}`); status != http.StatusOK || res.Error != transport.ErrorBusy {
+		t.Errorf("legacy deadline: got %d %+v", status, res)
+	}
+}
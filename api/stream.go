@@ -0,0 +1,303 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alxyng/tracer/controller"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// streamBuffer is the number of readings queued for a client before further
+// readings are dropped for it.
+const streamBuffer = 16
+
+const streamKeepAlive = 15 * time.Second
+const streamWriteTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// readingFields is the set of JSON fields of a reading clients can select.
+var readingFields = func() map[string]bool {
+	fields := map[string]bool{}
+	for _, f := range jsonFields(reflect.TypeOf(controller.Reading{})) {
+		fields[f.name] = true
+	}
+	return fields
+}()
+
+// streamEvent is a reading encoded once for every client.
+type streamEvent struct {
+	time   time.Time
+	data   []byte
+	fields map[string]json.RawMessage
+}
+
+// encode returns the event's JSON, limited to fields if any are given.
+func (e *streamEvent) encode(fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return e.data, nil
+	}
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		selected[f] = e.fields[f]
+	}
+	return json.Marshal(selected)
+}
+
+type streamClient struct {
+	events   chan *streamEvent
+	fields   []string
+	interval time.Duration
+	last     time.Time
+}
+
+func NewStreamHub(logger *zap.Logger) *StreamHub {
+	return &StreamHub{
+		clients: make(map[*streamClient]struct{}),
+		logger:  logger,
+	}
+}
+
+// StreamHub fans readings from a single subscription out to streaming
+// clients.
+type StreamHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	logger  *zap.Logger
+	dropped uint64
+}
+
+// Publish sends reading to every client that is due one. It is suitable for
+// use with controller.Subscriber.
+func (h *StreamHub) Publish(ctx context.Context, reading *controller.Reading) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.clients) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(reading)
+	if err != nil {
+		h.logger.Error("error marshalling reading", zap.Error(err))
+		return
+	}
+
+	event := &streamEvent{time: reading.EndTime, data: data}
+	if err := json.Unmarshal(data, &event.fields); err != nil {
+		h.logger.Error("error unmarshalling reading", zap.Error(err))
+		return
+	}
+
+	for c := range h.clients {
+		if c.interval > 0 && event.time.Sub(c.last) < c.interval {
+			continue
+		}
+
+		select {
+		case c.events <- event:
+			c.last = event.time
+		default:
+			atomic.AddUint64(&h.dropped, 1)
+		}
+	}
+}
+
+// Clients returns the number of connected clients.
+func (h *StreamHub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.clients)
+}
+
+func (h *StreamHub) add(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.clients[c] = struct{}{}
+}
+
+func (h *StreamHub) remove(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.clients, c)
+}
+
+// ServeHTTP streams readings as server-sent events, or over a WebSocket if
+// the request asks to upgrade. The fields query parameter selects reading
+// fields and interval sets the minimum time between readings.
+func (h *StreamHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := newStreamClient(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidRequest", err.Error())
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r, c)
+		return
+	}
+	h.serveEvents(w, r, c)
+}
+
+func newStreamClient(r *http.Request) (*streamClient, error) {
+	c := &streamClient{events: make(chan *streamEvent, streamBuffer)}
+
+	if fields := r.URL.Query().Get("fields"); fields != "" {
+		for _, f := range strings.Split(fields, ",") {
+			if !readingFields[f] {
+				return nil, fmt.Errorf("unknown field %q", f)
+			}
+			c.fields = append(c.fields, f)
+		}
+	}
+
+	if interval := r.URL.Query().Get("interval"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid interval %q", interval)
+		}
+		c.interval = d
+	}
+
+	return c, nil
+}
+
+func (h *StreamHub) serveEvents(w http.ResponseWriter, r *http.Request, c *streamClient) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streamingUnsupported", "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	h.add(c)
+	defer h.remove(c)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-c.events:
+			data, err := event.encode(c.fields)
+			if err != nil {
+				h.logger.Error("error encoding reading", zap.Error(err))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: reading\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *StreamHub) serveWebSocket(w http.ResponseWriter, r *http.Request, c *streamClient) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already responded to the client.
+		h.logger.Warn("error upgrading to websocket", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	h.add(c)
+	defer h.remove(c)
+
+	// Clients don't send anything, but reading is needed to handle control
+	// frames and notice when the connection closes.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+		case event := <-c.events:
+			data, err := event.encode(c.fields)
+			if err != nil {
+				h.logger.Error("error encoding reading", zap.Error(err))
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamOperation describes /v1/stream in the OpenAPI document.
+func streamOperation() map[string]any {
+	return map[string]any{
+		"operationId": "streamReadings",
+		"summary":     "Stream readings as server-sent events, or over a WebSocket when upgraded",
+		"parameters": []map[string]any{
+			{
+				"name":        "fields",
+				"in":          "query",
+				"required":    false,
+				"description": "Comma separated reading fields to include",
+				"schema":      schema{"type": "string"},
+			},
+			{
+				"name":        "interval",
+				"in":          "query",
+				"required":    false,
+				"description": "Minimum time between readings, such as 10s",
+				"schema":      schema{"type": "string"},
+			},
+		},
+		"responses": map[string]any{
+			"200": map[string]any{
+				"description": "A reading event for every reading",
+				"content": map[string]any{
+					"text/event-stream": map[string]any{
+						"schema": schema{"$ref": "#/components/schemas/Reading"},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/controller"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func waitForClients(t *testing.T, hub *StreamHub, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.Clients() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("clients = %d, want %d", hub.Clients(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testStreamReading(at time.Time, voltage float32) *controller.Reading {
+	return &controller.Reading{EndTime: at, BatteryVoltage: voltage}
+}
+
+func TestStreamEvents(t *testing.T) {
+	hub := NewStreamHub(zap.NewNop())
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?fields=batteryVoltage&interval=10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type = %q", ct)
+	}
+	waitForClients(t, hub, 1)
+
+	// The second reading is within the interval, so only the first and
+	// third are sent.
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	hub.Publish(context.Background(), testStreamReading(start, 12.5))
+	hub.Publish(context.Background(), testStreamReading(start.Add(5*time.Second), 12.6))
+	hub.Publish(context.Background(), testStreamReading(start.Add(10*time.Second), 12.7))
+
+	scanner := bufio.NewScanner(res.Body)
+	var data []string
+	for len(data) < 2 && scanner.Scan() {
+		if line, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			data = append(data, line)
+		}
+	}
+
+	want := []string{`{"batteryVoltage":12.5}`, `{"batteryVoltage":12.7}`}
+	for i := range want {
+		if i >= len(data) || data[i] != want[i] {
+			t.Fatalf("events = %v, want %v", data, want)
+		}
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	hub := NewStreamHub(zap.NewNop())
+	server := httptest.NewServer(hub)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForClients(t, hub, 1)
+
+	hub.Publish(context.Background(), testStreamReading(time.Now(), 13.1))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reading controller.Reading
+	if err := json.Unmarshal(data, &reading); err != nil {
+		t.Fatal(err)
+	}
+	if reading.BatteryVoltage != 13.1 {
+		t.Errorf("battery voltage = %v, want 13.1", reading.BatteryVoltage)
+	}
+
+	// Closing the connection removes the client.
+	conn.Close()
+	waitForClients(t, hub, 0)
+}
+
+func TestStreamInvalidParameters(t *testing.T) {
+	hub := NewStreamHub(zap.NewNop())
+
+	for _, query := range []string{"fields=batteryVoltage,nope", "interval=soon", "interval=-1s"} {
+		rec := httptest.NewRecorder()
+		hub.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/stream?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestStreamDropsForSlowClients(t *testing.T) {
+	hub := NewStreamHub(zap.NewNop())
+
+	slow := &streamClient{events: make(chan *streamEvent, streamBuffer)}
+	hub.add(slow)
+
+	start := time.Now()
+	for i := 0; i < streamBuffer+4; i++ {
+		hub.Publish(context.Background(), testStreamReading(start.Add(time.Duration(i)*time.Second), 12))
+	}
+
+	if len(slow.events) != streamBuffer || hub.dropped != 4 {
+		t.Errorf("queued %d and dropped %d, want %d and 4", len(slow.events), hub.dropped, streamBuffer)
+	}
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/alxyng/tracer/api"
+	"github.com/alxyng/tracer/controller"
+	"github.com/alxyng/tracer/history"
 	"github.com/alxyng/tracer/internal/config"
+	"github.com/alxyng/tracer/internal/metrics"
+	"github.com/alxyng/tracer/internal/modbus"
+	"github.com/alxyng/tracer/internal/sqlite"
+	"github.com/alxyng/tracer/internal/transport"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
 
@@ -26,27 +35,164 @@ func main() {
 		logger.Fatal("error getting config", zap.Error(err))
 	}
 
+	hub := api.NewStreamHub(logger)
+	registry := metrics.NewRegistry()
+
+	var service controller.API
+	switch cfg.API.Mode {
+	case config.APIModeDirect:
+		service = directService(cfg, registry, hub, logger)
+	default:
+		service = remoteService(cfg, registry, hub, logger)
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	// router.Use(ginzap.Ginzap(logger, time.RFC3339, true))
+	router.Use(ginzap.RecoveryWithZap(logger, true))
+
+	var store history.Store
+	if cfg.API.History && cfg.API.HistoryStore == config.WriterSinkSQLite {
+		db, err := sqlite.Open(cfg.SQLite.Path)
+		if err != nil {
+			logger.Fatal("error opening sqlite database", zap.String("path", cfg.SQLite.Path), zap.Error(err))
+		}
+		defer db.Close()
+
+		store = history.NewSQLiteStore(db)
+	} else if cfg.API.History {
+		pool, err := pgxpool.New(context.Background(), cfg.Database.DSN)
+		if err != nil {
+			logger.Fatal("error creating database pool", zap.Error(err))
+		}
+		defer pool.Close()
+
+		store = history.NewPostgresStore(pool)
+	}
+
+	auth, err := authenticator(cfg.API)
+	if err != nil {
+		logger.Fatal("error configuring authentication", zap.Error(err))
+	}
+	if auth == nil {
+		logger.Warn("authentication is disabled, set TRACER_API_KEYS or TRACER_API_TOKEN_SECRET to enable it")
+	}
+
+	httpTransport := api.NewHTTPTransport(router, service, hub, store, auth, logger)
+	if err := httpTransport.Register(); err != nil {
+		logger.Fatal("error registering http routes", zap.Error(err))
+	}
+
+	registry.GaugeFunc("tracer_api_stream_clients", "Clients streaming readings", func() float64 {
+		return float64(hub.Clients())
+	})
+	router.GET("/metrics", gin.WrapH(registry))
+
+	logger.Info("starting http server", zap.String("addr", cfg.API.Addr))
+	router.Run(cfg.API.Addr)
+}
+
+// remoteService returns a controller.Remote forwarding requests to
+// tracer-controller over MQTT.
+func remoteService(cfg *config.Config, registry *metrics.Registry, hub *api.StreamHub, logger *zap.Logger) controller.API {
+	var signer *transport.Signer
+	if cfg.Auth.ClientID != "" && cfg.Auth.Key != "" {
+		signer = transport.NewSigner(cfg.Auth.ClientID, []byte(cfg.Auth.Key))
+	}
+
+	requester := transport.NewRequester(controller.RequestTopics, registry, logger)
+
+	var remote *controller.Remote
+
+	// Subscribe on every connect so the stream survives a reconnect.
+	onConnect := func(c mqtt.Client) {
+		logger.Info("connected to mqtt")
+
+		if err := remote.Subscribe(c); err != nil {
+			logger.Error("error subscribing to mqtt topics", zap.Error(err))
+		}
+	}
+
 	// mqtt.DEBUG = log.New(os.Stdout, "", 0)
 	// mqtt.ERROR = log.New(os.Stdout, "", 0)
 	opts := mqtt.NewClientOptions().
 		AddBroker(cfg.MQTT.Broker).
 		SetClientID(ServiceName).
 		SetKeepAlive(2 * time.Second).
-		SetPingTimeout(1 * time.Second)
+		SetPingTimeout(1 * time.Second).
+		SetOnConnectHandler(onConnect)
 
 	mqttClient := mqtt.NewClient(opts)
+	remote = controller.NewRemote(mqttClient, requester, signer, logger)
+	remote.OnRecord(hub.Publish)
+
 	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		log.Fatal("error connecting to mqtt", zap.Error(token.Error()))
 	}
 
-	gin.SetMode(gin.ReleaseMode)
-	router := gin.New()
-	// router.Use(ginzap.Ginzap(logger, time.RFC3339, true))
-	router.Use(ginzap.RecoveryWithZap(logger, true))
+	registry.GaugeFunc("tracer_mqtt_connected", "Whether the broker connection is open", func() float64 {
+		if mqttClient.IsConnectionOpen() {
+			return 1
+		}
+		return 0
+	})
 
-	transport := api.NewHTTPTransport(router, mqttClient, logger)
-	transport.Register()
+	return remote
+}
 
-	logger.Info("starting http server", zap.String("addr", cfg.API.Addr))
-	router.Run(cfg.API.Addr)
+// directService returns a controller.Service driving the device itself, for
+// running without a broker. tracer-controller must not use the same device at
+// the same time.
+func directService(cfg *config.Config, registry *metrics.Registry, hub *api.StreamHub, logger *zap.Logger) controller.API {
+	// The connection and audit log stay open for the life of the process.
+	_, client, err := modbus.Connect(cfg.Modbus)
+	if err != nil {
+		logger.Fatal("unable to initiate Modbus RTU connection", zap.Error(err))
+	}
+	client = modbus.Instrument(client, registry)
+
+	auditLog, err := controller.OpenAuditLog(cfg.Audit.File)
+	if err != nil {
+		logger.Fatal("unable to open audit log", zap.String("file", cfg.Audit.File), zap.Error(err))
+	}
+
+	guard, err := controller.OpenWriteGuard(cfg.Controller.WriteGuardFile, cfg.Controller.WriteInterval, cfg.Controller.WriteBudget)
+	if err != nil {
+		logger.Fatal("unable to open write counts", zap.String("file", cfg.Controller.WriteGuardFile), zap.Error(err))
+	}
+	service := controller.NewService(client, guard, auditLog, logger)
+	service.OnRecord(hub.Publish)
+	service.OnRecord(controller.NewReadingMetrics(registry, cfg.Metrics.DeviceID).Record)
+
+	logger.Info("running controller in-process")
+	go service.Run(context.Background())
+
+	return service
+}
+
+// authenticator returns an authenticator for the configured API keys and
+// token secret, or nil if there are none.
+func authenticator(cfg *config.APIConfig) (api.Authenticator, error) {
+	var auth api.Authenticators
+
+	if len(cfg.Keys) > 0 {
+		keys := make(map[string]*api.Principal, len(cfg.Keys))
+		for key, k := range cfg.Keys {
+			role, err := api.ParseRole(k.Role)
+			if err != nil {
+				return nil, fmt.Errorf("api key %s: %w", k.Name, err)
+			}
+			keys[key] = &api.Principal{Name: k.Name, Role: role}
+		}
+		auth = append(auth, api.NewKeyAuthenticator(keys))
+	}
+
+	if cfg.TokenSecret != "" {
+		auth = append(auth, api.NewTokenAuthenticator([]byte(cfg.TokenSecret)))
+	}
+
+	if len(auth) == 0 {
+		return nil, nil
+	}
+	return auth, nil
 }
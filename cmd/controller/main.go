@@ -2,13 +2,20 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"log"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/alxyng/tracer/controller"
 	"github.com/alxyng/tracer/internal/config"
+	"github.com/alxyng/tracer/internal/metrics"
 	"github.com/alxyng/tracer/internal/modbus"
+	"github.com/alxyng/tracer/internal/queue"
+	"github.com/alxyng/tracer/internal/transport"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"go.uber.org/zap"
 )
@@ -16,7 +23,8 @@ import (
 const ServiceName = "tracer-controller"
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	logger, err := zap.NewProduction()
 	if err != nil {
@@ -29,11 +37,73 @@ func main() {
 		logger.Fatal("error getting config", zap.Error(err))
 	}
 
+	registry := metrics.NewRegistry()
+
 	handler, client, err := modbus.Connect(cfg.Modbus)
 	if err != nil {
 		logger.Fatal("unable to initiate Modbus RTU connection", zap.Error(err))
 	}
 	defer handler.Close()
+	client = modbus.Instrument(client, registry)
+
+	encoding, err := controller.ParseEncoding(cfg.MQTT.ReadingEncoding)
+	if err != nil {
+		logger.Fatal("invalid reading encoding", zap.Error(err))
+	}
+
+	spool, err := queue.Open(cfg.Spool.Dir, cfg.Spool.MaxBytes)
+	if err != nil {
+		logger.Fatal("unable to open spool", zap.String("dir", cfg.Spool.Dir), zap.Error(err))
+	}
+	defer spool.Close()
+
+	auditLog, err := controller.OpenAuditLog(cfg.Audit.File)
+	if err != nil {
+		logger.Fatal("unable to open audit log", zap.String("file", cfg.Audit.File), zap.Error(err))
+	}
+	defer auditLog.Close()
+
+	guard, err := controller.OpenWriteGuard(cfg.Controller.WriteGuardFile, cfg.Controller.WriteInterval, cfg.Controller.WriteBudget)
+	if err != nil {
+		logger.Fatal("unable to open write counts", zap.String("file", cfg.Controller.WriteGuardFile), zap.Error(err))
+	}
+	service := controller.NewService(client, guard, auditLog, logger)
+
+	var mqttTransport *controller.MQTTTransport
+	var publisher *controller.Publisher
+	var sparkplugNode *controller.SparkplugNode
+	if cfg.Sparkplug.Enabled {
+		sparkplugNode, err = controller.NewSparkplugNode(service, cfg.Sparkplug.GroupID, cfg.Sparkplug.EdgeNodeID, cfg.Sparkplug.DeviceID, cfg.Sparkplug.BdSeqFile, len(cfg.Auth.Keys) > 0, logger)
+		if err != nil {
+			logger.Fatal("unable to create sparkplug node", zap.Error(err))
+		}
+	}
+
+	var numConns, numConnLosts uint64
+
+	onConnect := func(c mqtt.Client) {
+		atomic.AddUint64(&numConns, 1)
+		logger.Info("connected to mqtt")
+
+		if err := mqttTransport.Register(); err != nil {
+			logger.Error("error registering mqtt transport", zap.Error(err))
+		}
+		if err := publisher.PublishMetadata(); err != nil {
+			logger.Error("error publishing metadata", zap.Error(err))
+		}
+		publisher.Wake()
+
+		if sparkplugNode != nil {
+			if err := sparkplugNode.OnConnect(c); err != nil {
+				logger.Error("error starting sparkplug node", zap.Error(err))
+			}
+		}
+	}
+
+	onConnectionLost := func(c mqtt.Client, err error) {
+		atomic.AddUint64(&numConnLosts, 1)
+		logger.Error("mqtt connection lost", zap.Error(err))
+	}
 
 	// mqtt.DEBUG = log.New(os.Stdout, "", 0)
 	// mqtt.ERROR = log.New(os.Stdout, "", 0)
@@ -41,29 +111,90 @@ func main() {
 		AddBroker(cfg.MQTT.Broker).
 		SetClientID(ServiceName).
 		SetKeepAlive(2 * time.Second).
-		SetPingTimeout(1 * time.Second)
+		SetPingTimeout(1 * time.Second).
+		SetConnectRetry(true).
+		SetOnConnectHandler(onConnect).
+		SetConnectionLostHandler(onConnectionLost)
+
+	if sparkplugNode != nil {
+		topic, payload := sparkplugNode.Will()
+		opts.SetBinaryWill(topic, payload, 1, false)
+		opts.SetReconnectingHandler(sparkplugNode.OnReconnecting)
+	}
 
 	mqttClient := mqtt.NewClient(opts)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal("error connecting to mqtt", zap.Error(token.Error()))
+
+	publisher = controller.NewPublisher(mqttClient, spool, encoding, logger)
+	service.OnRecord(publisher.Publish)
+	service.OnRecord(controller.NewReadingMetrics(registry, cfg.Metrics.DeviceID).Record)
+	auditLog.OnAppend(publisher.PublishAudit)
+	if sparkplugNode != nil {
+		service.OnRecord(sparkplugNode.Publish)
+		go sparkplugNode.Run(ctx)
 	}
 
-	service := controller.NewService(client, logger)
-	service.OnRecord(func(ctx context.Context, reading *controller.Reading) {
-		payload, err := json.Marshal(reading)
-		if err != nil {
-			logger.Error("error marshalling reading", zap.Error(err))
-			return
-		}
-		if token := mqttClient.Publish("tracer/reading", 0, false, payload); token.Wait() && token.Error() != nil {
-			logger.Error("error publishing to mqtt", zap.String("topic", "tracer/reading"), zap.Error(token.Error()))
-			return
+	pool := transport.NewPool(cfg.Controller.Workers, cfg.Controller.RequestTimeout)
+
+	var verifier *transport.Verifier
+	if len(cfg.Auth.Keys) > 0 {
+		keys := make(map[string][]byte)
+		for clientID, key := range cfg.Auth.Keys {
+			keys[clientID] = []byte(key)
 		}
+		verifier = transport.NewVerifier(keys, cfg.Auth.MaxSkew)
+	} else {
+		logger.Warn("TRACER_AUTH_KEYS is not set, accepting unsigned setting changes")
+	}
+
+	mqttTransport = controller.NewMQTTTransport(mqttClient, service, pool, verifier, logger)
+
+	registry.CounterFunc("tracer_mqtt_publish_failures", "Publishes to the broker that failed", func() float64 {
+		return float64(publisher.Failures())
 	})
+	registry.CounterFunc("tracer_mqtt_connects", "Connections made to the broker", func() float64 {
+		return float64(atomic.LoadUint64(&numConns))
+	})
+	registry.CounterFunc("tracer_mqtt_connection_losses", "Connections to the broker that were lost", func() float64 {
+		return float64(atomic.LoadUint64(&numConnLosts))
+	})
+	registry.GaugeFunc("tracer_spool_readings", "Readings buffered while the broker is unreachable", func() float64 {
+		return float64(spool.Len())
+	})
+	registry.CounterFunc("tracer_spool_dropped", "Buffered readings discarded because the spool was full", func() float64 {
+		return float64(spool.Dropped())
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	metricsServer := &http.Server{Addr: cfg.Metrics.Addr, Handler: mux}
+	go func() {
+		logger.Info("serving metrics", zap.String("addr", cfg.Metrics.Addr))
+		if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("error serving metrics", zap.Error(err))
+		}
+	}()
 
-	mqttTransport := controller.NewMQTTTransport(mqttClient, service, logger)
-	mqttTransport.Register()
+	// Readings are buffered until the broker is reachable, so don't wait for
+	// the initial connection.
+	mqttClient.Connect()
+
+	go publisher.Run(ctx)
 
 	logger.Info("running controller")
 	service.Run(ctx)
+
+	logger.Info("shutting down")
+	// Stop taking requests and answer those already taken while the broker
+	// is still connected.
+	if mqttClient.IsConnectionOpen() {
+		if err := mqttTransport.Unregister(); err != nil {
+			logger.Error("error unregistering mqtt transport", zap.Error(err))
+		}
+	}
+	pool.Close()
+	if sparkplugNode != nil {
+		sparkplugNode.Close()
+	}
+	mqttClient.Disconnect(250)
+	metricsServer.Close()
 }
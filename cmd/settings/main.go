@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/alxyng/tracer/controller"
+	"github.com/alxyng/tracer/internal/config"
+	"github.com/alxyng/tracer/internal/metrics"
+	"github.com/alxyng/tracer/internal/transport"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const ServiceName = "tracer-settings"
+
+// requestTimeout allows for an import writing every setting, each of which
+// is read back.
+var requestTimeout = controller.SettingsTimeout
+
+const usage = `usage:
+  settings export [file]          write the controller's settings to file, or stdout
+  settings diff file              show how file differs from the controller
+  settings import [-y] file       apply the settings in file that differ from the controller
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "export":
+		err = export(args)
+	case "diff":
+		err = importSettings(args, true)
+	case "import":
+		err = importSettings(args, false)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func export(args []string) error {
+	c, remote, err := connect()
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect(250)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	res, err := remote.ExportSettings(ctx, &controller.ExportSettingsRequest{})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range res.Unreadable {
+		fmt.Fprintf(os.Stderr, "warning: %s could not be read and was left out\n", name)
+	}
+
+	data, err := json.MarshalIndent(&res.Settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if len(args) == 0 {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(args[0], data, 0o644)
+}
+
+func importSettings(args []string, diffOnly bool) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	yes := fs.Bool("y", false, "apply without asking for confirmation")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var settings controller.Settings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("reading %s: %w", fs.Arg(0), err)
+	}
+
+	c, remote, err := connect()
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect(250)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	req := controller.ImportSettingsRequest{Settings: settings, DryRun: true}
+	preview, err := remote.ImportSettings(ctx, &req)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	printDifferences(os.Stdout, preview.Differences)
+	if diffOnly || len(preview.Differences) == 0 {
+		return nil
+	}
+
+	if !*yes && !confirm(fmt.Sprintf("Apply %d changes?", len(preview.Differences))) {
+		return nil
+	}
+
+	// Waiting for confirmation may have taken a while, so the import gets
+	// a deadline of its own.
+	ctx, cancel = context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req.DryRun = false
+	res, err := remote.ImportSettings(ctx, &req)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d changes applied\n", len(res.Changes))
+	return nil
+}
+
+func printDifferences(w io.Writer, differences []controller.SettingDifference) {
+	if len(differences) == 0 {
+		fmt.Fprintln(w, "no differences")
+		return
+	}
+
+	for _, d := range differences {
+		address, _ := d.Address.MarshalText()
+		fmt.Fprintf(w, "%-45s %s  %6d -> %d\n", d.Name, address, d.Old, d.New)
+	}
+}
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// connect connects to the broker and returns a Remote for making requests to
+// the controller, signing setting changes if TRACER_AUTH_CLIENT_ID and
+// TRACER_AUTH_KEY are set.
+func connect() (mqtt.Client, *controller.Remote, error) {
+	cfg, err := config.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var signer *transport.Signer
+	if cfg.Auth.ClientID != "" && cfg.Auth.Key != "" {
+		signer = transport.NewSigner(cfg.Auth.ClientID, []byte(cfg.Auth.Key))
+	}
+
+	logger := zap.NewNop()
+	requester := transport.NewRequester(controller.RequestTopics, metrics.NewRegistry(), logger)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTT.Broker).
+		SetClientID(ServiceName + "-" + uuid.NewString()[:8])
+
+	c := mqtt.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return nil, nil, fmt.Errorf("connecting to mqtt: %w", token.Error())
+	}
+
+	if err := requester.Subscribe(c); err != nil {
+		c.Disconnect(250)
+		return nil, nil, fmt.Errorf("subscribing to responses: %w", err)
+	}
+
+	return c, controller.NewRemote(c, requester, signer, logger), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alxyng/tracer/api"
+	"github.com/alxyng/tracer/internal/config"
+)
+
+const usage = `usage:
+  token [-role viewer|admin] [-ttl duration] name
+        print a bearer token for tracer-api, signed with TRACER_API_TOKEN_SECRET
+`
+
+func main() {
+	role := flag.String("role", string(api.RoleViewer), "role granted by the token")
+	ttl := flag.Duration("ttl", 30*24*time.Hour, "how long the token is valid for")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *role, *ttl); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(name, role string, ttl time.Duration) error {
+	cfg, err := config.Get()
+	if err != nil {
+		return err
+	}
+	if cfg.API.TokenSecret == "" {
+		return fmt.Errorf("TRACER_API_TOKEN_SECRET is not set")
+	}
+
+	r, err := api.ParseRole(role)
+	if err != nil {
+		return err
+	}
+
+	token, err := api.NewTokenAuthenticator([]byte(cfg.API.TokenSecret)).Sign(name, r, ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+	return nil
+}
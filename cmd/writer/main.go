@@ -2,25 +2,58 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/alxyng/tracer/controller"
 	"github.com/alxyng/tracer/internal/config"
+	"github.com/alxyng/tracer/internal/metrics"
+	"github.com/alxyng/tracer/internal/queue"
+	"github.com/alxyng/tracer/internal/sqlite"
 	"github.com/alxyng/tracer/writer"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 )
 
 const ServiceName = "tracer-writer"
 
+// sink is a writer readings go to, writing them in the background.
+type sink interface {
+	writer.Writer
+	Run(ctx context.Context)
+	OnFlush(f func(batch []*controller.Reading))
+}
+
+type namedSink struct {
+	name string
+	sink
+}
+
 func main() {
-	ctx := context.Background()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [migrate]\n", os.Args[0])
+	}
+	flag.Parse()
+	if flag.NArg() > 1 || (flag.NArg() == 1 && flag.Arg(0) != "migrate") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	logger, err := zap.NewProduction()
 	if err != nil {
@@ -33,45 +66,215 @@ func main() {
 		logger.Fatal("error getting config", zap.Error(err))
 	}
 
-	conn, err := pgx.Connect(ctx, cfg.Database.DSN)
+	pool, err := pgxpool.New(ctx, cfg.Database.DSN)
 	if err != nil {
 		logger.Fatal("unable to connect to database", zap.Error(err))
 	}
-	defer conn.Close(ctx)
-	logger.Info("connected to database", zap.String("database", conn.Config().Database))
+	defer pool.Close()
+
+	migrate := func(ctx context.Context) error {
+		if err := writer.Migrate(ctx, pool, logger); err != nil {
+			return err
+		}
+		if cfg.Writer.Timescale {
+			return writer.MigrateTimescale(ctx, pool, cfg.Writer.CompressAfter, cfg.Writer.Retention, logger)
+		}
+		return nil
+	}
+
+	var db *sql.DB
+	if cfg.Writer.HasSink(config.WriterSinkSQLite) {
+		db, err = sqlite.Open(cfg.SQLite.Path)
+		if err != nil {
+			logger.Fatal("error opening sqlite database", zap.String("path", cfg.SQLite.Path), zap.Error(err))
+		}
+		defer db.Close()
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if cfg.Writer.HasSink(config.WriterSinkPostgres) {
+			if err := migrate(ctx); err != nil {
+				logger.Fatal("error migrating database", zap.Error(err))
+			}
+		}
+		if db != nil {
+			if err := writer.MigrateSQLite(ctx, db, logger); err != nil {
+				logger.Fatal("error migrating sqlite database", zap.Error(err))
+			}
+		}
+		return
+	}
+
+	registry := metrics.NewRegistry()
+	lag := registry.Gauge("tracer_writer_lag_seconds", "Time between a reading being taken and it being written", "sink")
+
+	var sinks []namedSink
+	if cfg.Writer.HasSink(config.WriterSinkPostgres) {
+		// The pool reconnects as needed, so the database being down at
+		// startup only delays writes.
+		if err := pool.Ping(ctx); err != nil {
+			logger.Warn("unable to connect to database", zap.Error(err))
+		} else {
+			logger.Info("connected to database", zap.String("database", pool.Config().ConnConfig.Database))
+		}
+
+		spool, err := queue.Open(cfg.Writer.SpoolDir, cfg.Spool.MaxBytes)
+		if err != nil {
+			logger.Fatal("unable to open spool", zap.String("dir", cfg.Writer.SpoolDir), zap.Error(err))
+		}
+		defer spool.Close()
+
+		deadLetters, err := writer.OpenDeadLetterFile(cfg.Writer.DeadLetterFile)
+		if err != nil {
+			logger.Fatal("unable to open dead-letter file", zap.String("path", cfg.Writer.DeadLetterFile), zap.Error(err))
+		}
+		defer deadLetters.Close()
+
+		w1 := writer.NewBatchWriter(pool, spool, deadLetters, cfg.Writer.BatchSize, cfg.Writer.FlushInterval, cfg.Writer.MaxPending, logger)
+		w1.Prepare(func(ctx context.Context) error {
+			if cfg.Writer.Migrate {
+				if err := migrate(ctx); err != nil {
+					return err
+				}
+			}
+			if cfg.Writer.Timescale {
+				return nil
+			}
+
+			// Once the TimescaleDB migrations have been applied,
+			// daily_energy is a view that can't be added to.
+			migrated, err := writer.TimescaleMigrated(ctx, pool)
+			if err != nil {
+				return err
+			}
+			if migrated {
+				logger.Warn("timescaledb migrations have been applied, leaving daily energy to the rollups; set TRACER_WRITER_TIMESCALE=true")
+				w1.SkipDailyEnergy()
+			}
+			return nil
+		})
+		if cfg.Writer.Timescale {
+			w1.SkipDailyEnergy()
+		}
+		sinks = append(sinks, namedSink{config.WriterSinkPostgres, w1})
+
+		registry.CounterFunc("tracer_writer_reading_writes", "Readings written to the readings table", func() float64 {
+			return float64(w1.NumWrites())
+		})
+		registry.CounterFunc("tracer_writer_daily_energy_writes", "Rows written to the daily_energy table", func() float64 {
+			return float64(w1.NumDailyEnergyWrites())
+		})
+		registry.GaugeFunc("tracer_writer_pending_readings", "Readings waiting to be written", func() float64 {
+			return float64(w1.Pending())
+		})
+		registry.CounterFunc("tracer_writer_dropped_readings", "Readings lost because they couldn't be spooled or dead-lettered", func() float64 {
+			return float64(w1.Dropped())
+		})
+		registry.GaugeFunc("tracer_writer_spooled_batches", "Batches waiting in the spool for the database", func() float64 {
+			return float64(spool.Len())
+		})
+		registry.CounterFunc("tracer_writer_spool_dropped_batches", "Spooled batches dropped to keep the spool within its size limit", func() float64 {
+			return float64(spool.Dropped())
+		})
+		registry.CounterFunc("tracer_writer_dead_letters", "Readings the database refused", func() float64 {
+			return float64(deadLetters.Count())
+		})
+	}
+
+	if cfg.Writer.HasSink(config.WriterSinkInflux) {
+		writeURL, err := writer.InfluxWriteURL(cfg.Influx.URL, cfg.Influx.Org, cfg.Influx.Bucket, cfg.Influx.Database)
+		if err != nil {
+			logger.Fatal("invalid influxdb url", zap.String("url", cfg.Influx.URL), zap.Error(err))
+		}
+
+		influx := writer.NewInfluxWriter(&http.Client{Timeout: 30 * time.Second}, writeURL, cfg.Influx.Token, cfg.Influx.DeviceID, cfg.Writer.BatchSize, cfg.Writer.FlushInterval, cfg.Writer.MaxPending, logger)
+		sinks = append(sinks, namedSink{config.WriterSinkInflux, influx})
+
+		registry.CounterFunc("tracer_writer_influx_reading_writes", "Readings written to InfluxDB", func() float64 {
+			return float64(influx.NumWrites())
+		})
+		registry.GaugeFunc("tracer_writer_influx_pending_readings", "Readings waiting to be written to InfluxDB", func() float64 {
+			return float64(influx.Pending())
+		})
+		registry.CounterFunc("tracer_writer_influx_dropped_readings", "Readings that couldn't be written to InfluxDB", func() float64 {
+			return float64(influx.Dropped())
+		})
+	}
+
+	if db != nil {
+		// SQLite is local, so unlike PostgreSQL there's nothing to wait for.
+		if cfg.Writer.Migrate {
+			if err := writer.MigrateSQLite(ctx, db, logger); err != nil {
+				logger.Fatal("error migrating sqlite database", zap.Error(err))
+			}
+		}
+
+		w3 := writer.NewSQLiteWriter(db, cfg.Writer.BatchSize, cfg.Writer.FlushInterval, cfg.Writer.MaxPending, logger)
+		sinks = append(sinks, namedSink{config.WriterSinkSQLite, w3})
+
+		registry.CounterFunc("tracer_writer_sqlite_reading_writes", "Readings written to SQLite", func() float64 {
+			return float64(w3.NumWrites())
+		})
+		registry.CounterFunc("tracer_writer_sqlite_daily_energy_writes", "Updates made to the daily energy totals in SQLite", func() float64 {
+			return float64(w3.NumDailyEnergyWrites())
+		})
+		registry.GaugeFunc("tracer_writer_sqlite_pending_readings", "Readings waiting to be written to SQLite", func() float64 {
+			return float64(w3.Pending())
+		})
+		registry.CounterFunc("tracer_writer_sqlite_dropped_readings", "Readings that couldn't be written to SQLite", func() float64 {
+			return float64(w3.Dropped())
+		})
+	}
 
-	w1 := writer.NewSQLWriter(conn, logger)
-	w2 := writer.NewSQLAggregateWriter(conn, logger)
+	for _, s := range sinks {
+		lag := lag.With(s.name)
+		s.OnFlush(func(batch []*controller.Reading) {
+			lag.Set(time.Since(batch[len(batch)-1].EndTime).Seconds())
+		})
+	}
+
+	auditWriter := writer.NewSQLAuditWriter(pool, logger)
+	subscriber := controller.NewSubscriber(logger)
 	var numConns uint64
 	var numConnLosts uint64
 
 	onConnect := func(c mqtt.Client) {
-		numConns++
+		atomic.AddUint64(&numConns, 1)
 		logger.Info("connected to mqtt")
 
-		handler := func(client mqtt.Client, msg mqtt.Message) {
-			var reading controller.Reading
-			if err := json.Unmarshal(msg.Payload(), &reading); err != nil {
-				logger.Error("error unmarshalling reading", zap.Error(err))
-				return
+		handler := func(ctx context.Context, reading *controller.Reading) {
+			for _, s := range sinks {
+				if err := s.Write(ctx, reading); err != nil {
+					logger.Error("error writing", zap.String("sink", s.name), zap.Error(err))
+				}
 			}
+		}
 
-			if err := w1.Write(ctx, reading); err != nil {
-				logger.Fatal("error writing", zap.String("writer", "w1"), zap.Error(err))
-			}
+		if err := subscriber.Subscribe(c, handler); err != nil {
+			logger.Error("error subscribing to mqtt topic", zap.String("topic", controller.TopicReading), zap.Error(err))
+		}
+
+		if cfg.Audit.Database {
+			auditHandler := func(c mqtt.Client, msg mqtt.Message) {
+				var rec controller.AuditRecord
+				if err := json.Unmarshal(msg.Payload(), &rec); err != nil {
+					logger.Error("error unmarshalling audit record", zap.Error(err))
+					return
+				}
 
-			if err := w2.Write(ctx, reading); err != nil {
-				logger.Fatal("error writing", zap.String("writer", "w2"), zap.Error(err))
+				if err := auditWriter.Write(ctx, &rec); err != nil {
+					logger.Error("error writing audit record", zap.Error(err))
+				}
 			}
-		}
 
-		if token := c.Subscribe("tracer/reading", 0, handler); token.Wait() && token.Error() != nil {
-			logger.Fatal("error subscribing to mqtt topic", zap.String("topic", "tracer/reading"), zap.Error(token.Error()))
+			if token := c.Subscribe(controller.TopicAudit, 1, auditHandler); token.Wait() && token.Error() != nil {
+				logger.Error("error subscribing to mqtt topic", zap.String("topic", controller.TopicAudit), zap.Error(token.Error()))
+			}
 		}
 	}
 
 	onConnectionLost := func(c mqtt.Client, err error) {
-		numConnLosts++
+		atomic.AddUint64(&numConnLosts, 1)
 		logger.Error("mqtt connection lost", zap.Error(err))
 	}
 
@@ -85,6 +288,16 @@ func main() {
 		SetOnConnectHandler(onConnect).
 		SetConnectionLostHandler(onConnectionLost)
 
+	var writers sync.WaitGroup
+	writerCtx, stopWriter := context.WithCancel(context.Background())
+	for _, s := range sinks {
+		writers.Add(1)
+		go func(s namedSink) {
+			defer writers.Done()
+			s.Run(writerCtx)
+		}(s)
+	}
+
 	mqttClient := mqtt.NewClient(opts)
 	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		logger.Fatal("error connecting to mqtt", zap.Error(token.Error()))
@@ -95,17 +308,37 @@ func main() {
 	// router.Use(ginzap.Ginzap(logger, time.RFC3339, true))
 	router.Use(ginzap.RecoveryWithZap(logger, true))
 
-	router.GET("/", gin.WrapF(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{
-  "w1Writes": %v,
-  "w2Writes": %v,
-  "mqttConnected": %v,
-  "mqttConnectionOpen": %v,
-  "numConns": %v,
-  "numConnLosts": %v
-}`, w1.NumWrites(), w2.NumWrites(), mqttClient.IsConnected(), mqttClient.IsConnectionOpen(), numConns, numConnLosts)
-	}))
-	logger.Info("starting http server", zap.String("addr", ":3011"))
-	router.Run(":3011")
+	registry.CounterFunc("tracer_writer_audit_writes", "Audit records written to the audit_log table", func() float64 {
+		return float64(auditWriter.NumWrites())
+	})
+	registry.GaugeFunc("tracer_mqtt_connected", "Whether the broker connection is open", func() float64 {
+		if mqttClient.IsConnectionOpen() {
+			return 1
+		}
+		return 0
+	})
+	registry.CounterFunc("tracer_mqtt_connects", "Connections made to the broker", func() float64 {
+		return float64(atomic.LoadUint64(&numConns))
+	})
+	registry.CounterFunc("tracer_mqtt_connection_losses", "Connections to the broker that were lost", func() float64 {
+		return float64(atomic.LoadUint64(&numConnLosts))
+	})
+
+	router.GET("/metrics", gin.WrapH(registry))
+	server := &http.Server{Addr: ":3011", Handler: router}
+	go func() {
+		logger.Info("starting http server", zap.String("addr", server.Addr))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("error serving http", zap.Error(err))
+		}
+	}()
+
+	<-ctx.Done()
+
+	// Stop taking readings before writing out those buffered.
+	logger.Info("shutting down")
+	mqttClient.Disconnect(250)
+	stopWriter()
+	writers.Wait()
+	server.Close()
 }
@@ -12,5 +12,13 @@ type API interface {
 	GetSystemTime(ctx context.Context, req *GetSystemTimeRequest) (*GetSystemTimeResponse, error)
 	SetSystemTime(ctx context.Context, req *SetSystemTimeRequest) (*SetSystemTimeResponse, error)
 	GetBatteryInformation(ctx context.Context, req *GetBatteryInformationRequest) (*GetBatteryInformationResponse, error)
+	GetRatedData(ctx context.Context, req *GetRatedDataRequest) (*GetRatedDataResponse, error)
 	SetBatteryCapacity(ctx context.Context, req *SetBatteryCapacityRequest) (*SetBatteryCapacityResponse, error)
+	GetChargingProfile(ctx context.Context, req *GetChargingProfileRequest) (*GetChargingProfileResponse, error)
+	SetChargingProfile(ctx context.Context, req *SetChargingProfileRequest) (*SetChargingProfileResponse, error)
+	GetWriteStatistics(ctx context.Context, req *GetWriteStatisticsRequest) (*GetWriteStatisticsResponse, error)
+	ExportSettings(ctx context.Context, req *ExportSettingsRequest) (*ExportSettingsResponse, error)
+	ImportSettings(ctx context.Context, req *ImportSettingsRequest) (*ImportSettingsResponse, error)
+	GetAuditLog(ctx context.Context, req *GetAuditLogRequest) (*GetAuditLogResponse, error)
+	Batch(ctx context.Context, req *BatchRequest) (*BatchResponse, error)
 }
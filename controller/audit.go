@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alxyng/tracer/internal/transport"
+	"go.uber.org/zap"
+)
+
+const (
+	AuditOutcomeChanged   = "changed"
+	AuditOutcomeUnchanged = "unchanged"
+	AuditOutcomeFailed    = "failed"
+)
+
+const defaultAuditLimit = 100
+const maxAuditLimit = 1000
+
+// maxAuditRecordSize bounds the length of a line read back from the audit
+// log.
+const maxAuditRecordSize = 1 << 20
+
+// OpenAuditLog opens the audit log at path, creating it if needed. Records
+// are only ever appended to the file.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditLog{path: path, file: f}, nil
+}
+
+// AuditLog records requests that change the device's settings as JSON lines.
+type AuditLog struct {
+	mu sync.Mutex
+
+	path     string
+	file     *os.File
+	onAppend []func(*AuditRecord)
+}
+
+// OnAppend registers f to be called with every record appended.
+func (a *AuditLog) OnAppend(f func(*AuditRecord)) {
+	a.onAppend = append(a.onAppend, f)
+}
+
+// Append writes rec to the log and syncs it to disk.
+func (a *AuditLog) Append(rec *AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	_, err = a.file.Write(data)
+	if err == nil {
+		err = a.file.Sync()
+	}
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range a.onAppend {
+		f(rec)
+	}
+	return nil
+}
+
+// Query returns the records matching req, newest first.
+func (a *AuditLog) Query(req *GetAuditLogRequest) ([]AuditRecord, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditRecordSize)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A crash part way through a write can leave a partial line.
+			continue
+		}
+		if !req.Since.IsZero() && rec.Time.Before(req.Since) {
+			continue
+		}
+		if !req.Until.IsZero() && !rec.Time.Before(req.Until) {
+			continue
+		}
+		if req.Method != "" && rec.Method != req.Method {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Records are appended in order, so reversing them first keeps records
+	// with the same time newest first too.
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.After(records[j].Time)
+	})
+	if len(records) > limit {
+		records = records[:limit]
+	}
+
+	return records, nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+// changeSet is implemented by the responses of setters.
+type changeSet interface {
+	registerChanges() []RegisterChange
+}
+
+func (r *SetSystemTimeResponse) registerChanges() []RegisterChange {
+	if r == nil {
+		return nil
+	}
+	return r.Changes
+}
+
+func (r *SetBatteryCapacityResponse) registerChanges() []RegisterChange {
+	if r == nil {
+		return nil
+	}
+	return r.Changes
+}
+
+func (r *SetChargingProfileResponse) registerChanges() []RegisterChange {
+	if r == nil {
+		return nil
+	}
+	return r.Changes
+}
+
+func (r *ImportSettingsResponse) registerChanges() []RegisterChange {
+	if r == nil {
+		return nil
+	}
+	return r.Changes
+}
+
+// audit records the outcome of a request that may have changed the device's
+// settings.
+func (s *Service) audit(ctx context.Context, method string, req any, res changeSet, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	request, marshalErr := json.Marshal(req)
+	if marshalErr != nil {
+		s.logger.Error("error marshalling audited request", zap.Error(marshalErr))
+	}
+
+	caller := transport.CallerFrom(ctx)
+	rec := &AuditRecord{
+		Time:      time.Now().UTC(),
+		Method:    method,
+		Source:    caller.Source,
+		ClientID:  caller.ClientID,
+		Principal: caller.Principal,
+		RequestID: caller.RequestID,
+		Request:   request,
+		Changes:   res.registerChanges(),
+		Outcome:   AuditOutcomeChanged,
+	}
+
+	switch {
+	case err != nil:
+		rec.Outcome = AuditOutcomeFailed
+		rec.Error = err.Error()
+		var txErr *TransactionError
+		if errors.As(err, &txErr) {
+			rec.RolledBack = txErr.RolledBack
+		}
+	case len(rec.Changes) == 0:
+		rec.Outcome = AuditOutcomeUnchanged
+	}
+
+	if err := s.auditLog.Append(rec); err != nil {
+		s.logger.Error("error writing audit record", zap.String("method", method), zap.Error(err))
+	}
+}
+
+func (s *Service) GetAuditLog(ctx context.Context, req *GetAuditLogRequest) (*GetAuditLogResponse, error) {
+	if s.auditLog == nil {
+		return &GetAuditLogResponse{Records: []AuditRecord{}}, nil
+	}
+
+	records, err := s.auditLog.Query(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GetAuditLogResponse{Records: records}, nil
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/internal/transport"
+	"go.uber.org/zap"
+)
+
+func openTestAuditLog(t *testing.T) *AuditLog {
+	t.Helper()
+
+	auditLog, err := OpenAuditLog(t.TempDir() + "/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+	return auditLog
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	auditLog := openTestAuditLog(t)
+
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	methods := []string{"setSystemTime", "setBatteryCapacity", "setBatteryCapacity", "importSettings"}
+	for i, method := range methods {
+		rec := &AuditRecord{Time: start.Add(time.Duration(i) * time.Minute), Method: method, Request: []byte("{}"), Outcome: AuditOutcomeChanged}
+		if err := auditLog.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A partial line left by a crash is skipped.
+	f, err := os.OpenFile(auditLog.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time": "2024-06-01T13:00:00Z", "meth`)
+	f.Close()
+
+	tests := []struct {
+		name string
+		req  GetAuditLogRequest
+		want []string
+	}{
+		{"all", GetAuditLogRequest{}, []string{"importSettings", "setBatteryCapacity", "setBatteryCapacity", "setSystemTime"}},
+		{"method", GetAuditLogRequest{Method: "setSystemTime"}, []string{"setSystemTime"}},
+		{"since", GetAuditLogRequest{Since: start.Add(2 * time.Minute)}, []string{"importSettings", "setBatteryCapacity"}},
+		{"until", GetAuditLogRequest{Until: start.Add(time.Minute)}, []string{"setSystemTime"}},
+		{"limit", GetAuditLogRequest{Limit: 1}, []string{"importSettings"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := auditLog.Query(&tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for i, rec := range records {
+				if rec.Method != tt.want[i] {
+					t.Errorf("record %d = %s, want %s", i, rec.Method, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogOnAppend(t *testing.T) {
+	auditLog := openTestAuditLog(t)
+
+	var appended []*AuditRecord
+	auditLog.OnAppend(func(rec *AuditRecord) { appended = append(appended, rec) })
+
+	rec := &AuditRecord{Time: time.Now(), Method: "setSystemTime", Request: []byte("{}")}
+	if err := auditLog.Append(rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(appended) != 1 || appended[0] != rec {
+		t.Errorf("appended = %v", appended)
+	}
+}
+
+func TestServiceAudit(t *testing.T) {
+	client := newFakeModbus()
+	client.registers[0x9001] = 200
+	guard, err := OpenWriteGuard(t.TempDir()+"/write-counts.json", time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := openTestAuditLog(t)
+	s := NewService(client, guard, auditLog, zap.NewNop())
+
+	ctx := transport.WithCaller(context.Background(), transport.Caller{Source: transport.SourceMQTT, ClientID: "phone", Principal: "alex", RequestID: "1"})
+
+	if _, err := s.SetBatteryCapacity(ctx, &SetBatteryCapacityRequest{Capacity: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetBatteryCapacity(ctx, &SetBatteryCapacityRequest{Capacity: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetBatteryCapacity(ctx, &SetBatteryCapacityRequest{Capacity: 150}); !errors.Is(err, ErrWriteRejected) {
+		t.Fatalf("err = %v, want ErrWriteRejected", err)
+	}
+	if _, err := s.SetBatteryCapacity(ctx, &SetBatteryCapacityRequest{Capacity: 50, DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.GetAuditLog(ctx, &GetAuditLogRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest first, and the dry run isn't recorded.
+	records := res.Records
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+	wantOutcomes := []string{AuditOutcomeFailed, AuditOutcomeUnchanged, AuditOutcomeChanged}
+	for i, rec := range records {
+		if rec.Outcome != wantOutcomes[i] {
+			t.Errorf("record %d outcome = %s, want %s", i, rec.Outcome, wantOutcomes[i])
+		}
+		if rec.Method != "setBatteryCapacity" || rec.ClientID != "phone" || rec.Principal != "alex" || rec.Source != transport.SourceMQTT || rec.RequestID != "1" {
+			t.Errorf("record %d = %+v", i, rec)
+		}
+	}
+
+	changed := records[2]
+	if len(changed.Changes) != 1 || changed.Changes[0].Old[0] != 200 || changed.Changes[0].New[0] != 100 {
+		t.Errorf("changes = %+v, want 200 to 100", changed.Changes)
+	}
+	if records[0].Error == "" {
+		t.Error("failed record has no error")
+	}
+}
+
+func TestAuditLogQuerySameTime(t *testing.T) {
+	auditLog := openTestAuditLog(t)
+
+	now := time.Now().UTC()
+	for _, method := range []string{"first", "second"} {
+		if err := auditLog.Append(&AuditRecord{Time: now, Method: method, Request: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := auditLog.Query(&GetAuditLogRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Method != "second" {
+		t.Errorf("records = %+v, want second first", records)
+	}
+}
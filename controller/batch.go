@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/alxyng/tracer/internal/transport"
+	"go.uber.org/zap"
+)
+
+// maxBatchCalls limits how long a batch can hold the bus.
+const maxBatchCalls = 16
+
+type batchMethod func(s *Service, ctx context.Context, req json.RawMessage) (any, error)
+
+func batchCall[Req, Res any](f func(*Service, context.Context, *Req) (*Res, error)) batchMethod {
+	return func(s *Service, ctx context.Context, data json.RawMessage) (any, error) {
+		var req Req
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &req); err != nil {
+				return nil, &InvalidRequestError{Reason: err.Error()}
+			}
+		}
+		return f(s, ctx, &req)
+	}
+}
+
+// batchMethods are the RPCs that can be batched. Only reads are allowed, so a
+// batch needs no signature. exportSettings is left out, as it reads every
+// setting and would outlast a batch's deadline.
+var batchMethods = map[string]batchMethod{
+	"getReading":            batchCall((*Service).GetReading),
+	"getSystemTime":         batchCall((*Service).GetSystemTime),
+	"getBatteryInformation": batchCall((*Service).GetBatteryInformation),
+	"getRatedData":          batchCall((*Service).GetRatedData),
+	"getChargingProfile":    batchCall((*Service).GetChargingProfile),
+	"getWriteStatistics":    batchCall((*Service).GetWriteStatistics),
+	"getAuditLog":           batchCall((*Service).GetAuditLog),
+}
+
+// Batch makes each call in turn while holding the bus, so other requests and
+// readings can't interleave with them. A call that fails doesn't stop the
+// rest.
+func (s *Service) Batch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	if len(req.Calls) == 0 {
+		return nil, &InvalidRequestError{Reason: "calls is required"}
+	}
+	if len(req.Calls) > maxBatchCalls {
+		return nil, &InvalidRequestError{Reason: fmt.Sprintf("at most %d calls can be batched", maxBatchCalls)}
+	}
+	for i, call := range req.Calls {
+		if _, ok := batchMethods[call.Method]; !ok {
+			return nil, &InvalidRequestError{Reason: fmt.Sprintf("call %d: %q can't be batched", i, call.Method)}
+		}
+	}
+
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
+
+	ctx = s.withBus(ctx)
+
+	res := &BatchResponse{Results: make([]BatchResult, len(req.Calls))}
+	for i, call := range req.Calls {
+		if err := ctx.Err(); err != nil {
+			res.Results[i] = s.batchError(call.Method, err)
+			continue
+		}
+
+		callRes, err := batchMethods[call.Method](s, ctx, call.Request)
+		if err != nil {
+			res.Results[i] = s.batchError(call.Method, err)
+			continue
+		}
+
+		data, err := json.Marshal(callRes)
+		if err != nil {
+			res.Results[i] = s.batchError(call.Method, err)
+			continue
+		}
+		res.Results[i] = BatchResult{Response: data}
+	}
+
+	return res, nil
+}
+
+// batchError returns the result for a failed call, with the error code the
+// call would have returned on its own.
+func (s *Service) batchError(method string, err error) BatchResult {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return BatchResult{Error: transport.ErrorBusy}
+	}
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) {
+		return BatchResult{Error: coded.ErrorCode(), Message: err.Error()}
+	}
+	s.logger.Error("error handling batched call", zap.String("method", method), zap.Error(err))
+	return BatchResult{Error: transport.ErrorHandlingRequest}
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/internal/transport"
+)
+
+// failingReads fails reads of the holding registers at address.
+type failingReads struct {
+	*fakeModbus
+	address uint16
+}
+
+func (m *failingReads) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	if address == m.address {
+		return nil, errors.New("modbus: exception '2' (illegal data address)")
+	}
+	return m.fakeModbus.ReadHoldingRegisters(address, quantity)
+}
+
+func TestBatch(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, &failingReads{fakeModbus: client, address: 0x9000}, 0, 10)
+	if _, err := s.SetSystemTime(context.Background(), &SetSystemTimeRequest{Time: time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := s.Batch(ctx, &BatchRequest{Calls: []BatchCall{
+		{Method: "getSystemTime"},
+		{Method: "getBatteryInformation"},
+		{Method: "getAuditLog", Request: json.RawMessage(`{"limit": "ten"}`)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results) != 3 {
+		t.Fatalf("got %d results, want 3", len(res.Results))
+	}
+
+	var systemTime GetSystemTimeResponse
+	if err := json.Unmarshal(res.Results[0].Response, &systemTime); err != nil {
+		t.Fatal(err)
+	}
+	if !systemTime.Time.Equal(time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("time = %s", systemTime.Time)
+	}
+
+	// Failed calls don't stop the rest, and report the error they would
+	// have on their own.
+	if r := res.Results[1]; r.Error != transport.ErrorHandlingRequest || r.Response != nil {
+		t.Errorf("getBatteryInformation = %+v, want %s", r, transport.ErrorHandlingRequest)
+	}
+	if r := res.Results[2]; r.Error != "invalidRequest" {
+		t.Errorf("getAuditLog = %+v, want invalidRequest", r)
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	s := newTestService(t, newFakeModbus(), 0, 10)
+
+	tooMany := make([]BatchCall, maxBatchCalls+1)
+	for i := range tooMany {
+		tooMany[i].Method = "getSystemTime"
+	}
+
+	tests := []struct {
+		name  string
+		calls []BatchCall
+		want  string
+	}{
+		{"empty", nil, "calls is required"},
+		{"too many", tooMany, "at most"},
+		{"write", []BatchCall{{Method: "getSystemTime"}, {Method: "setBatteryCapacity"}}, `call 1: "setBatteryCapacity" can't be batched`},
+		{"export", []BatchCall{{Method: "exportSettings"}}, `call 0: "exportSettings" can't be batched`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Batch(context.Background(), &BatchRequest{Calls: tt.calls})
+			var invalid *InvalidRequestError
+			if !errors.As(err, &invalid) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want an invalid request containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Encoding is the wire format of readings published on TopicReading. The
+// controller advertises the encoding it uses on TopicMetadata.
+type Encoding string
+
+const (
+	EncodingJSON     Encoding = "json"
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// ReadingSchema identifies the message in reading.proto.
+const ReadingSchema = "tracer.v1.Reading"
+
+var (
+	ErrUnknownEncoding = errors.New("unknown encoding")
+	ErrMalformedProto  = errors.New("malformed protobuf reading")
+)
+
+func ParseEncoding(s string) (Encoding, error) {
+	switch e := Encoding(s); e {
+	case EncodingJSON, EncodingProtobuf:
+		return e, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownEncoding, s)
+}
+
+// Metadata is published, retained, on TopicMetadata so consumers know how to
+// decode readings.
+type Metadata struct {
+	Encoding Encoding `json:"encoding"`
+	Schema   string   `json:"schema,omitempty"`
+}
+
+func (e Encoding) Metadata() Metadata {
+	md := Metadata{Encoding: e}
+	if e == EncodingProtobuf {
+		md.Schema = ReadingSchema
+	}
+	return md
+}
+
+func (e Encoding) MarshalReading(r *Reading) ([]byte, error) {
+	switch e {
+	case EncodingJSON:
+		return json.Marshal(r)
+	case EncodingProtobuf:
+		return marshalReadingProto(r), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownEncoding, e)
+}
+
+func (e Encoding) UnmarshalReading(data []byte, r *Reading) error {
+	switch e {
+	case EncodingJSON:
+		return json.Unmarshal(data, r)
+	case EncodingProtobuf:
+		return unmarshalReadingProto(data, r)
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownEncoding, e)
+}
+
+type protoFloat struct {
+	num protowire.Number
+	v   *float32
+}
+
+// protoFloats maps the float fields of r to their field numbers in
+// reading.proto.
+func protoFloats(r *Reading) []protoFloat {
+	return []protoFloat{
+		{3, &r.SolarVoltage},
+		{4, &r.SolarCurrent},
+		{5, &r.SolarPower},
+		{6, &r.LoadVoltage},
+		{7, &r.LoadCurrent},
+		{8, &r.LoadPower},
+		{9, &r.BatteryTemperature},
+		{10, &r.DeviceTemperature},
+		{13, &r.MaximumBatteryVoltageToday},
+		{14, &r.MinimumBatteryVoltageToday},
+		{15, &r.ConsumedEnergyToday},
+		{16, &r.ConsumedEnergyMonth},
+		{17, &r.ConsumedEnergyYear},
+		{18, &r.ConsumedEnergyTotal},
+		{19, &r.GeneratedEnergyToday},
+		{20, &r.GeneratedEnergyMonth},
+		{21, &r.GeneratedEnergyYear},
+		{22, &r.GeneratedEnergyTotal},
+		{23, &r.BatteryVoltage},
+		{24, &r.BatteryCurrent},
+	}
+}
+
+func marshalReadingProto(r *Reading) []byte {
+	var b []byte
+
+	appendBool := func(num protowire.Number, v bool) {
+		if v {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, 1)
+		}
+	}
+	appendVarint := func(num protowire.Number, v uint64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, v)
+		}
+	}
+
+	appendBool(1, r.OverTemperature)
+	appendBool(2, r.Day)
+
+	for _, f := range protoFloats(r) {
+		if *f.v != 0 {
+			b = protowire.AppendTag(b, f.num, protowire.Fixed32Type)
+			b = protowire.AppendFixed32(b, math.Float32bits(*f.v))
+		}
+	}
+
+	appendVarint(11, uint64(r.BatterySOC))
+	appendVarint(12, uint64(r.BatteryRatedVoltage))
+	appendVarint(25, uint64(unixNano(r.StartTime)))
+	appendVarint(26, uint64(unixNano(r.EndTime)))
+	appendVarint(27, uint64(r.Duration))
+	appendBool(28, r.Replayed)
+
+	return b
+}
+
+func unmarshalReadingProto(b []byte, r *Reading) error {
+	*r = Reading{}
+
+	floats := make(map[protowire.Number]*float32)
+	for _, f := range protoFloats(r) {
+		floats[f.num] = f.v
+	}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ErrMalformedProto
+		}
+		b = b[n:]
+
+		if v, ok := floats[num]; ok && typ == protowire.Fixed32Type {
+			x, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return ErrMalformedProto
+			}
+			*v = math.Float32frombits(x)
+			b = b[n:]
+			continue
+		}
+
+		if typ != protowire.VarintType {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return ErrMalformedProto
+			}
+			b = b[n:]
+			continue
+		}
+
+		x, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return ErrMalformedProto
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			r.OverTemperature = x != 0
+		case 2:
+			r.Day = x != 0
+		case 11:
+			r.BatterySOC = uint16(x)
+		case 12:
+			r.BatteryRatedVoltage = uint16(x)
+		case 25:
+			r.StartTime = fromUnixNano(int64(x))
+		case 26:
+			r.EndTime = fromUnixNano(int64(x))
+		case 27:
+			r.Duration = time.Duration(int64(x))
+		case 28:
+			r.Replayed = x != 0
+		}
+	}
+
+	return nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
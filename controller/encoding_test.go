@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var protoFieldPattern = regexp.MustCompile(`^\s*(\w+)\s+(\w+)\s*=\s*(\d+);`)
+
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"float":  descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+	"uint32": descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+}
+
+// readingDescriptor builds the message descriptor for reading.proto, which
+// only uses scalar fields, so the hand-written encoding can be checked
+// against it.
+func readingDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+
+	f, err := os.Open("reading.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	msg := &descriptorpb.DescriptorProto{Name: proto.String("Reading")}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := protoFieldPattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		typ, ok := protoScalarTypes[m[1]]
+		if !ok {
+			t.Fatalf("reading.proto field %s has unsupported type %s", m[2], m[1])
+		}
+		num, _ := strconv.Atoi(m[3])
+		msg.Field = append(msg.Field, &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(m[2]),
+			JsonName: proto.String(protoJSONName(m[2])),
+			Number:   proto.Int32(int32(num)),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("reading.proto"),
+		Package:     proto.String("tracer.v1"),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{msg},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := file.Messages().ByName("Reading")
+	if string(md.FullName()) != ReadingSchema {
+		t.Fatalf("reading.proto declares %s, want %s", md.FullName(), ReadingSchema)
+	}
+	return md
+}
+
+func protoJSONName(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+	}
+	return strings.Join(parts, "")
+}
+
+// readingFields maps the JSON names of reading.proto fields to the fields of
+// r, with times as Unix nanoseconds as the schema documents.
+func readingFields(r *Reading) map[string]any {
+	fields := make(map[string]any)
+	v := reflect.ValueOf(r).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		switch x := v.Field(i).Interface().(type) {
+		case time.Time:
+			fields[name] = x.UnixNano()
+		case time.Duration:
+			fields[name] = int64(x)
+		case uint16:
+			fields[name] = uint32(x)
+		default:
+			fields[name] = x
+		}
+	}
+	// BatterySOC is the only field whose JSON name isn't the schema's.
+	fields["batterySoc"] = fields["batterySOC"]
+	delete(fields, "batterySOC")
+	return fields
+}
+
+func testReading() *Reading {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	return &Reading{
+		OverTemperature:            true,
+		Day:                        true,
+		SolarVoltage:               18.5,
+		SolarCurrent:               2.25,
+		SolarPower:                 41.625,
+		LoadVoltage:                12.75,
+		LoadCurrent:                1.5,
+		LoadPower:                  19.125,
+		BatteryTemperature:         21.5,
+		DeviceTemperature:          30.25,
+		BatterySOC:                 87,
+		BatteryRatedVoltage:        12,
+		MaximumBatteryVoltageToday: 14.25,
+		MinimumBatteryVoltageToday: 12.5,
+		ConsumedEnergyToday:        0.5,
+		ConsumedEnergyMonth:        10.5,
+		ConsumedEnergyYear:         100.25,
+		ConsumedEnergyTotal:        1000.5,
+		GeneratedEnergyToday:       0.75,
+		GeneratedEnergyMonth:       12.5,
+		GeneratedEnergyYear:        120.25,
+		GeneratedEnergyTotal:       1200.5,
+		BatteryVoltage:             13.25,
+		BatteryCurrent:             -1.5,
+		StartTime:                  start,
+		EndTime:                    start.Add(150 * time.Millisecond),
+		Duration:                   150 * time.Millisecond,
+		Replayed:                   true,
+	}
+}
+
+func TestProtobufMatchesSchema(t *testing.T) {
+	md := readingDescriptor(t)
+	reading := testReading()
+	fields := readingFields(reading)
+
+	if md.Fields().Len() != len(fields) {
+		t.Fatalf("reading.proto has %d fields, Reading has %d", md.Fields().Len(), len(fields))
+	}
+
+	// Decode the hand-written encoding using the schema.
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(marshalReadingProto(reading), msg); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < md.Fields().Len(); i++ {
+		fd := md.Fields().Get(i)
+		want, ok := fields[fd.JSONName()]
+		if !ok {
+			t.Errorf("reading.proto field %s has no counterpart in Reading", fd.Name())
+			continue
+		}
+		if got := msg.Get(fd).Interface(); got != want {
+			t.Errorf("field %s = %v (%T), want %v (%T)", fd.Name(), got, got, want, want)
+		}
+	}
+
+	// And the other way round.
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Reading
+	if err := EncodingProtobuf.UnmarshalReading(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, reading) {
+		t.Fatalf("decoded %+v, want %+v", decoded, reading)
+	}
+}
+
+func TestProtobufZeroReading(t *testing.T) {
+	if data := marshalReadingProto(&Reading{}); len(data) != 0 {
+		t.Fatalf("zero reading encoded to %d bytes, want 0", len(data))
+	}
+
+	var r Reading
+	if err := EncodingProtobuf.UnmarshalReading(nil, &r); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, Reading{}) {
+		t.Fatalf("decoded %+v, want the zero reading", r)
+	}
+}
+
+func TestProtobufSkipsUnknownFields(t *testing.T) {
+	data := marshalReadingProto(&Reading{BatterySOC: 50})
+	data = protowire.AppendTag(data, 100, protowire.BytesType)
+	data = protowire.AppendBytes(data, []byte("from a newer controller"))
+	data = protowire.AppendTag(data, 101, protowire.Fixed64Type)
+	data = protowire.AppendFixed64(data, 1)
+
+	var r Reading
+	if err := EncodingProtobuf.UnmarshalReading(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.BatterySOC != 50 {
+		t.Fatalf("battery soc = %d, want 50", r.BatterySOC)
+	}
+}
+
+func TestProtobufMalformed(t *testing.T) {
+	data := marshalReadingProto(testReading())
+
+	var r Reading
+	if err := EncodingProtobuf.UnmarshalReading(data[:len(data)-1], &r); err != ErrMalformedProto {
+		t.Fatalf("truncated reading decoded with %v, want ErrMalformedProto", err)
+	}
+}
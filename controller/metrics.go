@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/alxyng/tracer/internal/metrics"
+)
+
+type readingSeries struct {
+	name  string
+	help  string
+	value func(*Reading) float64
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var readingGauges = []readingSeries{
+	{"tracer_over_temperature", "Whether the controller is over temperature", func(r *Reading) float64 { return boolValue(r.OverTemperature) }},
+	{"tracer_day", "Whether it is day, by the solar voltage", func(r *Reading) float64 { return boolValue(r.Day) }},
+	{"tracer_solar_voltage_volts", "Solar panel voltage", func(r *Reading) float64 { return float64(r.SolarVoltage) }},
+	{"tracer_solar_current_amperes", "Solar panel current", func(r *Reading) float64 { return float64(r.SolarCurrent) }},
+	{"tracer_solar_power_watts", "Solar panel power", func(r *Reading) float64 { return float64(r.SolarPower) }},
+	{"tracer_load_voltage_volts", "Load voltage", func(r *Reading) float64 { return float64(r.LoadVoltage) }},
+	{"tracer_load_current_amperes", "Load current", func(r *Reading) float64 { return float64(r.LoadCurrent) }},
+	{"tracer_load_power_watts", "Load power", func(r *Reading) float64 { return float64(r.LoadPower) }},
+	{"tracer_battery_temperature_celsius", "Battery temperature", func(r *Reading) float64 { return float64(r.BatteryTemperature) }},
+	{"tracer_device_temperature_celsius", "Controller temperature", func(r *Reading) float64 { return float64(r.DeviceTemperature) }},
+	{"tracer_battery_soc_percent", "Battery state of charge", func(r *Reading) float64 { return float64(r.BatterySOC) }},
+	{"tracer_battery_rated_voltage_volts", "Battery rated voltage", func(r *Reading) float64 { return float64(r.BatteryRatedVoltage) }},
+	{"tracer_maximum_battery_voltage_today_volts", "Highest battery voltage today", func(r *Reading) float64 { return float64(r.MaximumBatteryVoltageToday) }},
+	{"tracer_minimum_battery_voltage_today_volts", "Lowest battery voltage today", func(r *Reading) float64 { return float64(r.MinimumBatteryVoltageToday) }},
+	{"tracer_consumed_energy_today_kwh", "Energy consumed today", func(r *Reading) float64 { return float64(r.ConsumedEnergyToday) }},
+	{"tracer_consumed_energy_month_kwh", "Energy consumed this month", func(r *Reading) float64 { return float64(r.ConsumedEnergyMonth) }},
+	{"tracer_consumed_energy_year_kwh", "Energy consumed this year", func(r *Reading) float64 { return float64(r.ConsumedEnergyYear) }},
+	{"tracer_generated_energy_today_kwh", "Energy generated today", func(r *Reading) float64 { return float64(r.GeneratedEnergyToday) }},
+	{"tracer_generated_energy_month_kwh", "Energy generated this month", func(r *Reading) float64 { return float64(r.GeneratedEnergyMonth) }},
+	{"tracer_generated_energy_year_kwh", "Energy generated this year", func(r *Reading) float64 { return float64(r.GeneratedEnergyYear) }},
+	{"tracer_battery_voltage_volts", "Battery voltage", func(r *Reading) float64 { return float64(r.BatteryVoltage) }},
+	{"tracer_battery_current_amperes", "Battery current, negative when discharging", func(r *Reading) float64 { return float64(r.BatteryCurrent) }},
+	{"tracer_reading_duration_seconds", "Time taken to take the reading", func(r *Reading) float64 { return r.Duration.Seconds() }},
+	{"tracer_reading_timestamp_seconds", "When the reading was taken", func(r *Reading) float64 { return float64(r.EndTime.UnixNano()) / 1e9 }},
+}
+
+// readingCounters are the lifetime totals kept by the controller, which only
+// go up.
+var readingCounters = []readingSeries{
+	{"tracer_consumed_energy_kwh", "Energy consumed", func(r *Reading) float64 { return float64(r.ConsumedEnergyTotal) }},
+	{"tracer_generated_energy_kwh", "Energy generated", func(r *Reading) float64 { return float64(r.GeneratedEnergyTotal) }},
+}
+
+// NewReadingMetrics registers a metric for every reading field, labelled with
+// deviceID.
+func NewReadingMetrics(registry *metrics.Registry, deviceID string) *ReadingMetrics {
+	m := &ReadingMetrics{}
+	for _, g := range readingGauges {
+		m.values = append(m.values, registry.Gauge(g.name, g.help, "device").With(deviceID))
+	}
+	for _, c := range readingCounters {
+		m.values = append(m.values, registry.Counter(c.name, c.help, "device").With(deviceID))
+	}
+	return m
+}
+
+type ReadingMetrics struct {
+	values []*metrics.Value
+}
+
+// Record sets the metrics from reading. It is suitable for use with
+// Service.OnRecord.
+func (m *ReadingMetrics) Record(ctx context.Context, reading *Reading) {
+	i := 0
+	for _, g := range readingGauges {
+		m.values[i].Set(g.value(reading))
+		i++
+	}
+	for _, c := range readingCounters {
+		m.values[i].Set(c.value(reading))
+		i++
+	}
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/internal/metrics"
+)
+
+func TestReadingMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	m := NewReadingMetrics(registry, "tracer-1")
+
+	m.Record(context.Background(), &Reading{
+		Day:                  true,
+		SolarPower:           120.5,
+		BatteryCurrent:       -2,
+		GeneratedEnergyTotal: 42,
+		Duration:             250 * time.Millisecond,
+	})
+
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	registry.Write(w)
+	w.Flush()
+
+	for _, line := range []string{
+		`tracer_day{device="tracer-1"} 1`,
+		`tracer_over_temperature{device="tracer-1"} 0`,
+		`tracer_solar_power_watts{device="tracer-1"} 120.5`,
+		`tracer_battery_current_amperes{device="tracer-1"} -2`,
+		`tracer_reading_duration_seconds{device="tracer-1"} 0.25`,
+		`tracer_generated_energy_kwh_total{device="tracer-1"} 42`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
@@ -6,16 +6,50 @@ import (
 	"go.uber.org/zap"
 )
 
+const TopicReading = "tracer/reading"
+const TopicMetadata = "tracer/controller/metadata"
+const TopicAudit = "tracer/audit"
+
 const TopicGetReading = "tracer/controller/getReading/request/#"
 const TopicGetSystemTime = "tracer/controller/getSystemTime/request/#"
 const TopicSetSystemTime = "tracer/controller/setSystemTime/request/#"
 const TopicGetBatteryInformation = "tracer/controller/getBatteryInformation/request/#"
+const TopicGetRatedData = "tracer/controller/getRatedData/request/#"
 const TopicSetBatteryCapacity = "tracer/controller/setBatteryCapacity/request/#"
+const TopicGetChargingProfile = "tracer/controller/getChargingProfile/request/#"
+const TopicSetChargingProfile = "tracer/controller/setChargingProfile/request/#"
+const TopicGetWriteStatistics = "tracer/controller/getWriteStatistics/request/#"
+const TopicExportSettings = "tracer/controller/exportSettings/request/#"
+const TopicImportSettings = "tracer/controller/importSettings/request/#"
+const TopicGetAuditLog = "tracer/controller/getAuditLog/request/#"
+const TopicBatch = "tracer/controller/batch/request/#"
+
+// RequestTopics lists the request topic of every RPC.
+var RequestTopics = []string{
+	TopicGetReading,
+	TopicGetSystemTime,
+	TopicSetSystemTime,
+	TopicGetBatteryInformation,
+	TopicGetRatedData,
+	TopicSetBatteryCapacity,
+	TopicGetChargingProfile,
+	TopicSetChargingProfile,
+	TopicGetWriteStatistics,
+	TopicExportSettings,
+	TopicImportSettings,
+	TopicGetAuditLog,
+	TopicBatch,
+}
 
-func NewMQTTTransport(mqttClient mqtt.Client, api API, logger *zap.Logger) *MQTTTransport {
+// NewMQTTTransport creates an MQTTTransport that handles requests on pool.
+// If verifier is not nil, requests that change the device's settings must be
+// signed.
+func NewMQTTTransport(mqttClient mqtt.Client, api API, pool *transport.Pool, verifier *transport.Verifier, logger *zap.Logger) *MQTTTransport {
 	return &MQTTTransport{
 		mqttClient: mqttClient,
 		api:        api,
+		pool:       pool,
+		verifier:   verifier,
 		logger:     logger,
 	}
 }
@@ -23,35 +57,86 @@ func NewMQTTTransport(mqttClient mqtt.Client, api API, logger *zap.Logger) *MQTT
 type MQTTTransport struct {
 	mqttClient mqtt.Client
 	api        API
+	pool       *transport.Pool
+	verifier   *transport.Verifier
 	logger     *zap.Logger
 }
 
 func (t *MQTTTransport) Register() error {
 	if err := t.subscribe(TopicGetReading, 0,
-		transport.MQTT(t.mqttClient, t.logger, t.api.GetReading)); err != nil {
+		transport.MQTT(t.mqttClient, t.logger, t.api.GetReading, transport.WithPool(t.pool))); err != nil {
 		return err
 	}
 
 	if err := t.subscribe(TopicGetSystemTime, 0,
-		transport.MQTT(t.mqttClient, t.logger, t.api.GetSystemTime)); err != nil {
+		transport.MQTT(t.mqttClient, t.logger, t.api.GetSystemTime, transport.WithPool(t.pool))); err != nil {
 		return err
 	}
 
 	if err := t.subscribe(TopicSetSystemTime, 0,
-		transport.MQTT(t.mqttClient, t.logger, t.api.SetSystemTime)); err != nil {
+		transport.MQTT(t.mqttClient, t.logger, t.api.SetSystemTime, transport.WithPool(t.pool), transport.WithVerifier(t.verifier))); err != nil {
 		return err
 	}
 
 	if err := t.subscribe(TopicGetBatteryInformation, 0,
-		transport.MQTT(t.mqttClient, t.logger, t.api.GetBatteryInformation)); err != nil {
+		transport.MQTT(t.mqttClient, t.logger, t.api.GetBatteryInformation, transport.WithPool(t.pool))); err != nil {
+		return err
+	}
+
+	if err := t.subscribe(TopicGetRatedData, 0,
+		transport.MQTT(t.mqttClient, t.logger, t.api.GetRatedData, transport.WithPool(t.pool))); err != nil {
 		return err
 	}
 
 	if err := t.subscribe(TopicSetBatteryCapacity, 0,
-		transport.MQTT(t.mqttClient, t.logger, t.api.SetBatteryCapacity)); err != nil {
+		transport.MQTT(t.mqttClient, t.logger, t.api.SetBatteryCapacity, transport.WithPool(t.pool), transport.WithVerifier(t.verifier))); err != nil {
+		return err
+	}
+
+	if err := t.subscribe(TopicGetChargingProfile, 0,
+		transport.MQTT(t.mqttClient, t.logger, t.api.GetChargingProfile, transport.WithPool(t.pool))); err != nil {
+		return err
+	}
+
+	if err := t.subscribe(TopicSetChargingProfile, 0,
+		transport.MQTT(t.mqttClient, t.logger, t.api.SetChargingProfile, transport.WithPool(t.pool), transport.WithVerifier(t.verifier))); err != nil {
+		return err
+	}
+
+	if err := t.subscribe(TopicGetWriteStatistics, 0,
+		transport.MQTT(t.mqttClient, t.logger, t.api.GetWriteStatistics, transport.WithPool(t.pool))); err != nil {
+		return err
+	}
+
+	if err := t.subscribe(TopicExportSettings, 0,
+		transport.MQTT(t.mqttClient, t.logger, t.api.ExportSettings, transport.WithPool(t.pool), transport.WithTimeout(SettingsTimeout))); err != nil {
+		return err
+	}
+
+	if err := t.subscribe(TopicImportSettings, 0,
+		transport.MQTT(t.mqttClient, t.logger, t.api.ImportSettings, transport.WithPool(t.pool), transport.WithTimeout(SettingsTimeout), transport.WithVerifier(t.verifier))); err != nil {
+		return err
+	}
+
+	if err := t.subscribe(TopicGetAuditLog, 0,
+		transport.MQTT(t.mqttClient, t.logger, t.api.GetAuditLog, transport.WithPool(t.pool))); err != nil {
 		return err
 	}
 
+	if err := t.subscribe(TopicBatch, 0,
+		transport.MQTT(t.mqttClient, t.logger, t.api.Batch, transport.WithPool(t.pool))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Unregister unsubscribes from the request topics, so no more requests are
+// handed to the pool. It should be called before the pool is closed.
+func (t *MQTTTransport) Unregister() error {
+	if token := t.mqttClient.Unsubscribe(RequestTopics...); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
 	return nil
 }
 
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"go.uber.org/zap"
+)
+
+const chargingProfileAddress = 0x9003
+
+type profileRegister struct {
+	name    string
+	address uint16
+	volts   *float32
+}
+
+// registers maps the fields of p to their holding registers, in address
+// order from chargingProfileAddress.
+func (p *ChargingProfile) registers() []profileRegister {
+	return []profileRegister{
+		{"highVoltageDisconnect", 0x9003, &p.HighVoltageDisconnect},
+		{"chargingLimitVoltage", 0x9004, &p.ChargingLimitVoltage},
+		{"overVoltageReconnect", 0x9005, &p.OverVoltageReconnect},
+		{"equalizationVoltage", 0x9006, &p.EqualizationVoltage},
+		{"boostVoltage", 0x9007, &p.BoostVoltage},
+		{"floatVoltage", 0x9008, &p.FloatVoltage},
+		{"boostReconnectVoltage", 0x9009, &p.BoostReconnectVoltage},
+		{"lowVoltageReconnect", 0x900a, &p.LowVoltageReconnect},
+		{"underVoltageWarningRecover", 0x900b, &p.UnderVoltageWarningRecover},
+		{"underVoltageWarning", 0x900c, &p.UnderVoltageWarning},
+		{"lowVoltageDisconnect", 0x900d, &p.LowVoltageDisconnect},
+		{"dischargingLimitVoltage", 0x900e, &p.DischargingLimitVoltage},
+	}
+}
+
+// validate applies the ordering the Tracer requires between thresholds.
+func (p *ChargingProfile) validate() error {
+	rules := []struct {
+		higher, lower         float32
+		higherName, lowerName string
+		strict                bool
+	}{
+		{p.HighVoltageDisconnect, p.ChargingLimitVoltage, "highVoltageDisconnect", "chargingLimitVoltage", false},
+		{p.HighVoltageDisconnect, p.OverVoltageReconnect, "highVoltageDisconnect", "overVoltageReconnect", true},
+		{p.ChargingLimitVoltage, p.EqualizationVoltage, "chargingLimitVoltage", "equalizationVoltage", false},
+		{p.EqualizationVoltage, p.BoostVoltage, "equalizationVoltage", "boostVoltage", false},
+		{p.BoostVoltage, p.FloatVoltage, "boostVoltage", "floatVoltage", false},
+		{p.FloatVoltage, p.BoostReconnectVoltage, "floatVoltage", "boostReconnectVoltage", true},
+		{p.BoostReconnectVoltage, p.LowVoltageReconnect, "boostReconnectVoltage", "lowVoltageReconnect", true},
+		{p.LowVoltageReconnect, p.LowVoltageDisconnect, "lowVoltageReconnect", "lowVoltageDisconnect", true},
+		{p.UnderVoltageWarningRecover, p.UnderVoltageWarning, "underVoltageWarningRecover", "underVoltageWarning", true},
+		{p.UnderVoltageWarning, p.DischargingLimitVoltage, "underVoltageWarning", "dischargingLimitVoltage", false},
+		{p.LowVoltageDisconnect, p.DischargingLimitVoltage, "lowVoltageDisconnect", "dischargingLimitVoltage", false},
+	}
+
+	for _, r := range p.registers() {
+		if *r.volts <= 0 || *r.volts*100 > math.MaxUint16 {
+			return &InvalidRequestError{Reason: fmt.Sprintf("%s is out of range", r.name)}
+		}
+	}
+
+	for _, r := range rules {
+		if r.higher < r.lower || (r.strict && r.higher == r.lower) {
+			op := ">="
+			if r.strict {
+				op = ">"
+			}
+			return &InvalidRequestError{Reason: fmt.Sprintf("%s must be %s %s", r.higherName, op, r.lowerName)}
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) GetChargingProfile(ctx context.Context, req *GetChargingProfileRequest) (*GetChargingProfileResponse, error) {
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
+
+	var profile ChargingProfile
+	registers := profile.registers()
+
+	results, err := s.client.ReadHoldingRegisters(chargingProfileAddress, uint16(len(registers)))
+	if err != nil {
+		return nil, err
+	}
+	if len(results) < len(registers)*2 {
+		return nil, ErrNotEnoughData
+	}
+
+	for i, r := range registers {
+		*r.volts = getFloatFrom16Bit(results[i*2 : i*2+2])
+	}
+
+	return &GetChargingProfileResponse{ChargingProfile: profile}, nil
+}
+
+// SetChargingProfile writes the registers of the profile that differ from
+// the device as one transaction, restoring the previous values if any write
+// fails.
+func (s *Service) SetChargingProfile(ctx context.Context, req *SetChargingProfileRequest) (res *SetChargingProfileResponse, err error) {
+	if !req.DryRun {
+		defer func() { s.audit(ctx, "setChargingProfile", req, res, err) }()
+	}
+
+	profile := req.ChargingProfile
+	if err := profile.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
+
+	// The thresholds are written as one block, so the Tracer never holds a
+	// mix of old and new values that breaks their ordering.
+	registers := profile.registers()
+	data := make([]byte, len(registers)*2)
+	for i, r := range registers {
+		binary.BigEndian.PutUint16(data[i*2:], uint16(math.Round(float64(*r.volts)*100)))
+	}
+	writes := []registerWrite{
+		{name: "chargingProfile", address: chargingProfileAddress, quantity: uint16(len(registers)), data: data},
+	}
+
+	if req.DryRun {
+		changes, planned, err := s.dryRun(writes)
+		if err != nil {
+			return nil, err
+		}
+		return &SetChargingProfileResponse{Changes: splitChanges(changes, profileNames(registers)), Planned: planned, DryRun: true}, nil
+	}
+
+	changes, err := s.transaction(writes)
+	if err != nil {
+		s.logger.Info("error setting charging profile", zap.Error(err))
+		return nil, err
+	}
+	changes = splitChanges(changes, profileNames(registers))
+
+	s.logger.Info("charging profile set", zap.Int("changes", len(changes)))
+
+	return &SetChargingProfileResponse{Changes: changes}, nil
+}
+
+func profileNames(registers []profileRegister) map[uint16]string {
+	names := make(map[uint16]string, len(registers))
+	for _, r := range registers {
+		names[r.address] = r.name
+	}
+	return names
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testChargingProfile() ChargingProfile {
+	return ChargingProfile{
+		HighVoltageDisconnect:      16.0,
+		ChargingLimitVoltage:       15.0,
+		OverVoltageReconnect:       15.0,
+		EqualizationVoltage:        14.6,
+		BoostVoltage:               14.4,
+		FloatVoltage:               13.8,
+		BoostReconnectVoltage:      13.2,
+		LowVoltageReconnect:        12.6,
+		UnderVoltageWarningRecover: 12.2,
+		UnderVoltageWarning:        12.0,
+		LowVoltageDisconnect:       11.1,
+		DischargingLimitVoltage:    10.6,
+	}
+}
+
+func TestSetChargingProfileWritesBlock(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, time.Hour, 100)
+
+	profile := testChargingProfile()
+	if _, err := s.SetChargingProfile(context.Background(), &SetChargingProfileRequest{ChargingProfile: profile}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.writes) != 1 || client.writes[0] != [2]uint16{chargingProfileAddress, 12} {
+		t.Fatalf("writes = %v, want one write of 12 registers at 0x9003", client.writes)
+	}
+	if client.registers[0x9008] != 1380 {
+		t.Errorf("float voltage register = %d, want 1380", client.registers[0x9008])
+	}
+
+	// Changing one threshold still writes the block, but reports only it.
+	profile.FloatVoltage = 13.7
+	_, err := s.SetChargingProfile(context.Background(), &SetChargingProfileRequest{ChargingProfile: profile})
+	if !errors.Is(err, ErrWriteRejected) {
+		t.Fatalf("err = %v, want the block's interval to apply", err)
+	}
+
+	s = newTestService(t, client, 0, 100)
+	res, err := s.SetChargingProfile(context.Background(), &SetChargingProfileRequest{ChargingProfile: profile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Changes) != 1 || res.Changes[0].Name != "floatVoltage" || res.Changes[0].Old[0] != 1380 || res.Changes[0].New[0] != 1370 {
+		t.Errorf("changes = %+v, want only floatVoltage", res.Changes)
+	}
+	if len(client.writes) != 2 || client.writes[1][1] != 12 {
+		t.Errorf("writes = %v, want a second block write", client.writes)
+	}
+}
+
+func TestSetChargingProfileDryRun(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, 0, 100)
+
+	res, err := s.SetChargingProfile(context.Background(), &SetChargingProfileRequest{ChargingProfile: testChargingProfile(), DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.writes) != 0 {
+		t.Errorf("dry run made %d writes", len(client.writes))
+	}
+	if !res.DryRun {
+		t.Error("response not marked as a dry run")
+	}
+	if len(res.Planned) != 1 || res.Planned[0].Quantity != 12 || len(res.Planned[0].Data) != 24 {
+		t.Errorf("planned = %+v, want one 12 register write", res.Planned)
+	}
+}
+
+func TestSetChargingProfileInvalid(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, 0, 100)
+
+	profile := testChargingProfile()
+	profile.FloatVoltage = profile.BoostReconnectVoltage
+	if _, err := s.SetChargingProfile(context.Background(), &SetChargingProfileRequest{ChargingProfile: profile}); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("err = %v, want ErrInvalidRequest", err)
+	}
+	if len(client.writes) != 0 {
+		t.Errorf("made %d writes", len(client.writes))
+	}
+}
+
+func TestSetChargingProfileVerificationFailure(t *testing.T) {
+	client := newFakeModbus()
+	client.failWrite[chargingProfileAddress] = errors.New("timeout")
+	s := newTestService(t, client, 0, 100)
+
+	_, err := s.SetChargingProfile(context.Background(), &SetChargingProfileRequest{ChargingProfile: testChargingProfile()})
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) || txErr.Step != "chargingProfile" {
+		t.Fatalf("err = %v, want the chargingProfile step to fail", err)
+	}
+	if client.registers[0x9003] != 0 {
+		t.Error("registers changed")
+	}
+}
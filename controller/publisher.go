@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alxyng/tracer/internal/queue"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+const publishTimeout = 5 * time.Second
+const replayInterval = 5 * time.Second
+
+// NewPublisher creates a Publisher that encodes readings with encoding and
+// buffers them in q while the broker is unreachable.
+func NewPublisher(mqttClient mqtt.Client, q *queue.Queue, encoding Encoding, logger *zap.Logger) *Publisher {
+	return &Publisher{
+		mqttClient: mqttClient,
+		queue:      q,
+		encoding:   encoding,
+		logger:     logger,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Publisher publishes readings to TopicReading. Readings that cannot be
+// published are stored on disk, marked as replayed, and published in order
+// once the broker is reachable again. Readings that arrive while the backlog
+// is draining are queued behind it unmarked.
+//
+// The queue only records its position every few readings, so after a crash
+// up to that many readings are published twice.
+type Publisher struct {
+	mu sync.Mutex
+
+	mqttClient mqtt.Client
+	queue      *queue.Queue
+	encoding   Encoding
+	logger     *zap.Logger
+	wake       chan struct{}
+	failures   uint64
+}
+
+// Publish is suitable for use with Service.OnRecord.
+func (p *Publisher) Publish(ctx context.Context, reading *Reading) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queued := *reading
+	queued.Replayed = !p.mqttClient.IsConnectionOpen()
+
+	// Anything already queued has to go out first to keep readings in order.
+	if !queued.Replayed && p.queue.Len() == 0 {
+		payload, err := p.encoding.MarshalReading(reading)
+		if err != nil {
+			p.logger.Error("error marshalling reading", zap.Error(err))
+			return
+		}
+
+		err = p.publish(payload, 0)
+		if err == nil {
+			return
+		}
+		p.logger.Error("error publishing to mqtt", zap.String("topic", TopicReading), zap.Error(err))
+		queued.Replayed = true
+	}
+
+	// Readings are spooled as JSON and encoded when they're replayed, so
+	// they're published in the encoding the metadata advertises even if it
+	// changed while they were queued.
+	data, err := json.Marshal(&queued)
+	if err != nil {
+		p.logger.Error("error marshalling reading", zap.Error(err))
+		return
+	}
+
+	if err := p.queue.Push(data); err != nil {
+		p.logger.Error("error buffering reading", zap.Error(err))
+	}
+}
+
+// PublishMetadata advertises the reading encoding on TopicMetadata. It is
+// retained so consumers receive it as soon as they subscribe.
+func (p *Publisher) PublishMetadata() error {
+	payload, err := json.Marshal(p.encoding.Metadata())
+	if err != nil {
+		return err
+	}
+
+	token := p.mqttClient.Publish(TopicMetadata, 1, true, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return errors.New("timed out publishing")
+	}
+	return token.Error()
+}
+
+// PublishAudit publishes rec to TopicAudit. It is suitable for use with
+// AuditLog.OnAppend. Records are only published while the broker is
+// reachable; the audit log file remains the complete record.
+func (p *Publisher) PublishAudit(rec *AuditRecord) {
+	if !p.mqttClient.IsConnectionOpen() {
+		p.logger.Warn("not connected to mqtt, audit record not published", zap.String("method", rec.Method))
+		return
+	}
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		p.logger.Error("error marshalling audit record", zap.Error(err))
+		return
+	}
+
+	token := p.mqttClient.Publish(TopicAudit, 1, false, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		atomic.AddUint64(&p.failures, 1)
+		p.logger.Error("timed out publishing audit record")
+		return
+	}
+	if err := token.Error(); err != nil {
+		atomic.AddUint64(&p.failures, 1)
+		p.logger.Error("error publishing audit record", zap.Error(err))
+	}
+}
+
+// Failures returns the number of publishes that failed.
+func (p *Publisher) Failures() uint64 {
+	return atomic.LoadUint64(&p.failures)
+}
+
+// Wake prompts the publisher to replay buffered readings, typically from the
+// MQTT client's OnConnect handler.
+func (p *Publisher) Wake() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run replays buffered readings whenever the broker is reachable, until ctx is
+// cancelled.
+func (p *Publisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+
+		p.replay(ctx)
+	}
+}
+
+func (p *Publisher) replay(ctx context.Context) {
+	var replayed int
+	defer func() {
+		if replayed > 0 {
+			p.logger.Info("replayed buffered readings",
+				zap.Int("count", replayed),
+				zap.Int("remaining", p.queue.Len()),
+				zap.Uint64("dropped", p.queue.Dropped()))
+		}
+	}()
+
+	for ctx.Err() == nil && p.mqttClient.IsConnectionOpen() {
+		done, err := p.replayOne()
+		if err != nil {
+			p.logger.Error("error replaying reading", zap.Error(err))
+			return
+		}
+		if done {
+			return
+		}
+		replayed++
+	}
+}
+
+// replayOne publishes the reading at the head of the queue. It doesn't hold
+// p.mu, so Publish isn't held up by a slow acknowledgement; Publish only
+// publishes directly once the queue is empty, so order is kept.
+func (p *Publisher) replayOne() (bool, error) {
+	data, err := p.queue.Peek()
+	if errors.Is(err, queue.ErrEmpty) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var reading Reading
+	if err := json.Unmarshal(data, &reading); err != nil {
+		p.logger.Error("discarding unreadable buffered reading", zap.Error(err))
+		return false, p.queue.Pop()
+	}
+	payload, err := p.encoding.MarshalReading(&reading)
+	if err != nil {
+		return false, err
+	}
+
+	// QoS 1 so a reading only leaves the queue once the broker has it.
+	if err := p.publish(payload, 1); err != nil {
+		return false, err
+	}
+
+	return false, p.queue.Pop()
+}
+
+func (p *Publisher) publish(payload []byte, qos byte) error {
+	token := p.mqttClient.Publish(TopicReading, qos, false, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		atomic.AddUint64(&p.failures, 1)
+		return errors.New("timed out publishing")
+	}
+	if err := token.Error(); err != nil {
+		atomic.AddUint64(&p.failures, 1)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/internal/queue"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+// fakeToken is an mqtt.Token that has already completed.
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool                       { return true }
+func (t *fakeToken) WaitTimeout(d time.Duration) bool { return true }
+func (t *fakeToken) Error() error                     { return t.err }
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+type fakeMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+// fakeClient is an mqtt.Client that records what's published. Methods it
+// doesn't implement panic.
+type fakeClient struct {
+	mqtt.Client
+
+	mu        sync.Mutex
+	connected bool
+	err       error
+	block     chan struct{}
+	published []fakeMessage
+	handlers  map[string]mqtt.MessageHandler
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connected
+}
+
+func (c *fakeClient) setConnected(connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.connected = connected
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if c.block != nil {
+		<-c.block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return &fakeToken{err: c.err}
+	}
+	c.published = append(c.published, fakeMessage{topic: topic, qos: qos, retained: retained, payload: payload.([]byte)})
+	return &fakeToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.handlers == nil {
+		c.handlers = make(map[string]mqtt.MessageHandler)
+	}
+	c.handlers[topic] = callback
+	return &fakeToken{}
+}
+
+// deliver calls the handler subscribed to topic with payload.
+func (c *fakeClient) deliver(topic string, payload []byte) {
+	c.mu.Lock()
+	handler := c.handlers[topic]
+	c.mu.Unlock()
+
+	handler(c, &payloadMessage{payload: payload})
+}
+
+func (c *fakeClient) messages() []fakeMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]fakeMessage(nil), c.published...)
+}
+
+func newTestPublisher(t *testing.T, client *fakeClient) (*Publisher, *queue.Queue) {
+	t.Helper()
+
+	q, err := queue.Open(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	return NewPublisher(client, q, EncodingJSON, zap.NewNop()), q
+}
+
+func decodeReadings(t *testing.T, msgs []fakeMessage) []Reading {
+	t.Helper()
+
+	var readings []Reading
+	for _, msg := range msgs {
+		var r Reading
+		if err := json.Unmarshal(msg.payload, &r); err != nil {
+			t.Fatal(err)
+		}
+		readings = append(readings, r)
+	}
+	return readings
+}
+
+func TestPublisherPublishesLive(t *testing.T) {
+	client := &fakeClient{connected: true}
+	p, q := newTestPublisher(t, client)
+
+	p.Publish(context.Background(), &Reading{BatterySOC: 50})
+
+	readings := decodeReadings(t, client.messages())
+	if len(readings) != 1 || readings[0].BatterySOC != 50 || readings[0].Replayed {
+		t.Fatalf("published %+v, want one live reading", readings)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("queue holds %d readings, want 0", q.Len())
+	}
+}
+
+func TestPublisherReplaysInOrder(t *testing.T) {
+	client := &fakeClient{}
+	p, q := newTestPublisher(t, client)
+
+	// Queued while disconnected.
+	p.Publish(context.Background(), &Reading{BatterySOC: 1})
+	p.Publish(context.Background(), &Reading{BatterySOC: 2})
+
+	// Connected but behind the backlog.
+	client.setConnected(true)
+	p.Publish(context.Background(), &Reading{BatterySOC: 3})
+
+	if q.Len() != 3 {
+		t.Fatalf("queue holds %d readings, want 3", q.Len())
+	}
+	if len(client.messages()) != 0 {
+		t.Fatal("published ahead of the backlog")
+	}
+
+	p.replay(context.Background())
+	p.Publish(context.Background(), &Reading{BatterySOC: 4})
+
+	readings := decodeReadings(t, client.messages())
+	if len(readings) != 4 {
+		t.Fatalf("published %d readings, want 4", len(readings))
+	}
+	for i, r := range readings {
+		if r.BatterySOC != uint16(i+1) {
+			t.Fatalf("reading %d has soc %d, want readings in order", i, r.BatterySOC)
+		}
+		wantReplayed := i < 2
+		if r.Replayed != wantReplayed {
+			t.Errorf("reading %d replayed = %v, want %v", i, r.Replayed, wantReplayed)
+		}
+	}
+	for _, msg := range client.messages()[:3] {
+		if msg.qos != 1 {
+			t.Errorf("replayed with qos %d, want 1", msg.qos)
+		}
+	}
+}
+
+func TestPublisherQueuesFailedPublish(t *testing.T) {
+	client := &fakeClient{connected: true, err: errors.New("broken pipe")}
+	p, q := newTestPublisher(t, client)
+
+	p.Publish(context.Background(), &Reading{BatterySOC: 1})
+	if q.Len() != 1 {
+		t.Fatalf("queue holds %d readings, want 1", q.Len())
+	}
+
+	// A failed replay leaves the reading queued.
+	p.replay(context.Background())
+	if q.Len() != 1 {
+		t.Fatalf("queue holds %d readings after a failed replay, want 1", q.Len())
+	}
+
+	client.mu.Lock()
+	client.err = nil
+	client.mu.Unlock()
+	p.replay(context.Background())
+
+	readings := decodeReadings(t, client.messages())
+	if len(readings) != 1 || !readings[0].Replayed {
+		t.Fatalf("published %+v, want one replayed reading", readings)
+	}
+}
+
+func TestPublisherReplayDoesNotBlockPublish(t *testing.T) {
+	client := &fakeClient{}
+	p, q := newTestPublisher(t, client)
+
+	p.Publish(context.Background(), &Reading{BatterySOC: 1})
+	client.setConnected(true)
+
+	// Hold the replay in the middle of publishing.
+	client.block = make(chan struct{})
+	replayed := make(chan struct{})
+	go func() {
+		p.replay(context.Background())
+		close(replayed)
+	}()
+
+	published := make(chan struct{})
+	go func() {
+		p.Publish(context.Background(), &Reading{BatterySOC: 2})
+		close(published)
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Publish waited for the replay")
+	}
+	if q.Len() != 2 {
+		t.Fatalf("queue holds %d readings, want the live reading queued behind the backlog", q.Len())
+	}
+
+	close(client.block)
+	<-replayed
+
+	readings := decodeReadings(t, client.messages())
+	if len(readings) != 2 || readings[0].BatterySOC != 1 || readings[1].BatterySOC != 2 {
+		t.Fatalf("published %+v, want both readings in order", readings)
+	}
+}
+
+func TestPublisherReplaysInCurrentEncoding(t *testing.T) {
+	client := &fakeClient{}
+	q, err := queue.Open(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	NewPublisher(client, q, EncodingJSON, zap.NewNop()).Publish(context.Background(), &Reading{BatterySOC: 7})
+
+	// Restarted with protobuf while the reading was queued.
+	client.setConnected(true)
+	NewPublisher(client, q, EncodingProtobuf, zap.NewNop()).replay(context.Background())
+
+	msgs := client.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("published %d readings, want 1", len(msgs))
+	}
+	var r Reading
+	if err := EncodingProtobuf.UnmarshalReading(msgs[0].payload, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.BatterySOC != 7 || !r.Replayed {
+		t.Fatalf("replayed %+v, want the queued reading as protobuf", r)
+	}
+}
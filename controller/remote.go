@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alxyng/tracer/internal/transport"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+// RemoteError is an error returned by a remote controller.
+type RemoteError struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *RemoteError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+func (e *RemoteError) ErrorCode() string {
+	return e.Code
+}
+
+// NewRemote creates a Remote that makes requests with requester. If signer is
+// not nil, requests that change the device's settings are signed with it.
+func NewRemote(mqttClient mqtt.Client, requester *transport.Requester, signer *transport.Signer, logger *zap.Logger) *Remote {
+	return &Remote{
+		mqttClient: mqttClient,
+		requester:  requester,
+		signer:     signer,
+		subscriber: NewSubscriber(logger),
+		logger:     logger,
+	}
+}
+
+// Remote implements API by making requests to a controller over MQTT.
+type Remote struct {
+	mqttClient mqtt.Client
+	requester  *transport.Requester
+	signer     *transport.Signer
+	subscriber *Subscriber
+	logger     *zap.Logger
+
+	mu       sync.Mutex
+	onRecord []func(context.Context, *Reading)
+}
+
+// Subscribe subscribes to responses and readings. It should be called from
+// the client's OnConnect handler so the subscriptions survive a reconnect.
+func (r *Remote) Subscribe(c mqtt.Client) error {
+	if err := r.requester.Subscribe(c); err != nil {
+		return err
+	}
+	return r.subscriber.Subscribe(c, r.record)
+}
+
+// Run waits for ctx to be cancelled; readings are taken by the remote
+// controller.
+func (r *Remote) Run(ctx context.Context) {
+	<-ctx.Done()
+}
+
+// OnRecord registers f to be called with every reading the remote controller
+// publishes.
+func (r *Remote) OnRecord(f func(context.Context, *Reading)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onRecord = append(r.onRecord, f)
+}
+
+func (r *Remote) record(ctx context.Context, reading *Reading) {
+	r.mu.Lock()
+	onRecord := r.onRecord
+	r.mu.Unlock()
+
+	for _, f := range onRecord {
+		f(ctx, reading)
+	}
+}
+
+func (r *Remote) GetReading(ctx context.Context, req *GetReadingRequest) (*GetReadingResponse, error) {
+	return call[GetReadingResponse](ctx, r, TopicGetReading, false, req)
+}
+
+func (r *Remote) GetSystemTime(ctx context.Context, req *GetSystemTimeRequest) (*GetSystemTimeResponse, error) {
+	return call[GetSystemTimeResponse](ctx, r, TopicGetSystemTime, false, req)
+}
+
+func (r *Remote) SetSystemTime(ctx context.Context, req *SetSystemTimeRequest) (*SetSystemTimeResponse, error) {
+	return call[SetSystemTimeResponse](ctx, r, TopicSetSystemTime, true, req)
+}
+
+func (r *Remote) GetBatteryInformation(ctx context.Context, req *GetBatteryInformationRequest) (*GetBatteryInformationResponse, error) {
+	return call[GetBatteryInformationResponse](ctx, r, TopicGetBatteryInformation, false, req)
+}
+
+func (r *Remote) GetRatedData(ctx context.Context, req *GetRatedDataRequest) (*GetRatedDataResponse, error) {
+	return call[GetRatedDataResponse](ctx, r, TopicGetRatedData, false, req)
+}
+
+func (r *Remote) SetBatteryCapacity(ctx context.Context, req *SetBatteryCapacityRequest) (*SetBatteryCapacityResponse, error) {
+	return call[SetBatteryCapacityResponse](ctx, r, TopicSetBatteryCapacity, true, req)
+}
+
+func (r *Remote) GetChargingProfile(ctx context.Context, req *GetChargingProfileRequest) (*GetChargingProfileResponse, error) {
+	return call[GetChargingProfileResponse](ctx, r, TopicGetChargingProfile, false, req)
+}
+
+func (r *Remote) SetChargingProfile(ctx context.Context, req *SetChargingProfileRequest) (*SetChargingProfileResponse, error) {
+	return call[SetChargingProfileResponse](ctx, r, TopicSetChargingProfile, true, req)
+}
+
+func (r *Remote) GetWriteStatistics(ctx context.Context, req *GetWriteStatisticsRequest) (*GetWriteStatisticsResponse, error) {
+	return call[GetWriteStatisticsResponse](ctx, r, TopicGetWriteStatistics, false, req)
+}
+
+func (r *Remote) ExportSettings(ctx context.Context, req *ExportSettingsRequest) (*ExportSettingsResponse, error) {
+	return call[ExportSettingsResponse](ctx, r, TopicExportSettings, false, req)
+}
+
+func (r *Remote) ImportSettings(ctx context.Context, req *ImportSettingsRequest) (*ImportSettingsResponse, error) {
+	return call[ImportSettingsResponse](ctx, r, TopicImportSettings, true, req)
+}
+
+func (r *Remote) GetAuditLog(ctx context.Context, req *GetAuditLogRequest) (*GetAuditLogResponse, error) {
+	return call[GetAuditLogResponse](ctx, r, TopicGetAuditLog, false, req)
+}
+
+func (r *Remote) Batch(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	return call[BatchResponse](ctx, r, TopicBatch, false, req)
+}
+
+// call makes a request to topic and decodes the response, or the error the
+// controller responded with. The controller is asked to allow as long as ctx
+// does.
+func call[Res any](ctx context.Context, r *Remote, topic string, signed bool, req any) (*Res, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, err
+		}
+		fields["timeoutMs"] = json.RawMessage(fmt.Sprint(time.Until(deadline).Milliseconds()))
+		if payload, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+
+	var signer *transport.Signer
+	if signed {
+		signer = r.signer
+	}
+
+	data, err := r.requester.Request(ctx, r.mqttClient, topic, payload, signer)
+	if errors.Is(err, transport.ErrTimeout) {
+		r.logger.Error("timed out waiting for mqtt reply", zap.String("topic", topic))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var errRes RemoteError
+	if err := json.Unmarshal(data, &errRes); err != nil {
+		return nil, err
+	}
+	if errRes.Code != "" {
+		return nil, &errRes
+	}
+
+	var res Res
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
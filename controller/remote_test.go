@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/internal/metrics"
+	"github.com/alxyng/tracer/internal/transport"
+	"go.uber.org/zap"
+)
+
+// newTestRemote returns a Remote whose requests are answered by respond, with
+// the request's payload.
+func newTestRemote(t *testing.T, respond func(request map[string]any) any) *Remote {
+	t.Helper()
+
+	client := &fakeClient{}
+	requester := transport.NewRequester(RequestTopics, metrics.NewRegistry(), zap.NewNop())
+	remote := NewRemote(client, requester, nil, zap.NewNop())
+	if err := requester.Subscribe(client); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			msgs := client.messages()
+			if len(msgs) > 0 {
+				msg := msgs[0]
+				var request map[string]any
+				json.Unmarshal(msg.payload, &request)
+				data, _ := json.Marshal(respond(request))
+
+				topic := strings.Replace(msg.topic, "/request/", "/response/", 1)
+				client.mu.Lock()
+				handler := client.handlers[topic[:strings.LastIndex(topic, "/")]+"/+"]
+				client.mu.Unlock()
+				handler(client, &payloadMessage{topic: topic, payload: data})
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	return remote
+}
+
+func TestRemote(t *testing.T) {
+	var timeoutMs float64
+	remote := newTestRemote(t, func(request map[string]any) any {
+		timeoutMs, _ = request["timeoutMs"].(float64)
+		return &SetBatteryCapacityResponse{DryRun: true}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := remote.SetBatteryCapacity(ctx, &SetBatteryCapacityRequest{Capacity: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.DryRun {
+		t.Error("response not decoded")
+	}
+	if timeoutMs < 4000 || timeoutMs > 5000 {
+		t.Errorf("timeoutMs = %v, want the context's deadline", timeoutMs)
+	}
+}
+
+func TestRemoteError(t *testing.T) {
+	remote := newTestRemote(t, func(map[string]any) any {
+		return &RemoteError{Code: "writeRejected", Message: "daily budget exhausted"}
+	})
+
+	_, err := remote.SetBatteryCapacity(context.Background(), &SetBatteryCapacityRequest{Capacity: 100})
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.ErrorCode() != "writeRejected" || remoteErr.Message != "daily budget exhausted" {
+		t.Errorf("err = %v, want the controller's error", err)
+	}
+}
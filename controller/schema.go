@@ -45,6 +45,10 @@ type Reading struct {
 	StartTime time.Time     `json:"startTime"`
 	EndTime   time.Time     `json:"endTime"`
 	Duration  time.Duration `json:"duration"`
+
+	// Replayed is set on readings that were buffered while the broker was
+	// unreachable and published after it came back.
+	Replayed bool `json:"replayed,omitempty"`
 }
 
 type BatteryType int
@@ -89,9 +93,17 @@ type GetSystemTimeResponse struct {
 
 type SetSystemTimeRequest struct {
 	Time time.Time `json:"time"`
+	// DryRun returns the writes that would be made without making them.
+	DryRun bool `json:"dryRun"`
 }
 
-type SetSystemTimeResponse struct{}
+type SetSystemTimeResponse struct {
+	Changes []RegisterChange `json:"changes"`
+	Planned []PlannedWrite   `json:"planned,omitempty"`
+	// DryRun is set when Changes lists the changes a dry run would have
+	// made rather than ones that were made.
+	DryRun bool `json:"dryRun,omitempty"`
+}
 
 type GetBatteryInformationRequest struct{}
 
@@ -100,8 +112,205 @@ type GetBatteryInformationResponse struct {
 	BatteryCapacity uint16      `json:"batteryCapacity"`
 }
 
+// ChargingMode is how the controller charges the battery.
+type ChargingMode int
+
+const (
+	ChargingModeNone ChargingMode = iota
+	ChargingModePWM
+	ChargingModeMPPT
+)
+
+func (cm ChargingMode) String() string {
+	switch cm {
+	case ChargingModeNone:
+		return "None"
+	case ChargingModePWM:
+		return "PWM"
+	case ChargingModeMPPT:
+		return "MPPT"
+	}
+	return "Unknown"
+}
+
+func (cm ChargingMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cm.String())
+}
+
+// RatedData is the controller's rated input and output, which don't change.
+type RatedData struct {
+	SolarVoltage   float32      `json:"solarVoltage"`   // 3000
+	SolarCurrent   float32      `json:"solarCurrent"`   // 3001
+	SolarPower     float32      `json:"solarPower"`     // 3002, 3003
+	BatteryVoltage float32      `json:"batteryVoltage"` // 3004
+	BatteryCurrent float32      `json:"batteryCurrent"` // 3005
+	BatteryPower   float32      `json:"batteryPower"`   // 3006, 3007
+	ChargingMode   ChargingMode `json:"chargingMode"`   // 3008
+	LoadCurrent    float32      `json:"loadCurrent"`    // 300E
+}
+
+type GetRatedDataRequest struct{}
+
+type GetRatedDataResponse struct {
+	RatedData RatedData `json:"ratedData"`
+}
+
 type SetBatteryCapacityRequest struct {
 	Capacity uint16 `json:"capacity"`
+	// DryRun returns the writes that would be made without making them.
+	DryRun bool `json:"dryRun"`
+}
+
+type SetBatteryCapacityResponse struct {
+	Changes []RegisterChange `json:"changes"`
+	Planned []PlannedWrite   `json:"planned,omitempty"`
+	// DryRun is set when Changes lists the changes a dry run would have
+	// made rather than ones that were made.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// ChargingProfile holds the battery voltage thresholds, in volts.
+type ChargingProfile struct {
+	HighVoltageDisconnect      float32 `json:"highVoltageDisconnect"`      // 9003
+	ChargingLimitVoltage       float32 `json:"chargingLimitVoltage"`       // 9004
+	OverVoltageReconnect       float32 `json:"overVoltageReconnect"`       // 9005
+	EqualizationVoltage        float32 `json:"equalizationVoltage"`        // 9006
+	BoostVoltage               float32 `json:"boostVoltage"`               // 9007
+	FloatVoltage               float32 `json:"floatVoltage"`               // 9008
+	BoostReconnectVoltage      float32 `json:"boostReconnectVoltage"`      // 9009
+	LowVoltageReconnect        float32 `json:"lowVoltageReconnect"`        // 900A
+	UnderVoltageWarningRecover float32 `json:"underVoltageWarningRecover"` // 900B
+	UnderVoltageWarning        float32 `json:"underVoltageWarning"`        // 900C
+	LowVoltageDisconnect       float32 `json:"lowVoltageDisconnect"`       // 900D
+	DischargingLimitVoltage    float32 `json:"dischargingLimitVoltage"`    // 900E
+}
+
+type GetChargingProfileRequest struct{}
+
+type GetChargingProfileResponse struct {
+	ChargingProfile ChargingProfile `json:"chargingProfile"`
+}
+
+type SetChargingProfileRequest struct {
+	ChargingProfile ChargingProfile `json:"chargingProfile"`
+	// DryRun returns the writes that would be made without making them.
+	DryRun bool `json:"dryRun"`
 }
 
-type SetBatteryCapacityResponse struct{}
+type SetChargingProfileResponse struct {
+	Changes []RegisterChange `json:"changes"`
+	Planned []PlannedWrite   `json:"planned,omitempty"`
+	// DryRun is set when Changes lists the changes a dry run would have
+	// made rather than ones that were made.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+type WriteStatistics struct {
+	// Writes is the number of writes made to each register, keyed by
+	// address.
+	Writes      map[string]uint64 `json:"writes"`
+	WritesToday int               `json:"writesToday"`
+	DailyBudget int               `json:"dailyBudget"`
+	// Suppressed is the number of writes skipped because the register
+	// already held the value.
+	Suppressed uint64 `json:"suppressed"`
+	Rejected   uint64 `json:"rejected"`
+}
+
+type GetWriteStatisticsRequest struct{}
+
+type GetWriteStatisticsResponse struct {
+	WriteStatistics
+}
+
+// Settings is a copy of the controller's writable holding registers and
+// coils, keyed by name. Holding registers hold the raw register value.
+type Settings struct {
+	Version          int               `json:"version"`
+	ExportedAt       time.Time         `json:"exportedAt"`
+	HoldingRegisters map[string]uint16 `json:"holdingRegisters"`
+	Coils            map[string]bool   `json:"coils"`
+}
+
+type ExportSettingsRequest struct{}
+
+type ExportSettingsResponse struct {
+	Settings   Settings `json:"settings"`
+	Unreadable []string `json:"unreadable,omitempty"`
+}
+
+type ImportSettingsRequest struct {
+	Settings Settings `json:"settings"`
+	// DryRun returns the writes that would be made without making them.
+	DryRun bool `json:"dryRun"`
+}
+
+// SettingDifference is a setting whose value on the controller, Old, differs
+// from the imported value, New. Coils are 0 or 1.
+type SettingDifference struct {
+	Name    string  `json:"name"`
+	Address Address `json:"address"`
+	Coil    bool    `json:"coil,omitempty"`
+	Old     uint16  `json:"old"`
+	New     uint16  `json:"new"`
+}
+
+type ImportSettingsResponse struct {
+	Differences []SettingDifference `json:"differences"`
+	Changes     []RegisterChange    `json:"changes"`
+	Planned     []PlannedWrite      `json:"planned,omitempty"`
+	DryRun      bool                `json:"dryRun,omitempty"`
+}
+
+// AuditRecord describes a request that may have changed the device's
+// settings. Changes lists the registers that were written, with their old and
+// new values.
+type AuditRecord struct {
+	Time      time.Time        `json:"time"`
+	Method    string           `json:"method"`
+	Source    string           `json:"source,omitempty"`
+	ClientID  string           `json:"clientId,omitempty"`
+	Principal string           `json:"principal,omitempty"`
+	RequestID string           `json:"requestId,omitempty"`
+	Request   json.RawMessage  `json:"request"`
+	Changes   []RegisterChange `json:"changes"`
+	Outcome   string           `json:"outcome"`
+	Error     string           `json:"error,omitempty"`
+	// RolledBack lists the changes undone after a failed transaction.
+	RolledBack []RegisterChange `json:"rolledBack,omitempty"`
+}
+
+type GetAuditLogRequest struct {
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Method string    `json:"method"`
+	Limit  int       `json:"limit"`
+}
+
+type GetAuditLogResponse struct {
+	Records []AuditRecord `json:"records"`
+}
+
+// BatchCall is one call in a batch. Method names a read-only RPC, such as
+// getReading, and Request holds its request.
+type BatchCall struct {
+	Method  string          `json:"method"`
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+type BatchRequest struct {
+	Calls []BatchCall `json:"calls"`
+}
+
+// BatchResult is the outcome of a call in a batch: either its response, or
+// an error code and message as a request on its own would have returned.
+type BatchResult struct {
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Message  string          `json:"message,omitempty"`
+}
+
+type BatchResponse struct {
+	// Results holds the result of each call, in the order they were made.
+	Results []BatchResult `json:"results"`
+}
@@ -12,26 +12,55 @@ import (
 )
 
 var (
-	ErrNotEnoughData = errors.New("not enough data")
+	ErrNotEnoughData  = errors.New("not enough data")
+	ErrInvalidRequest = errors.New("invalid request")
 )
 
-func NewService(client modbus.Client, logger *zap.Logger) *Service {
+// InvalidRequestError is returned when a request fails validation.
+type InvalidRequestError struct {
+	Reason string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return "invalid request: " + e.Reason
+}
+
+func (e *InvalidRequestError) Is(target error) bool {
+	return target == ErrInvalidRequest
+}
+
+func (e *InvalidRequestError) ErrorCode() string {
+	return "invalidRequest"
+}
+
+// NewService creates a Service. If auditLog is not nil, requests that change
+// the device's settings are recorded in it.
+func NewService(client modbus.Client, guard *WriteGuard, auditLog *AuditLog, logger *zap.Logger) *Service {
 	return &Service{
 		client:    client,
+		guard:     guard,
+		auditLog:  auditLog,
 		logger:    logger,
+		bus:       make(chan struct{}, 1),
 		iteration: 0,
 	}
 }
 
 type Service struct {
 	readingMutex sync.Mutex
-	serialMutex  sync.Mutex
+
+	// bus is held while using the Modbus client. It is a channel rather than
+	// a mutex so waiting for it can be abandoned when a request's deadline
+	// passes.
+	bus chan struct{}
 
 	client    modbus.Client
+	guard     *WriteGuard
+	auditLog  *AuditLog
 	logger    *zap.Logger
 	iteration uint64
 
-	onRecord func(context.Context, *Reading)
+	onRecord []func(context.Context, *Reading)
 
 	reading Reading
 }
@@ -49,38 +78,60 @@ func (s *Service) Run(ctx context.Context) {
 	}
 }
 
+// OnRecord registers f to be called with every reading taken. Callbacks are
+// called in the order they were registered.
 func (s *Service) OnRecord(f func(context.Context, *Reading)) {
-	s.onRecord = f
+	s.onRecord = append(s.onRecord, f)
 }
 
 func (s *Service) takeReading(ctx context.Context, start time.Time) {
+	reading, ok := s.readDevice(ctx, start)
+	if !ok {
+		return
+	}
+
+	s.readingMutex.Lock()
+	s.reading = *reading
+	s.iteration++
+	s.readingMutex.Unlock()
+
+	// Callbacks run without holding the bus so they are free to call back
+	// into the service.
+	for _, f := range s.onRecord {
+		f(ctx, reading)
+	}
+}
+
+func (s *Service) readDevice(ctx context.Context, start time.Time) (*Reading, bool) {
 	var results []byte
 	var err error
 	var reading Reading
 
-	s.serialMutex.Lock()
-	defer s.serialMutex.Unlock()
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, false
+	}
+	defer s.releaseBus(ctx)
 
 	reading.StartTime = start.UTC()
 
 	results, err = s.client.ReadDiscreteInputs(0x2000, 1)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 	reading.OverTemperature = results[0] != 0x00
 
 	results, err = s.client.ReadDiscreteInputs(0x200c, 1)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 	reading.Day = results[0] == 0x00
 
 	results, err = s.client.ReadInputRegisters(0x3100, 4)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 
 	reading.SolarVoltage = getFloatFrom16Bit(results[0:2])
@@ -90,7 +141,7 @@ func (s *Service) takeReading(ctx context.Context, start time.Time) {
 	results, err = s.client.ReadInputRegisters(0x310c, 4)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 
 	reading.LoadVoltage = getFloatFrom16Bit(results[0:2])
@@ -100,7 +151,7 @@ func (s *Service) takeReading(ctx context.Context, start time.Time) {
 	results, err = s.client.ReadInputRegisters(0x3110, 2)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 
 	reading.BatteryTemperature = getFloatFrom16Bit(results[0:2])
@@ -109,7 +160,7 @@ func (s *Service) takeReading(ctx context.Context, start time.Time) {
 	results, err = s.client.ReadInputRegisters(0x311a, 1)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 
 	reading.BatterySOC = getUint16(results[0:2])
@@ -117,7 +168,7 @@ func (s *Service) takeReading(ctx context.Context, start time.Time) {
 	results, err = s.client.ReadInputRegisters(0x311d, 1)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 
 	reading.BatteryRatedVoltage = getUint16(results[0:2]) / 100
@@ -125,7 +176,7 @@ func (s *Service) takeReading(ctx context.Context, start time.Time) {
 	results, err = s.client.ReadInputRegisters(0x3302, 18)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 
 	reading.MaximumBatteryVoltageToday = getFloatFrom16Bit(results[0:2])
@@ -142,7 +193,7 @@ func (s *Service) takeReading(ctx context.Context, start time.Time) {
 	results, err = s.client.ReadInputRegisters(0x331a, 3)
 	if err != nil {
 		s.logger.Error("error reading", zap.Error(err))
-		return
+		return nil, false
 	}
 
 	reading.BatteryVoltage = getFloatFrom16Bit(results[0:2])
@@ -154,16 +205,7 @@ func (s *Service) takeReading(ctx context.Context, start time.Time) {
 	reading.EndTime = time.Now().UTC()
 	reading.Duration = reading.EndTime.Sub(reading.StartTime)
 
-	s.readingMutex.Lock()
-	defer s.readingMutex.Unlock()
-
-	s.reading = reading
-
-	if s.onRecord != nil {
-		s.onRecord(ctx, &s.reading)
-	}
-
-	s.iteration++
+	return &reading, true
 }
 
 func (s *Service) GetReading(ctx context.Context, req *GetReadingRequest) (*GetReadingResponse, error) {
@@ -174,8 +216,10 @@ func (s *Service) GetReading(ctx context.Context, req *GetReadingRequest) (*GetR
 }
 
 func (s *Service) GetSystemTime(ctx context.Context, req *GetSystemTimeRequest) (*GetSystemTimeResponse, error) {
-	s.serialMutex.Lock()
-	defer s.serialMutex.Unlock()
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
 
 	results, err := s.client.ReadHoldingRegisters(0x9013, 3)
 	if err != nil {
@@ -185,43 +229,49 @@ func (s *Service) GetSystemTime(ctx context.Context, req *GetSystemTimeRequest)
 		return nil, ErrNotEnoughData
 	}
 
-	min := int(results[0])
-	sec := int(results[1])
-	day := int(results[2])
-	hour := int(results[3])
-	year := 2000 + int(results[4])
-	month := time.Month(results[5])
-
-	return &GetSystemTimeResponse{Time: time.Date(year, month, day, hour, min, sec, 0, time.UTC)}, nil
+	return &GetSystemTimeResponse{Time: decodeSystemTime(results)}, nil
 }
 
-func (s *Service) SetSystemTime(ctx context.Context, req *SetSystemTimeRequest) (*SetSystemTimeResponse, error) {
-	s.serialMutex.Lock()
-	defer s.serialMutex.Unlock()
+func (s *Service) SetSystemTime(ctx context.Context, req *SetSystemTimeRequest) (res *SetSystemTimeResponse, err error) {
+	if !req.DryRun {
+		defer func() { s.audit(ctx, "setSystemTime", req, res, err) }()
+	}
 
-	data := make([]byte, 6)
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
+
+	writes := []registerWrite{
+		{name: "systemTime", address: 0x9013, quantity: 3, data: encodeSystemTime(req.Time), volatile: true, equal: equalSystemTime},
+	}
 
-	data[0] = byte(req.Time.Minute())
-	data[1] = byte(req.Time.Second())
-	data[2] = byte(req.Time.Day())
-	data[3] = byte(req.Time.Hour())
-	data[4] = byte(req.Time.Year() - 2000)
-	data[5] = byte(req.Time.Month())
+	if req.DryRun {
+		changes, planned, err := s.dryRun(writes)
+		if err != nil {
+			return nil, err
+		}
+		return &SetSystemTimeResponse{Changes: changes, Planned: planned, DryRun: true}, nil
+	}
 
-	_, err := s.client.WriteMultipleRegisters(0x9013, 3, data)
+	changes, err := s.transaction(writes)
 	if err != nil {
 		s.logger.Info("error setting system time", zap.Error(err))
 		return nil, err
 	}
 
-	s.logger.Info("system time set", zap.Time("systemTime", req.Time))
+	if len(changes) > 0 {
+		s.logger.Info("system time set", zap.Time("systemTime", req.Time))
+	}
 
-	return &SetSystemTimeResponse{}, nil
+	return &SetSystemTimeResponse{Changes: changes}, nil
 }
 
 func (s *Service) GetBatteryInformation(ctx context.Context, req *GetBatteryInformationRequest) (*GetBatteryInformationResponse, error) {
-	s.serialMutex.Lock()
-	defer s.serialMutex.Unlock()
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
 
 	results, err := s.client.ReadHoldingRegisters(0x9000, 2)
 	if err != nil {
@@ -237,22 +287,143 @@ func (s *Service) GetBatteryInformation(ctx context.Context, req *GetBatteryInfo
 	}, nil
 }
 
-func (s *Service) SetBatteryCapacity(ctx context.Context, req *SetBatteryCapacityRequest) (*SetBatteryCapacityResponse, error) {
-	s.serialMutex.Lock()
-	defer s.serialMutex.Unlock()
+func (s *Service) GetRatedData(ctx context.Context, req *GetRatedDataRequest) (*GetRatedDataResponse, error) {
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
+
+	results, err := s.client.ReadInputRegisters(0x3000, 15)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) < 30 {
+		return nil, ErrNotEnoughData
+	}
+
+	return &GetRatedDataResponse{
+		RatedData: RatedData{
+			SolarVoltage:   getFloatFrom16Bit(results[0:2]),
+			SolarCurrent:   getFloatFrom16Bit(results[2:4]),
+			SolarPower:     getFloatFrom32Bit(results[4:8]),
+			BatteryVoltage: getFloatFrom16Bit(results[8:10]),
+			BatteryCurrent: getFloatFrom16Bit(results[10:12]),
+			BatteryPower:   getFloatFrom32Bit(results[12:16]),
+			ChargingMode:   ChargingMode(getUint16(results[16:18])),
+			LoadCurrent:    getFloatFrom16Bit(results[28:30]),
+		},
+	}, nil
+}
+
+func (s *Service) SetBatteryCapacity(ctx context.Context, req *SetBatteryCapacityRequest) (res *SetBatteryCapacityResponse, err error) {
+	if !req.DryRun {
+		defer func() { s.audit(ctx, "setBatteryCapacity", req, res, err) }()
+	}
+
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
 
 	data := make([]byte, 2)
 	binary.BigEndian.PutUint16(data, req.Capacity)
 
-	_, err := s.client.WriteMultipleRegisters(0x9001, 1, data)
+	writes := []registerWrite{
+		{name: "batteryCapacity", address: 0x9001, quantity: 1, data: data},
+	}
+
+	if req.DryRun {
+		changes, planned, err := s.dryRun(writes)
+		if err != nil {
+			return nil, err
+		}
+		return &SetBatteryCapacityResponse{Changes: changes, Planned: planned, DryRun: true}, nil
+	}
+
+	changes, err := s.transaction(writes)
 	if err != nil {
 		s.logger.Info("error setting battery capacity", zap.Error(err))
 		return nil, err
 	}
 
-	s.logger.Info("battery capacity set", zap.Uint16("capacity", req.Capacity))
+	if len(changes) > 0 {
+		s.logger.Info("battery capacity set", zap.Uint16("capacity", req.Capacity))
+	}
+
+	return &SetBatteryCapacityResponse{Changes: changes}, nil
+}
+
+func (s *Service) GetWriteStatistics(ctx context.Context, req *GetWriteStatisticsRequest) (*GetWriteStatisticsResponse, error) {
+	return &GetWriteStatisticsResponse{WriteStatistics: s.guard.Statistics()}, nil
+}
+
+type busKey struct{}
+
+// acquireBus waits for exclusive use of the Modbus client, giving up if ctx
+// is done first. It returns immediately if ctx already holds the bus, as in a
+// batch.
+func (s *Service) acquireBus(ctx context.Context) error {
+	if s.holdsBus(ctx) {
+		return nil
+	}
+	select {
+	case s.bus <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Service) releaseBus(ctx context.Context) {
+	if s.holdsBus(ctx) {
+		return
+	}
+	<-s.bus
+}
+
+// withBus returns a context whose requests use the bus already acquired by
+// the caller.
+func (s *Service) withBus(ctx context.Context) context.Context {
+	return context.WithValue(ctx, busKey{}, s)
+}
+
+func (s *Service) holdsBus(ctx context.Context) bool {
+	held, _ := ctx.Value(busKey{}).(*Service)
+	return held == s
+}
+
+func encodeSystemTime(t time.Time) []byte {
+	data := make([]byte, 6)
+
+	data[0] = byte(t.Minute())
+	data[1] = byte(t.Second())
+	data[2] = byte(t.Day())
+	data[3] = byte(t.Hour())
+	data[4] = byte(t.Year() - 2000)
+	data[5] = byte(t.Month())
 
-	return &SetBatteryCapacityResponse{}, nil
+	return data
+}
+
+func decodeSystemTime(data []byte) time.Time {
+	min := int(data[0])
+	sec := int(data[1])
+	day := int(data[2])
+	hour := int(data[3])
+	year := 2000 + int(data[4])
+	month := time.Month(data[5])
+
+	return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+}
+
+// equalSystemTime allows for the clock ticking between writing the system
+// time and reading it back.
+func equalSystemTime(written, read []byte) bool {
+	if len(written) < 6 || len(read) < 6 {
+		return false
+	}
+	d := decodeSystemTime(read).Sub(decodeSystemTime(written))
+	return d >= 0 && d <= 5*time.Second
 }
 
 func getUint16(data []byte) uint16 {
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSetBatteryCapacityDryRun(t *testing.T) {
+	client := newFakeModbus()
+	client.registers[0x9001] = 200
+	s := newTestService(t, client, time.Hour, 100)
+
+	res, err := s.SetBatteryCapacity(context.Background(), &SetBatteryCapacityRequest{Capacity: 100, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.DryRun {
+		t.Error("response not marked as a dry run")
+	}
+	if len(res.Changes) != 1 || res.Changes[0].Old[0] != 200 || res.Changes[0].New[0] != 100 {
+		t.Errorf("changes = %+v, want 200 to 100", res.Changes)
+	}
+	if len(res.Planned) != 1 || res.Planned[0].Function != FunctionWriteMultipleRegisters || string(res.Planned[0].Data) != "\x00\x64" {
+		t.Errorf("planned = %+v", res.Planned)
+	}
+	if len(client.writes) != 0 || s.guard.Statistics().WritesToday != 0 {
+		t.Error("dry run wrote or was counted")
+	}
+
+	// The write itself isn't marked.
+	res, err = s.SetBatteryCapacity(context.Background(), &SetBatteryCapacityRequest{Capacity: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DryRun || len(res.Planned) != 0 || len(res.Changes) != 1 {
+		t.Errorf("response = %+v", res)
+	}
+}
+
+func TestSetSystemTime(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, time.Hour, 1)
+
+	now := time.Date(2024, 6, 1, 12, 30, 15, 0, time.UTC)
+	res, err := s.SetSystemTime(context.Background(), &SetSystemTimeRequest{Time: now, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.DryRun || len(res.Planned) != 1 || len(client.writes) != 0 {
+		t.Errorf("dry run response = %+v", res)
+	}
+
+	// The clock isn't limited by the write guard.
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Minute)
+		if _, err := s.SetSystemTime(context.Background(), &SetSystemTimeRequest{Time: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := client.ReadHoldingRegisters(0x9013, 3)
+	if got := decodeSystemTime(data); !got.Equal(now) {
+		t.Errorf("clock = %s, want %s", got, now)
+	}
+}
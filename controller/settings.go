@@ -0,0 +1,392 @@
+package controller
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SettingsVersion is the version of the Settings document written by
+// ExportSettings.
+const SettingsVersion = 1
+
+// maxRunLength is the most holding registers read or written in one request.
+const maxRunLength = 32
+
+// settingTimeout is how long is allowed per setting for reading, writing and
+// reading back the settings, and restoring them if an import fails.
+const settingTimeout = 500 * time.Millisecond
+
+// SettingsTimeout is how long to allow for exporting or importing every
+// setting.
+var SettingsTimeout = time.Duration(len(settings)) * settingTimeout
+
+type setting struct {
+	name    string
+	address uint16
+	coil    bool
+
+	// alone is written on its own rather than with adjacent registers.
+	alone bool
+}
+
+// settings lists every writable holding register and coil, in the order they
+// are written on import. The battery type comes first, on its own, as the
+// controller only accepts charging profile changes for user defined
+// batteries. The real time clock and the coils used for testing the load at
+// runtime are left out.
+var settings = []setting{
+	{name: "batteryType", address: 0x9000, alone: true},
+	{name: "batteryCapacity", address: 0x9001},
+	{name: "temperatureCompensationCoefficient", address: 0x9002},
+	{name: "highVoltageDisconnect", address: 0x9003},
+	{name: "chargingLimitVoltage", address: 0x9004},
+	{name: "overVoltageReconnect", address: 0x9005},
+	{name: "equalizationVoltage", address: 0x9006},
+	{name: "boostVoltage", address: 0x9007},
+	{name: "floatVoltage", address: 0x9008},
+	{name: "boostReconnectVoltage", address: 0x9009},
+	{name: "lowVoltageReconnect", address: 0x900a},
+	{name: "underVoltageWarningRecover", address: 0x900b},
+	{name: "underVoltageWarning", address: 0x900c},
+	{name: "lowVoltageDisconnect", address: 0x900d},
+	{name: "dischargingLimitVoltage", address: 0x900e},
+	{name: "equalizationChargingCycle", address: 0x9016},
+	{name: "batteryTemperatureWarningUpperLimit", address: 0x9017},
+	{name: "batteryTemperatureWarningLowerLimit", address: 0x9018},
+	{name: "controllerTemperatureUpperLimit", address: 0x9019},
+	{name: "controllerTemperatureUpperLimitRecover", address: 0x901a},
+	{name: "powerComponentTemperatureUpperLimit", address: 0x901b},
+	{name: "powerComponentTemperatureUpperLimitRecover", address: 0x901c},
+	{name: "lineImpedance", address: 0x901d},
+	{name: "nightTimeThresholdVoltage", address: 0x901e},
+	{name: "nightDelayTime", address: 0x901f},
+	{name: "dayTimeThresholdVoltage", address: 0x9020},
+	{name: "dayDelayTime", address: 0x9021},
+	{name: "loadControllingMode", address: 0x903d},
+	{name: "workingTimeLength1", address: 0x903e},
+	{name: "workingTimeLength2", address: 0x903f},
+	{name: "turnOnTiming1Second", address: 0x9042},
+	{name: "turnOnTiming1Minute", address: 0x9043},
+	{name: "turnOnTiming1Hour", address: 0x9044},
+	{name: "turnOffTiming1Second", address: 0x9045},
+	{name: "turnOffTiming1Minute", address: 0x9046},
+	{name: "turnOffTiming1Hour", address: 0x9047},
+	{name: "turnOnTiming2Second", address: 0x9048},
+	{name: "turnOnTiming2Minute", address: 0x9049},
+	{name: "turnOnTiming2Hour", address: 0x904a},
+	{name: "turnOffTiming2Second", address: 0x904b},
+	{name: "turnOffTiming2Minute", address: 0x904c},
+	{name: "turnOffTiming2Hour", address: 0x904d},
+	{name: "lengthOfNight", address: 0x9065},
+	{name: "batteryRatedVoltageCode", address: 0x9067},
+	{name: "loadTimingControlSelection", address: 0x9069},
+	{name: "defaultLoadOnOffInManualMode", address: 0x906a},
+	{name: "equalizeDuration", address: 0x906b},
+	{name: "boostDuration", address: 0x906c},
+	{name: "dischargingPercentage", address: 0x906d},
+	{name: "chargingPercentage", address: 0x906e},
+	{name: "batteryManagementMode", address: 0x9070},
+	{name: "manualLoadControl", address: 0x0002, coil: true},
+}
+
+// runtimeCoils were exported by earlier versions. They're skipped on import.
+var runtimeCoils = map[string]bool{
+	"loadTestMode": true,
+	"forceLoad":    true,
+}
+
+// validate checks the document can be imported and returns the settings it
+// contains.
+func (doc *Settings) validate() ([]setting, error) {
+	if doc.Version != SettingsVersion {
+		return nil, &InvalidRequestError{Reason: fmt.Sprintf("unsupported settings version %d", doc.Version)}
+	}
+
+	known := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		known[s.name] = s
+	}
+
+	var unknown []string
+	for name := range doc.HoldingRegisters {
+		if s, ok := known[name]; !ok || s.coil {
+			unknown = append(unknown, name)
+		}
+	}
+	for name := range doc.Coils {
+		if s, ok := known[name]; (!ok || !s.coil) && !runtimeCoils[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, &InvalidRequestError{Reason: fmt.Sprintf("unknown settings %v", unknown)}
+	}
+
+	var included []setting
+	for _, s := range settings {
+		if _, ok := doc.value(s); ok {
+			included = append(included, s)
+		}
+	}
+	if len(included) == 0 {
+		return nil, &InvalidRequestError{Reason: "no settings to import"}
+	}
+
+	return included, nil
+}
+
+func (doc *Settings) value(s setting) (uint16, bool) {
+	if s.coil {
+		on, ok := doc.Coils[s.name]
+		if on {
+			return 1, ok
+		}
+		return 0, ok
+	}
+	v, ok := doc.HoldingRegisters[s.name]
+	return v, ok
+}
+
+// ExportSettings reads every setting of the controller. Settings the
+// controller refuses to read are left out and listed as unreadable.
+func (s *Service) ExportSettings(ctx context.Context, req *ExportSettingsRequest) (*ExportSettingsResponse, error) {
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
+
+	values, errs := s.readSettings(settings)
+
+	doc := Settings{
+		Version:          SettingsVersion,
+		ExportedAt:       time.Now().UTC(),
+		HoldingRegisters: make(map[string]uint16),
+		Coils:            make(map[string]bool),
+	}
+	var unreadable []string
+
+	for _, setting := range settings {
+		if err, ok := errs[setting.name]; ok {
+			s.logger.Warn("error reading setting", zap.String("setting", setting.name), zap.Error(err))
+			unreadable = append(unreadable, setting.name)
+			continue
+		}
+		if setting.coil {
+			doc.Coils[setting.name] = values[setting.name] != 0
+		} else {
+			doc.HoldingRegisters[setting.name] = values[setting.name]
+		}
+	}
+
+	return &ExportSettingsResponse{Settings: doc, Unreadable: unreadable}, nil
+}
+
+// ImportSettings compares the settings in the document with the controller
+// and writes those that differ as one transaction. Settings missing from the
+// document are left alone.
+func (s *Service) ImportSettings(ctx context.Context, req *ImportSettingsRequest) (res *ImportSettingsResponse, err error) {
+	if !req.DryRun {
+		defer func() { s.audit(ctx, "importSettings", req, res, err) }()
+	}
+
+	included, err := req.Settings.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.acquireBus(ctx); err != nil {
+		return nil, err
+	}
+	defer s.releaseBus(ctx)
+
+	// The whole charging profile is read if any of it is being imported so
+	// the result can be validated.
+	toRead := included
+	if touchesProfile(included) {
+		toRead = nil
+		for _, setting := range settings {
+			_, ok := req.Settings.value(setting)
+			if ok || isProfileSetting(setting) {
+				toRead = append(toRead, setting)
+			}
+		}
+	}
+
+	values, errs := s.readSettings(toRead)
+	for _, setting := range toRead {
+		if err, ok := errs[setting.name]; ok {
+			return nil, fmt.Errorf("reading %s: %w", setting.name, err)
+		}
+	}
+
+	differences := []SettingDifference{}
+	var changed []setting
+	for _, setting := range included {
+		old := values[setting.name]
+		value, _ := req.Settings.value(setting)
+		if old == value {
+			continue
+		}
+
+		differences = append(differences, SettingDifference{
+			Name:    setting.name,
+			Address: Address(setting.address),
+			Coil:    setting.coil,
+			Old:     old,
+			New:     value,
+		})
+		changed = append(changed, setting)
+		values[setting.name] = value
+	}
+	writes := settingWrites(changed, values)
+
+	if touchesProfile(included) {
+		if err := validateProfileValues(values); err != nil {
+			return nil, err
+		}
+	}
+
+	res = &ImportSettingsResponse{Differences: differences, Changes: []RegisterChange{}, DryRun: req.DryRun}
+	if len(writes) == 0 {
+		return res, nil
+	}
+
+	names := make(map[uint16]string, len(changed))
+	for _, setting := range changed {
+		if !setting.coil {
+			names[setting.address] = setting.name
+		}
+	}
+
+	if req.DryRun {
+		var changes []RegisterChange
+		changes, res.Planned, err = s.dryRun(writes)
+		if err != nil {
+			return nil, err
+		}
+		res.Changes = splitChanges(changes, names)
+		return res, nil
+	}
+
+	changes, err := s.transaction(writes)
+	if err != nil {
+		s.logger.Info("error importing settings", zap.Error(err))
+		return nil, err
+	}
+	res.Changes = splitChanges(changes, names)
+
+	s.logger.Info("settings imported", zap.Int("changes", len(res.Changes)))
+
+	return res, nil
+}
+
+// settingWrites writes runs of adjacent holding registers in list together.
+// Coils are written one at a time.
+func settingWrites(list []setting, values map[string]uint16) []registerWrite {
+	var writes []registerWrite
+
+	for i := 0; i < len(list); {
+		j := i + 1
+		for !list[i].coil && !list[i].alone && j < len(list) && j-i < maxRunLength &&
+			!list[j].coil && !list[j].alone && list[j].address == list[j-1].address+1 {
+			j++
+		}
+
+		run := list[i:j]
+		data := make([]byte, len(run)*2)
+		for n, setting := range run {
+			binary.BigEndian.PutUint16(data[n*2:], values[setting.name])
+		}
+
+		name := run[0].name
+		if len(run) > 1 {
+			name = fmt.Sprintf("%s to %s", run[0].name, run[len(run)-1].name)
+		}
+		writes = append(writes, registerWrite{name: name, address: run[0].address, quantity: uint16(len(run)), data: data, coil: run[0].coil})
+
+		i = j
+	}
+
+	return writes
+}
+
+func isProfileSetting(s setting) bool {
+	return !s.coil && s.address >= chargingProfileAddress && s.address < chargingProfileAddress+12
+}
+
+func touchesProfile(list []setting) bool {
+	for _, s := range list {
+		if isProfileSetting(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateProfileValues checks the charging profile that would result from
+// an import.
+func validateProfileValues(values map[string]uint16) error {
+	var profile ChargingProfile
+	for _, r := range profile.registers() {
+		*r.volts = float32(values[r.name]) / 100
+	}
+	return profile.validate()
+}
+
+// readSettings reads the given settings, reading adjacent holding registers
+// together. If a run can't be read its registers are read one at a time so
+// that a single unsupported register doesn't hide the rest. The bus must be
+// held.
+func (s *Service) readSettings(list []setting) (map[string]uint16, map[string]error) {
+	values := make(map[string]uint16, len(list))
+	errs := make(map[string]error)
+
+	for i := 0; i < len(list); {
+		j := i + 1
+		for !list[i].coil && j < len(list) && j-i < maxRunLength &&
+			!list[j].coil && list[j].address == list[j-1].address+1 {
+			j++
+		}
+
+		run := list[i:j]
+		results, err := s.readRun(run)
+		if err != nil && len(run) > 1 {
+			for n := range run {
+				results, err := s.readRun(run[n : n+1])
+				if err != nil {
+					errs[run[n].name] = err
+					continue
+				}
+				values[run[n].name] = results[0]
+			}
+		} else if err != nil {
+			errs[run[0].name] = err
+		} else {
+			for n, setting := range run {
+				values[setting.name] = results[n]
+			}
+		}
+
+		i = j
+	}
+
+	return values, errs
+}
+
+func (s *Service) readRun(run []setting) ([]uint16, error) {
+	w := registerWrite{address: run[0].address, quantity: uint16(len(run)), coil: run[0].coil}
+	data, err := s.readStep(&w)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(run)*2 {
+		return nil, ErrNotEnoughData
+	}
+	return registerValues(data), nil
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestExportSettingsLeavesOutRuntimeCoils(t *testing.T) {
+	client := newFakeModbus()
+	client.registers[0x9001] = 200
+	client.coils[0x0002] = true
+	s := newTestService(t, client, 0, 100)
+
+	res, err := s.ExportSettings(context.Background(), &ExportSettingsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := res.Settings
+	if doc.Version != SettingsVersion || doc.HoldingRegisters["batteryCapacity"] != 200 || !doc.Coils["manualLoadControl"] {
+		t.Errorf("settings = %+v", doc)
+	}
+	for name := range runtimeCoils {
+		if _, ok := doc.Coils[name]; ok {
+			t.Errorf("exported runtime coil %s", name)
+		}
+	}
+}
+
+func TestImportSettingsWritesBlocks(t *testing.T) {
+	client := newFakeModbus()
+	client.registers[0x9002] = 3
+	s := newTestService(t, client, 0, 100)
+
+	doc := Settings{
+		Version: SettingsVersion,
+		HoldingRegisters: map[string]uint16{
+			"batteryType":                         1,
+			"batteryCapacity":                     100,
+			"temperatureCompensationCoefficient":  3,
+			"equalizationChargingCycle":           30,
+			"batteryTemperatureWarningUpperLimit": 6500,
+			"batteryTemperatureWarningLowerLimit": 0,
+			"controllerTemperatureUpperLimit":     8500,
+		},
+		Coils: map[string]bool{"manualLoadControl": true},
+	}
+
+	res, err := s.ImportSettings(context.Background(), &ImportSettingsRequest{Settings: doc})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The battery type is written alone, then 0x9001 on its own as 0x9002
+	// doesn't change, then 0x9016 to 0x9019 skipping the unchanged 0x9018
+	// and finally the coil.
+	want := [][2]uint16{{0x9000, 1}, {0x9001, 1}, {0x9016, 2}, {0x9019, 1}, {0x0002, 1}}
+	if len(client.writes) != len(want) {
+		t.Fatalf("writes = %x, want %x", client.writes, want)
+	}
+	for i := range want {
+		if client.writes[i] != want[i] {
+			t.Errorf("write %d = %x, want %x", i, client.writes[i], want[i])
+		}
+	}
+
+	if len(res.Differences) != 6 || len(res.Changes) != 6 {
+		t.Fatalf("differences = %+v, changes = %+v, want 6 of each", res.Differences, res.Changes)
+	}
+	for i, d := range res.Differences {
+		if c := res.Changes[i]; c.Name != d.Name || c.New[0] != d.New {
+			t.Errorf("change %d = %+v, want it to match %+v", i, c, d)
+		}
+	}
+	if client.registers[0x9017] != 6500 || !client.coils[0x0002] {
+		t.Error("settings not written")
+	}
+}
+
+func TestImportSettingsSkipsRuntimeCoils(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, 0, 100)
+
+	doc := Settings{
+		Version:          SettingsVersion,
+		HoldingRegisters: map[string]uint16{"batteryCapacity": 100},
+		Coils:            map[string]bool{"loadTestMode": true, "forceLoad": true},
+	}
+	if _, err := s.ImportSettings(context.Background(), &ImportSettingsRequest{Settings: doc}); err != nil {
+		t.Fatal(err)
+	}
+	if client.coils[0x0005] || client.coils[0x0006] {
+		t.Error("wrote runtime coils")
+	}
+
+	doc.Coils = map[string]bool{"loadTestMode": true}
+	doc.HoldingRegisters = nil
+	if _, err := s.ImportSettings(context.Background(), &ImportSettingsRequest{Settings: doc}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("err = %v, want nothing to import", err)
+	}
+}
+
+func TestImportSettingsDryRun(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, 0, 100)
+
+	doc := Settings{
+		Version:          SettingsVersion,
+		HoldingRegisters: map[string]uint16{"batteryCapacity": 100, "temperatureCompensationCoefficient": 3},
+	}
+	res, err := s.ImportSettings(context.Background(), &ImportSettingsRequest{Settings: doc, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.writes) != 0 {
+		t.Errorf("dry run made %d writes", len(client.writes))
+	}
+	if !res.DryRun {
+		t.Error("response not marked as a dry run")
+	}
+	if len(res.Planned) != 1 || res.Planned[0].Quantity != 2 {
+		t.Errorf("planned = %+v, want one write of 2 registers", res.Planned)
+	}
+}
+
+func TestImportSettingsUnknown(t *testing.T) {
+	s := newTestService(t, newFakeModbus(), 0, 100)
+
+	doc := Settings{Version: SettingsVersion, HoldingRegisters: map[string]uint16{"systemTime": 1}}
+	if _, err := s.ImportSettings(context.Background(), &ImportSettingsRequest{Settings: doc}); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("err = %v, want ErrInvalidRequest", err)
+	}
+}
@@ -0,0 +1,530 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alxyng/tracer/internal/sparkplug"
+	"github.com/alxyng/tracer/internal/transport"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+const metricRebirth = "Node Control/Rebirth"
+const metricBdSeq = "bdSeq"
+const metricSystemTime = "Settings/SystemTime"
+const metricBatteryCapacity = "Settings/BatteryCapacity"
+
+const aliasRebirth = 1
+const aliasSystemTime = 2
+const aliasBatteryCapacity = 3
+const aliasFirstReading = 10
+
+// deviceTimeout is how long the device can go without a reading before it is
+// reported dead.
+const deviceTimeout = 10 * time.Second
+
+// callbackTimeout bounds the controller calls made on the MQTT client's
+// callback goroutine, so a stuck controller can't hold up the client or the
+// birth certificates after a reconnect.
+const callbackTimeout = 10 * time.Second
+
+var ErrUnknownMetric = errors.New("unknown metric")
+
+type readingMetric struct {
+	name     string
+	alias    uint64
+	dataType sparkplug.DataType
+	field    int
+}
+
+// buildReadingMetrics derives the Sparkplug metric definitions from the
+// fields of t, named after their JSON keys.
+func buildReadingMetrics(t reflect.Type) ([]readingMetric, error) {
+	var metrics []readingMetric
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" || f.Name == "Replayed" {
+			continue
+		}
+
+		var dataType sparkplug.DataType
+		switch f.Type {
+		case reflect.TypeOf(time.Time{}):
+			dataType = sparkplug.DateTime
+		case reflect.TypeOf(time.Duration(0)):
+			dataType = sparkplug.Int64
+		default:
+			switch f.Type.Kind() {
+			case reflect.Bool:
+				dataType = sparkplug.Boolean
+			case reflect.Float32:
+				dataType = sparkplug.Float
+			case reflect.Uint16:
+				dataType = sparkplug.UInt16
+			default:
+				return nil, fmt.Errorf("no sparkplug data type for field %s of kind %s", f.Name, f.Type.Kind())
+			}
+		}
+
+		metrics = append(metrics, readingMetric{
+			name:     name,
+			alias:    uint64(aliasFirstReading + len(metrics)),
+			dataType: dataType,
+			field:    i,
+		})
+	}
+
+	return metrics, nil
+}
+
+func (m readingMetric) value(reading *Reading) any {
+	v := reflect.ValueOf(reading).Elem().Field(m.field)
+	switch m.dataType {
+	case sparkplug.DateTime:
+		return v.Interface().(time.Time)
+	case sparkplug.Int64:
+		return uint64(v.Int())
+	case sparkplug.Boolean:
+		return v.Bool()
+	case sparkplug.Float:
+		return float32(v.Float())
+	default:
+		return v.Uint()
+	}
+}
+
+// NewSparkplugNode creates a Sparkplug B edge node with a single device
+// backed by api. The bdSeq of the last session is kept in bdSeqFile, so it
+// keeps counting across restarts. DCMD messages can't be signed, so if
+// readOnly is set, as it must be whenever setting changes have to be signed,
+// they're refused.
+func NewSparkplugNode(api API, groupID, edgeNodeID, deviceID, bdSeqFile string, readOnly bool, logger *zap.Logger) (*SparkplugNode, error) {
+	metrics, err := buildReadingMetrics(reflect.TypeOf(Reading{}))
+	if err != nil {
+		return nil, err
+	}
+
+	n := &SparkplugNode{
+		api:        api,
+		groupID:    groupID,
+		edgeNodeID: edgeNodeID,
+		deviceID:   deviceID,
+		bdSeqFile:  bdSeqFile,
+		readOnly:   readOnly,
+		logger:     logger,
+		metrics:    metrics,
+		last:       make(map[uint64]any),
+	}
+
+	bdSeq, err := readBdSeq(bdSeqFile)
+	if err != nil {
+		return nil, err
+	}
+	n.bdSeq = bdSeq
+	if err := n.nextSession(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// SparkplugNode publishes readings as Sparkplug B DDATA messages and maps
+// DCMD writes onto the API's setters.
+type SparkplugNode struct {
+	mu sync.Mutex
+
+	api        API
+	groupID    string
+	edgeNodeID string
+	deviceID   string
+	bdSeqFile  string
+	readOnly   bool
+	logger     *zap.Logger
+	metrics    []readingMetric
+
+	mqttClient  mqtt.Client
+	bdSeq       uint64
+	seq         uint64
+	deviceAlive bool
+	lastReading time.Time
+	last        map[uint64]any
+}
+
+// Will returns the topic and payload of the NDEATH message, which must be
+// registered as the client's will before it connects.
+func (n *SparkplugNode) Will() (string, []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.will()
+}
+
+// will must be called with n.mu held.
+func (n *SparkplugNode) will() (string, []byte) {
+	payload := sparkplug.Payload{
+		Timestamp: time.Now(),
+		Metrics: []sparkplug.Metric{
+			{Name: metricBdSeq, DataType: sparkplug.UInt64, Value: n.bdSeq},
+		},
+	}
+	return n.topic(sparkplug.NDEATH, false), payload.Marshal()
+}
+
+// OnReconnecting starts a new session, registering NDEATH with the next
+// bdSeq as the will. It should be the client's reconnecting handler.
+func (n *SparkplugNode) OnReconnecting(c mqtt.Client, opts *mqtt.ClientOptions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.nextSession(); err != nil {
+		// bdSeq still moves on in memory, so this session is distinct from
+		// the last; it may repeat one from before a restart.
+		n.logger.Error("error saving sparkplug bdSeq", zap.String("file", n.bdSeqFile), zap.Error(err))
+	}
+
+	topic, payload := n.will()
+	opts.SetBinaryWill(topic, payload, 1, false)
+}
+
+// nextSession moves on to the next bdSeq and saves it. It must be called
+// with n.mu held, or before n is shared.
+func (n *SparkplugNode) nextSession() error {
+	n.bdSeq = (n.bdSeq + 1) % 256
+	return writeBdSeq(n.bdSeqFile, n.bdSeq)
+}
+
+// readBdSeq returns the bdSeq saved in path, or 255 if there isn't one so the
+// first session is 0.
+func readBdSeq(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 255, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	bdSeq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bdSeq in %s: %w", path, err)
+	}
+	return bdSeq, nil
+}
+
+func writeBdSeq(path string, bdSeq uint64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(bdSeq, 10)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// OnConnect subscribes to commands and publishes the birth certificates. It
+// should be called from the client's OnConnect handler.
+func (n *SparkplugNode) OnConnect(c mqtt.Client) error {
+	n.mu.Lock()
+	n.mqttClient = c
+	n.mu.Unlock()
+
+	if token := c.Subscribe(n.topic(sparkplug.NCMD, false), 1, n.handleNodeCommand); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	if token := c.Subscribe(n.topic(sparkplug.DCMD, true), 1, n.handleDeviceCommand); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+	return n.birth(ctx)
+}
+
+// Run reports the device dead when readings stop arriving, until ctx is
+// cancelled.
+func (n *SparkplugNode) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.mu.Lock()
+			if n.deviceAlive && time.Since(n.lastReading) > deviceTimeout {
+				n.logger.Info("no readings from device, publishing DDEATH")
+				n.deviceDeath()
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// Publish is suitable for use with Service.OnRecord. Only metrics that have
+// changed since the last DDATA are sent.
+func (n *SparkplugNode) Publish(ctx context.Context, reading *Reading) {
+	n.mu.Lock()
+	n.lastReading = time.Now()
+	connected := n.mqttClient != nil && n.mqttClient.IsConnectionOpen()
+	alive := n.deviceAlive
+	n.mu.Unlock()
+
+	if !connected {
+		return
+	}
+
+	if !alive {
+		if err := n.deviceBirth(ctx, reading); err != nil {
+			n.logger.Error("error publishing DBIRTH", zap.Error(err))
+		}
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var metrics []sparkplug.Metric
+	for _, m := range n.metrics {
+		v := m.value(reading)
+		if last, ok := n.last[m.alias]; ok && last == v {
+			continue
+		}
+		n.last[m.alias] = v
+		metrics = append(metrics, sparkplug.Metric{
+			Alias:     m.alias,
+			Timestamp: reading.EndTime,
+			DataType:  m.dataType,
+			Value:     v,
+		})
+	}
+
+	if len(metrics) == 0 {
+		return
+	}
+
+	if err := n.publish(sparkplug.DDATA, true, reading.EndTime, metrics); err != nil {
+		n.logger.Error("error publishing DDATA", zap.Error(err))
+	}
+}
+
+func (n *SparkplugNode) birth(ctx context.Context) error {
+	n.mu.Lock()
+	n.seq = 0
+	n.deviceAlive = false
+	n.last = make(map[uint64]any)
+
+	err := n.publish(sparkplug.NBIRTH, false, time.Now(), []sparkplug.Metric{
+		{Name: metricBdSeq, DataType: sparkplug.UInt64, Value: n.bdSeq},
+		{Name: metricRebirth, Alias: aliasRebirth, DataType: sparkplug.Boolean, Value: false},
+	})
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	res, err := n.api.GetReading(ctx, &GetReadingRequest{})
+	if err != nil {
+		return err
+	}
+	if res.Reading.EndTime.IsZero() {
+		// Nothing has been read from the device yet. DBIRTH is published
+		// with the first reading.
+		return nil
+	}
+
+	return n.deviceBirth(ctx, &res.Reading)
+}
+
+func (n *SparkplugNode) deviceBirth(ctx context.Context, reading *Reading) error {
+	// Settings are read before taking the lock, since reading them waits for
+	// the bus.
+	settings := []sparkplug.Metric{
+		{Name: metricSystemTime, Alias: aliasSystemTime, DataType: sparkplug.DateTime},
+		{Name: metricBatteryCapacity, Alias: aliasBatteryCapacity, DataType: sparkplug.UInt16},
+	}
+	if res, err := n.api.GetSystemTime(ctx, &GetSystemTimeRequest{}); err == nil {
+		settings[0].Value = res.Time
+	} else {
+		n.logger.Error("error getting system time", zap.Error(err))
+	}
+	if res, err := n.api.GetBatteryInformation(ctx, &GetBatteryInformationRequest{}); err == nil {
+		settings[1].Value = uint64(res.BatteryCapacity)
+	} else {
+		n.logger.Error("error getting battery information", zap.Error(err))
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	metrics := settings
+	for i := range metrics {
+		metrics[i].Timestamp = now
+	}
+	for _, m := range n.metrics {
+		v := m.value(reading)
+		n.last[m.alias] = v
+		metrics = append(metrics, sparkplug.Metric{
+			Name:      m.name,
+			Alias:     m.alias,
+			Timestamp: reading.EndTime,
+			DataType:  m.dataType,
+			Value:     v,
+		})
+	}
+
+	if err := n.publish(sparkplug.DBIRTH, true, now, metrics); err != nil {
+		return err
+	}
+
+	n.deviceAlive = true
+	n.lastReading = now
+	return nil
+}
+
+// deviceDeath must be called with n.mu held.
+func (n *SparkplugNode) deviceDeath() {
+	n.deviceAlive = false
+	n.last = make(map[uint64]any)
+
+	if n.mqttClient == nil || !n.mqttClient.IsConnectionOpen() {
+		return
+	}
+	if err := n.publish(sparkplug.DDEATH, true, time.Now(), nil); err != nil {
+		n.logger.Error("error publishing DDEATH", zap.Error(err))
+	}
+}
+
+// Close publishes DDEATH and NDEATH ahead of a graceful disconnect.
+func (n *SparkplugNode) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.deviceAlive {
+		n.deviceDeath()
+	}
+
+	if n.mqttClient == nil || !n.mqttClient.IsConnectionOpen() {
+		return
+	}
+
+	// The will is only sent if the connection drops, so publish NDEATH
+	// explicitly before disconnecting.
+	topic, payload := n.will()
+	token := n.mqttClient.Publish(topic, 1, false, payload)
+	if !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+		n.logger.Error("error publishing NDEATH", zap.Error(token.Error()))
+	}
+}
+
+func (n *SparkplugNode) handleNodeCommand(c mqtt.Client, msg mqtt.Message) {
+	payload, err := sparkplug.Unmarshal(msg.Payload())
+	if err != nil {
+		n.logger.Error("error unmarshalling NCMD", zap.Error(err))
+		return
+	}
+
+	for _, m := range payload.Metrics {
+		if (m.Name == metricRebirth || m.Alias == aliasRebirth) && m.Value == true {
+			n.logger.Info("rebirth requested")
+			ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+			if err := n.birth(ctx); err != nil {
+				n.logger.Error("error publishing birth certificates", zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+func (n *SparkplugNode) handleDeviceCommand(c mqtt.Client, msg mqtt.Message) {
+	if n.readOnly {
+		n.logger.Warn("rejecting DCMD, setting changes must be signed")
+		return
+	}
+
+	payload, err := sparkplug.Unmarshal(msg.Payload())
+	if err != nil {
+		n.logger.Error("error unmarshalling DCMD", zap.Error(err))
+		return
+	}
+
+	ctx := transport.WithCaller(context.Background(), transport.Caller{Source: transport.SourceSparkplug})
+	for _, m := range payload.Metrics {
+		cmdCtx, cancel := context.WithTimeout(ctx, callbackTimeout)
+		changed, err := n.command(cmdCtx, m)
+		cancel()
+		if err != nil {
+			n.logger.Error("error handling DCMD", zap.String("metric", m.Name), zap.Uint64("alias", m.Alias), zap.Error(err))
+			continue
+		}
+
+		n.mu.Lock()
+		if err := n.publish(sparkplug.DDATA, true, time.Now(), []sparkplug.Metric{*changed}); err != nil {
+			n.logger.Error("error publishing DDATA", zap.Error(err))
+		}
+		n.mu.Unlock()
+	}
+}
+
+// command applies a DCMD metric and returns the metric to report back.
+func (n *SparkplugNode) command(ctx context.Context, m sparkplug.Metric) (*sparkplug.Metric, error) {
+	switch {
+	case m.Name == metricSystemTime || m.Alias == aliasSystemTime:
+		v, ok := m.Value.(uint64)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for %s", metricSystemTime)
+		}
+		t := time.UnixMilli(int64(v)).UTC()
+		if _, err := n.api.SetSystemTime(ctx, &SetSystemTimeRequest{Time: t}); err != nil {
+			return nil, err
+		}
+		return &sparkplug.Metric{Alias: aliasSystemTime, Timestamp: time.Now(), DataType: sparkplug.DateTime, Value: t}, nil
+
+	case m.Name == metricBatteryCapacity || m.Alias == aliasBatteryCapacity:
+		v, ok := m.Value.(uint64)
+		if !ok || v > 0xffff {
+			return nil, fmt.Errorf("invalid value for %s", metricBatteryCapacity)
+		}
+		if _, err := n.api.SetBatteryCapacity(ctx, &SetBatteryCapacityRequest{Capacity: uint16(v)}); err != nil {
+			return nil, err
+		}
+		return &sparkplug.Metric{Alias: aliasBatteryCapacity, Timestamp: time.Now(), DataType: sparkplug.UInt16, Value: v}, nil
+	}
+
+	return nil, ErrUnknownMetric
+}
+
+// publish must be called with n.mu held.
+func (n *SparkplugNode) publish(typ sparkplug.MessageType, device bool, timestamp time.Time, metrics []sparkplug.Metric) error {
+	seq := n.seq
+	n.seq = (n.seq + 1) % 256
+
+	payload := sparkplug.Payload{
+		Timestamp: timestamp,
+		Metrics:   metrics,
+		Seq:       &seq,
+	}
+
+	token := n.mqttClient.Publish(n.topic(typ, device), 0, false, payload.Marshal())
+	if !token.WaitTimeout(publishTimeout) {
+		return errors.New("timed out publishing")
+	}
+	return token.Error()
+}
+
+func (n *SparkplugNode) topic(typ sparkplug.MessageType, device bool) string {
+	deviceID := ""
+	if device {
+		deviceID = n.deviceID
+	}
+	return sparkplug.Topic(n.groupID, typ, n.edgeNodeID, deviceID)
+}
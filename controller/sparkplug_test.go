@@ -0,0 +1,263 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/internal/sparkplug"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+// fakeAPI answers the calls the Sparkplug node makes. Methods it doesn't
+// implement panic.
+type fakeAPI struct {
+	API
+
+	reading  Reading
+	capacity uint16
+	// calls and unbounded count the calls made, and those made without a
+	// deadline.
+	calls, unbounded int
+}
+
+func (a *fakeAPI) call(ctx context.Context) {
+	a.calls++
+	if _, ok := ctx.Deadline(); !ok {
+		a.unbounded++
+	}
+}
+
+func (a *fakeAPI) GetReading(ctx context.Context, req *GetReadingRequest) (*GetReadingResponse, error) {
+	a.call(ctx)
+	return &GetReadingResponse{Reading: a.reading}, nil
+}
+
+func (a *fakeAPI) GetSystemTime(ctx context.Context, req *GetSystemTimeRequest) (*GetSystemTimeResponse, error) {
+	a.call(ctx)
+	return &GetSystemTimeResponse{Time: time.Unix(0, 0)}, nil
+}
+
+func (a *fakeAPI) GetBatteryInformation(ctx context.Context, req *GetBatteryInformationRequest) (*GetBatteryInformationResponse, error) {
+	a.call(ctx)
+	return &GetBatteryInformationResponse{BatteryCapacity: a.capacity}, nil
+}
+
+func (a *fakeAPI) SetBatteryCapacity(ctx context.Context, req *SetBatteryCapacityRequest) (*SetBatteryCapacityResponse, error) {
+	a.call(ctx)
+	a.capacity = req.Capacity
+	return &SetBatteryCapacityResponse{}, nil
+}
+
+func newTestSparkplugNode(t *testing.T, bdSeqFile string) *SparkplugNode {
+	t.Helper()
+
+	n, err := NewSparkplugNode(&fakeAPI{}, "group", "node", "device", bdSeqFile, false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// payloadBdSeq returns the bdSeq metric of a NBIRTH or NDEATH payload.
+func payloadBdSeq(t *testing.T, data []byte) uint64 {
+	t.Helper()
+
+	payload, err := sparkplug.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range payload.Metrics {
+		if m.Name == metricBdSeq {
+			return m.Value.(uint64)
+		}
+	}
+	t.Fatal("no bdSeq metric in payload")
+	return 0
+}
+
+func published(client *fakeClient, typ sparkplug.MessageType) []fakeMessage {
+	var msgs []fakeMessage
+	for _, msg := range client.messages() {
+		if msg.topic == sparkplug.Topic("group", typ, "node", "") || msg.topic == sparkplug.Topic("group", typ, "node", "device") {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+func TestSparkplugBdSeqPerSession(t *testing.T) {
+	bdSeqFile := filepath.Join(t.TempDir(), "bdseq")
+	n := newTestSparkplugNode(t, bdSeqFile)
+
+	_, will := n.Will()
+	if bdSeq := payloadBdSeq(t, will); bdSeq != 0 {
+		t.Fatalf("first session bdSeq = %d, want 0", bdSeq)
+	}
+
+	client := &fakeClient{connected: true}
+	if err := n.OnConnect(client); err != nil {
+		t.Fatal(err)
+	}
+	if bdSeq := payloadBdSeq(t, published(client, sparkplug.NBIRTH)[0].payload); bdSeq != 0 {
+		t.Fatalf("NBIRTH bdSeq = %d, want the will's 0", bdSeq)
+	}
+
+	// The connection drops and paho reconnects.
+	opts := mqtt.NewClientOptions()
+	n.OnReconnecting(client, opts)
+	if bdSeq := payloadBdSeq(t, opts.WillPayload); bdSeq != 1 {
+		t.Fatalf("reconnected will bdSeq = %d, want 1", bdSeq)
+	}
+	if err := n.OnConnect(client); err != nil {
+		t.Fatal(err)
+	}
+	if bdSeq := payloadBdSeq(t, published(client, sparkplug.NBIRTH)[1].payload); bdSeq != 1 {
+		t.Fatalf("NBIRTH bdSeq = %d, want the will's 1", bdSeq)
+	}
+
+	// And carries on after a restart.
+	n = newTestSparkplugNode(t, bdSeqFile)
+	if _, will := n.Will(); payloadBdSeq(t, will) != 2 {
+		t.Fatalf("bdSeq after restart = %d, want 2", payloadBdSeq(t, will))
+	}
+}
+
+func TestSparkplugBdSeqWraps(t *testing.T) {
+	bdSeqFile := filepath.Join(t.TempDir(), "bdseq")
+	if err := os.WriteFile(bdSeqFile, []byte("255\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	n := newTestSparkplugNode(t, bdSeqFile)
+	if _, will := n.Will(); payloadBdSeq(t, will) != 0 {
+		t.Fatalf("bdSeq after 255 = %d, want 0", payloadBdSeq(t, will))
+	}
+}
+
+func TestSparkplugBdSeqInvalidFile(t *testing.T) {
+	bdSeqFile := filepath.Join(t.TempDir(), "bdseq")
+	if err := os.WriteFile(bdSeqFile, []byte("256"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSparkplugNode(&fakeAPI{}, "group", "node", "device", bdSeqFile, false, zap.NewNop()); err == nil {
+		t.Fatal("NewSparkplugNode() accepted an out of range bdSeq")
+	}
+}
+
+func TestBuildReadingMetrics(t *testing.T) {
+	metrics, err := buildReadingMetrics(reflect.TypeOf(Reading{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range metrics {
+		if m.alias != uint64(aliasFirstReading+i) {
+			t.Errorf("metric %s has alias %d, want %d", m.name, m.alias, aliasFirstReading+i)
+		}
+		if m.name == "replayed" {
+			t.Error("replayed is published as a metric")
+		}
+	}
+
+	type unsupported struct {
+		Count int32 `json:"count"`
+	}
+	if _, err := buildReadingMetrics(reflect.TypeOf(unsupported{})); err == nil {
+		t.Fatal("buildReadingMetrics() accepted an int32 field")
+	}
+}
+
+func TestSparkplugPublishesChangedMetrics(t *testing.T) {
+	n := newTestSparkplugNode(t, filepath.Join(t.TempDir(), "bdseq"))
+	client := &fakeClient{connected: true}
+	if err := n.OnConnect(client); err != nil {
+		t.Fatal(err)
+	}
+
+	reading := testReading()
+	n.Publish(context.Background(), reading)
+	if len(published(client, sparkplug.DBIRTH)) != 1 {
+		t.Fatal("first reading didn't publish DBIRTH")
+	}
+
+	changed := *reading
+	changed.BatterySOC++
+	n.Publish(context.Background(), &changed)
+
+	ddata := published(client, sparkplug.DDATA)
+	if len(ddata) != 1 {
+		t.Fatalf("published %d DDATA, want 1", len(ddata))
+	}
+	payload, err := sparkplug.Unmarshal(ddata[0].payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Metrics) != 1 || payload.Metrics[0].Value != uint64(changed.BatterySOC) {
+		t.Fatalf("DDATA metrics = %+v, want only the battery soc", payload.Metrics)
+	}
+
+	// Nothing changed, nothing published.
+	n.Publish(context.Background(), &changed)
+	if len(published(client, sparkplug.DDATA)) != 1 {
+		t.Fatal("published DDATA for an unchanged reading")
+	}
+}
+
+func TestSparkplugDeviceCommand(t *testing.T) {
+	for _, readOnly := range []bool{false, true} {
+		api := &fakeAPI{capacity: 200}
+		n, err := NewSparkplugNode(api, "group", "node", "device", filepath.Join(t.TempDir(), "bdseq"), readOnly, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &fakeClient{connected: true}
+		if err := n.OnConnect(client); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := sparkplug.Payload{Metrics: []sparkplug.Metric{
+			{Name: metricBatteryCapacity, DataType: sparkplug.UInt16, Value: uint64(100)},
+		}}
+		client.deliver(sparkplug.Topic("group", sparkplug.DCMD, "node", "device"), cmd.Marshal())
+
+		want := uint16(100)
+		if readOnly {
+			want = 200
+		}
+		if api.capacity != want {
+			t.Errorf("readOnly %v: capacity = %d, want %d", readOnly, api.capacity, want)
+		}
+	}
+}
+
+func TestSparkplugCallbackDeadlines(t *testing.T) {
+	api := &fakeAPI{reading: Reading{EndTime: time.Now()}}
+	n, err := NewSparkplugNode(api, "group", "node", "device", filepath.Join(t.TempDir(), "bdseq"), false, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{connected: true}
+	if err := n.OnConnect(client); err != nil {
+		t.Fatal(err)
+	}
+
+	rebirth := sparkplug.Payload{Metrics: []sparkplug.Metric{
+		{Name: metricRebirth, DataType: sparkplug.Boolean, Value: true},
+	}}
+	client.deliver(sparkplug.Topic("group", sparkplug.NCMD, "node", ""), rebirth.Marshal())
+
+	cmd := sparkplug.Payload{Metrics: []sparkplug.Metric{
+		{Name: metricBatteryCapacity, DataType: sparkplug.UInt16, Value: uint64(100)},
+	}}
+	client.deliver(sparkplug.Topic("group", sparkplug.DCMD, "node", "device"), cmd.Marshal())
+
+	// Two births of three calls each, and the command.
+	if api.calls != 7 || api.unbounded != 0 {
+		t.Errorf("%d of %d calls had no deadline, want 0 of 7", api.unbounded, api.calls)
+	}
+}
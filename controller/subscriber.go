@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+func NewSubscriber(logger *zap.Logger) *Subscriber {
+	return &Subscriber{
+		logger:   logger,
+		encoding: EncodingJSON,
+	}
+}
+
+// Subscriber consumes readings from TopicReading, decoding them with the
+// encoding the controller advertises on TopicMetadata.
+type Subscriber struct {
+	mu       sync.RWMutex
+	logger   *zap.Logger
+	encoding Encoding
+}
+
+// Subscribe subscribes c to the metadata and reading topics. It should be
+// called from the client's OnConnect handler so the subscriptions survive a
+// reconnect.
+func (s *Subscriber) Subscribe(c mqtt.Client, handler func(context.Context, *Reading)) error {
+	// Metadata is retained, so subscribing to it first means the encoding is
+	// known before the first reading arrives.
+	if token := c.Subscribe(TopicMetadata, 1, s.handleMetadata); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	if token := c.Subscribe(TopicReading, 0, func(c mqtt.Client, msg mqtt.Message) {
+		reading, err := s.Decode(msg.Payload())
+		if err != nil {
+			s.logger.Error("error decoding reading", zap.Error(err))
+			return
+		}
+		handler(context.Background(), reading)
+	}); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+// Decode decodes a reading payload with the encoding last advertised on
+// TopicMetadata, or JSON if none has been.
+func (s *Subscriber) Decode(payload []byte) (*Reading, error) {
+	var reading Reading
+	if err := s.Encoding().UnmarshalReading(payload, &reading); err != nil {
+		return nil, err
+	}
+	return &reading, nil
+}
+
+func (s *Subscriber) Encoding() Encoding {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.encoding
+}
+
+func (s *Subscriber) handleMetadata(c mqtt.Client, msg mqtt.Message) {
+	var md Metadata
+	if err := json.Unmarshal(msg.Payload(), &md); err != nil {
+		s.logger.Error("error unmarshalling metadata", zap.Error(err))
+		return
+	}
+
+	encoding, err := ParseEncoding(string(md.Encoding))
+	if err != nil {
+		s.logger.Error("unsupported reading encoding", zap.Error(err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.encoding != encoding {
+		s.logger.Info("reading encoding changed", zap.String("encoding", string(encoding)))
+	}
+	s.encoding = encoding
+}
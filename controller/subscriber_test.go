@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"encoding/json"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+type payloadMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *payloadMessage) Topic() string   { return m.topic }
+func (m *payloadMessage) Payload() []byte { return m.payload }
+
+func advertise(t *testing.T, s *Subscriber, encoding Encoding) {
+	t.Helper()
+
+	payload, err := json.Marshal(encoding.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handleMetadata(nil, &payloadMessage{payload: payload})
+}
+
+func TestSubscriberFollowsMetadata(t *testing.T) {
+	s := NewSubscriber(zap.NewNop())
+	reading := testReading()
+
+	jsonPayload, _ := EncodingJSON.MarshalReading(reading)
+	protoPayload, _ := EncodingProtobuf.MarshalReading(reading)
+
+	// JSON until told otherwise.
+	if r, err := s.Decode(jsonPayload); err != nil || r.BatterySOC != reading.BatterySOC {
+		t.Fatalf("Decode(json) = %+v, %v", r, err)
+	}
+
+	advertise(t, s, EncodingProtobuf)
+	if s.Encoding() != EncodingProtobuf {
+		t.Fatalf("encoding = %s, want protobuf", s.Encoding())
+	}
+	if r, err := s.Decode(protoPayload); err != nil || r.BatterySOC != reading.BatterySOC {
+		t.Fatalf("Decode(protobuf) = %+v, %v", r, err)
+	}
+
+	// Payloads aren't sniffed, so JSON isn't accepted once protobuf is
+	// advertised.
+	if _, err := s.Decode(jsonPayload); err == nil {
+		t.Fatal("Decode(json) succeeded with protobuf advertised")
+	}
+
+	advertise(t, s, EncodingJSON)
+	if r, err := s.Decode(jsonPayload); err != nil || r.BatterySOC != reading.BatterySOC {
+		t.Fatalf("Decode(json) = %+v, %v", r, err)
+	}
+}
+
+func TestSubscriberIgnoresUnknownEncoding(t *testing.T) {
+	s := NewSubscriber(zap.NewNop())
+	s.handleMetadata(nil, &payloadMessage{payload: []byte(`{"encoding": "avro"}`)})
+
+	if s.Encoding() != EncodingJSON {
+		t.Fatalf("encoding = %s, want json kept", s.Encoding())
+	}
+}
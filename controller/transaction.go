@@ -0,0 +1,371 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrVerificationFailed = errors.New("verification failed")
+	ErrRollbackFailed     = errors.New("rollback failed")
+)
+
+// Address is a register address. It is written as hex in JSON.
+type Address uint16
+
+func (a Address) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("0x%04x", uint16(a))), nil
+}
+
+func (a *Address) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 0, 16)
+	if err != nil {
+		return err
+	}
+	*a = Address(v)
+	return nil
+}
+
+// RegisterChange describes a change made to a run of holding registers or to
+// a coil.
+type RegisterChange struct {
+	Name    string   `json:"name"`
+	Address Address  `json:"address"`
+	Old     []uint16 `json:"old"`
+	New     []uint16 `json:"new"`
+}
+
+const (
+	FunctionWriteSingleCoil        = "writeSingleCoil"
+	FunctionWriteMultipleRegisters = "writeMultipleRegisters"
+)
+
+// HexBytes is written as hex in JSON.
+type HexBytes []byte
+
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = data
+	return nil
+}
+
+// PlannedWrite is a Modbus write a dry run would have made.
+type PlannedWrite struct {
+	Name     string   `json:"name"`
+	Function string   `json:"function"`
+	Address  Address  `json:"address"`
+	Quantity uint16   `json:"quantity"`
+	Data     HexBytes `json:"data"`
+}
+
+// TransactionError is returned when a transaction fails. RolledBack lists the
+// changes that were undone.
+type TransactionError struct {
+	Step       string
+	Err        error
+	RolledBack []RegisterChange
+	Rollback   error
+}
+
+func (e *TransactionError) Error() string {
+	msg := fmt.Sprintf("setting %s: %v", e.Step, e.Err)
+	if e.Rollback != nil {
+		msg += fmt.Sprintf(" (rollback failed: %v)", e.Rollback)
+	} else if len(e.RolledBack) > 0 {
+		msg += fmt.Sprintf(" (rolled back %d changes)", len(e.RolledBack))
+	}
+	return msg
+}
+
+func (e *TransactionError) Unwrap() []error {
+	if e.Rollback != nil {
+		return []error{e.Err, ErrRollbackFailed}
+	}
+	return []error{e.Err}
+}
+
+func (e *TransactionError) ErrorCode() string {
+	var coded interface{ ErrorCode() string }
+	if errors.As(e.Err, &coded) {
+		return coded.ErrorCode()
+	}
+	if errors.Is(e.Err, ErrVerificationFailed) {
+		return "verificationFailed"
+	}
+	return "transactionFailed"
+}
+
+// registerWrite is one step of a transaction.
+type registerWrite struct {
+	name     string
+	address  uint16
+	quantity uint16
+	data     []byte
+
+	// coil writes a single coil at address rather than holding registers.
+	// data is then one register holding 0 or 1.
+	coil bool
+
+	// volatile is set for registers that aren't kept in EEPROM, such as the
+	// real-time clock, so aren't limited by the write guard.
+	volatile bool
+
+	// equal compares the value read back after writing with data. If nil,
+	// the bytes must match exactly.
+	equal func(written, read []byte) bool
+}
+
+// planned describes the Modbus write that makes this step.
+func (w *registerWrite) planned() PlannedWrite {
+	if w.coil {
+		data := []byte{0, 0}
+		if registerValues(w.data)[0] != 0 {
+			data[0] = 0xff
+		}
+		return PlannedWrite{Name: w.name, Function: FunctionWriteSingleCoil, Address: Address(w.address), Quantity: 1, Data: data}
+	}
+	return PlannedWrite{Name: w.name, Function: FunctionWriteMultipleRegisters, Address: Address(w.address), Quantity: w.quantity, Data: w.data}
+}
+
+// registers returns the address of every register the step writes.
+func (w *registerWrite) registers() []uint16 {
+	addresses := make([]uint16, w.quantity)
+	for i := range addresses {
+		addresses[i] = w.address + uint16(i)
+	}
+	return addresses
+}
+
+func (w *registerWrite) matches(read []byte) bool {
+	if w.equal != nil {
+		return w.equal(w.data, read)
+	}
+	return bytes.Equal(w.data, read)
+}
+
+// plan reads the current value of every step and returns the steps that
+// would change their registers, along with the values read. The bus must be
+// held.
+func (s *Service) plan(writes []registerWrite) ([]int, [][]byte, error) {
+	old := make([][]byte, len(writes))
+	var pending []int
+
+	for i := range writes {
+		w := &writes[i]
+		current, err := s.readStep(w)
+		if err != nil {
+			return nil, nil, &TransactionError{Step: w.name, Err: err}
+		}
+		old[i] = current
+
+		if !bytes.Equal(current, w.data) {
+			pending = append(pending, i)
+		}
+	}
+
+	return pending, old, nil
+}
+
+// dryRun returns the changes transaction would make and the writes it would
+// make them with, without writing anything. The write guard isn't consulted.
+// The bus must be held.
+func (s *Service) dryRun(writes []registerWrite) ([]RegisterChange, []PlannedWrite, error) {
+	pending, old, err := s.plan(writes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := []RegisterChange{}
+	planned := []PlannedWrite{}
+	for _, i := range pending {
+		w := &writes[i]
+		changes = append(changes, RegisterChange{
+			Name:    w.name,
+			Address: Address(w.address),
+			Old:     registerValues(old[i]),
+			New:     registerValues(w.data),
+		})
+		planned = append(planned, w.planned())
+	}
+
+	return changes, planned, nil
+}
+
+// transaction applies writes in order, verifying each by reading it back. The
+// registers are snapshotted first, and if any step fails the steps already
+// applied are restored. Steps that wouldn't change their registers are
+// skipped. The bus must be held.
+func (s *Service) transaction(writes []registerWrite) ([]RegisterChange, error) {
+	pending, old, err := s.plan(writes)
+	if err != nil {
+		return nil, err
+	}
+
+	s.guard.suppress(len(writes) - len(pending))
+
+	var addresses []uint16
+	for _, i := range pending {
+		if !writes[i].volatile {
+			addresses = append(addresses, writes[i].registers()...)
+		}
+	}
+
+	// Check every write up front so the guard can't stop a transaction
+	// part way through.
+	if len(addresses) > 0 {
+		if err := s.guard.reserve(addresses, time.Now()); err != nil {
+			return nil, &TransactionError{Step: "write guard", Err: err}
+		}
+	}
+
+	changes := []RegisterChange{}
+	for n, i := range pending {
+		w := &writes[i]
+		if err := s.verifiedWrite(w); err != nil {
+			rolledBack, rollbackErr := s.rollback(writes, old, pending[:n])
+			s.logger.Error("transaction failed",
+				zap.String("step", w.name),
+				zap.Error(err),
+				zap.Int("rolledBack", len(rolledBack)),
+				zap.NamedError("rollbackError", rollbackErr))
+			return nil, &TransactionError{Step: w.name, Err: err, RolledBack: rolledBack, Rollback: rollbackErr}
+		}
+
+		changes = append(changes, RegisterChange{
+			Name:    w.name,
+			Address: Address(w.address),
+			Old:     registerValues(old[i]),
+			New:     registerValues(w.data),
+		})
+	}
+
+	return changes, nil
+}
+
+// rollback restores the registers written by the given steps, most recent
+// first.
+func (s *Service) rollback(writes []registerWrite, old [][]byte, applied []int) ([]RegisterChange, error) {
+	var restored []RegisterChange
+	var errs []error
+
+	for n := len(applied) - 1; n >= 0; n-- {
+		i := applied[n]
+		w := writes[i]
+		restore := registerWrite{name: w.name, address: w.address, quantity: w.quantity, data: old[i], coil: w.coil, volatile: w.volatile, equal: w.equal}
+
+		// Restoring isn't limited by the guard, since refusing would leave
+		// the registers half changed, but it still counts.
+		if !restore.volatile {
+			if err := s.guard.record(restore.registers(), time.Now()); err != nil {
+				s.logger.Error("error saving write counts", zap.Error(err))
+			}
+		}
+
+		if err := s.verifiedWrite(&restore); err != nil {
+			errs = append(errs, fmt.Errorf("restoring %s: %w", w.name, err))
+			continue
+		}
+
+		restored = append(restored, RegisterChange{
+			Name:    w.name,
+			Address: Address(w.address),
+			Old:     registerValues(w.data),
+			New:     registerValues(old[i]),
+		})
+	}
+
+	return restored, errors.Join(errs...)
+}
+
+func (s *Service) verifiedWrite(w *registerWrite) error {
+	if err := s.writeStep(w); err != nil {
+		return err
+	}
+
+	read, err := s.readStep(w)
+	if err != nil {
+		return fmt.Errorf("reading back: %w", err)
+	}
+	if !w.matches(read) {
+		return fmt.Errorf("%w: wrote %v, read back %v", ErrVerificationFailed, registerValues(w.data), registerValues(read))
+	}
+
+	return nil
+}
+
+func (s *Service) readStep(w *registerWrite) ([]byte, error) {
+	if !w.coil {
+		return s.client.ReadHoldingRegisters(w.address, w.quantity)
+	}
+
+	results, err := s.client.ReadCoils(w.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) < 1 {
+		return nil, ErrNotEnoughData
+	}
+	return []byte{0, results[0] & 1}, nil
+}
+
+func (s *Service) writeStep(w *registerWrite) error {
+	if !w.coil {
+		_, err := s.client.WriteMultipleRegisters(w.address, w.quantity, w.data)
+		return err
+	}
+
+	var value uint16
+	if registerValues(w.data)[0] != 0 {
+		value = 0xff00
+	}
+	_, err := s.client.WriteSingleCoil(w.address, value)
+	return err
+}
+
+// splitChanges splits changes to runs of holding registers into a change for
+// each register that differs, named from names by address. Changes to coils
+// and registers missing from names are left as they are.
+func splitChanges(changes []RegisterChange, names map[uint16]string) []RegisterChange {
+	split := []RegisterChange{}
+	for _, c := range changes {
+		if _, ok := names[uint16(c.Address)]; !ok || len(c.Old) != len(c.New) {
+			split = append(split, c)
+			continue
+		}
+		for i := range c.Old {
+			if c.Old[i] == c.New[i] {
+				continue
+			}
+			address := uint16(c.Address) + uint16(i)
+			split = append(split, RegisterChange{
+				Name:    names[address],
+				Address: Address(address),
+				Old:     []uint16{c.Old[i]},
+				New:     []uint16{c.New[i]},
+			})
+		}
+	}
+	return split
+}
+
+func registerValues(data []byte) []uint16 {
+	values := make([]uint16, len(data)/2)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return values
+}
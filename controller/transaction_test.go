@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"go.uber.org/zap"
+)
+
+// fakeModbus is a modbus.Client backed by maps of registers and coils.
+type fakeModbus struct {
+	modbus.Client
+
+	registers map[uint16]uint16
+	coils     map[uint16]bool
+
+	// failWrite makes writes starting at an address fail.
+	failWrite map[uint16]error
+	// writes lists the address and quantity of each write made.
+	writes [][2]uint16
+}
+
+func newFakeModbus() *fakeModbus {
+	return &fakeModbus{
+		registers: make(map[uint16]uint16),
+		coils:     make(map[uint16]bool),
+		failWrite: make(map[uint16]error),
+	}
+}
+
+func (m *fakeModbus) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	data := make([]byte, quantity*2)
+	for i := uint16(0); i < quantity; i++ {
+		binary.BigEndian.PutUint16(data[i*2:], m.registers[address+i])
+	}
+	return data, nil
+}
+
+func (m *fakeModbus) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	if err := m.failWrite[address]; err != nil {
+		return nil, err
+	}
+	m.writes = append(m.writes, [2]uint16{address, quantity})
+	for i := uint16(0); i < quantity; i++ {
+		m.registers[address+i] = binary.BigEndian.Uint16(value[i*2:])
+	}
+	return nil, nil
+}
+
+func (m *fakeModbus) ReadCoils(address, quantity uint16) ([]byte, error) {
+	if m.coils[address] {
+		return []byte{1}, nil
+	}
+	return []byte{0}, nil
+}
+
+func (m *fakeModbus) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	if err := m.failWrite[address]; err != nil {
+		return nil, err
+	}
+	m.writes = append(m.writes, [2]uint16{address, 1})
+	m.coils[address] = value == 0xff00
+	return nil, nil
+}
+
+func newTestService(t *testing.T, client modbus.Client, minInterval time.Duration, dailyBudget int) *Service {
+	t.Helper()
+
+	guard, err := OpenWriteGuard(t.TempDir()+"/write-counts.json", minInterval, dailyBudget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewService(client, guard, nil, zap.NewNop())
+}
+
+func registers(values ...uint16) []byte {
+	data := make([]byte, len(values)*2)
+	for i, v := range values {
+		binary.BigEndian.PutUint16(data[i*2:], v)
+	}
+	return data
+}
+
+func TestTransactionSkipsUnchanged(t *testing.T) {
+	client := newFakeModbus()
+	client.registers[0x9000] = 1
+	s := newTestService(t, client, 0, 10)
+
+	changes, err := s.transaction([]registerWrite{
+		{name: "a", address: 0x9000, quantity: 1, data: registers(1)},
+		{name: "b", address: 0x9001, quantity: 1, data: registers(2)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Name != "b" {
+		t.Fatalf("changes = %+v, want only b", changes)
+	}
+
+	stats := s.guard.Statistics()
+	if stats.WritesToday != 1 || stats.Suppressed != 1 {
+		t.Errorf("writes today = %d, suppressed = %d, want 1 and 1", stats.WritesToday, stats.Suppressed)
+	}
+}
+
+func TestTransactionRollsBack(t *testing.T) {
+	client := newFakeModbus()
+	client.registers[0x9000] = 1
+	client.failWrite[0x9001] = errors.New("timeout")
+	s := newTestService(t, client, 0, 10)
+
+	_, err := s.transaction([]registerWrite{
+		{name: "a", address: 0x9000, quantity: 1, data: registers(5)},
+		{name: "b", address: 0x9001, quantity: 1, data: registers(6)},
+	})
+
+	var txErr *TransactionError
+	if !errors.As(err, &txErr) {
+		t.Fatalf("err = %v, want TransactionError", err)
+	}
+	if txErr.Step != "b" || len(txErr.RolledBack) != 1 || txErr.Rollback != nil {
+		t.Errorf("err = %+v, want b failed and a rolled back", txErr)
+	}
+	if client.registers[0x9000] != 1 {
+		t.Errorf("register 0x9000 = %d, want restored to 1", client.registers[0x9000])
+	}
+
+	// Both writes were counted up front and the restore counts too.
+	if got := s.guard.Statistics().WritesToday; got != 3 {
+		t.Errorf("writes today = %d, want 3", got)
+	}
+}
+
+func TestTransactionRejectedByGuard(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, time.Hour, 10)
+
+	writes := []registerWrite{{name: "a", address: 0x9000, quantity: 1, data: registers(1)}}
+	if _, err := s.transaction(writes); err != nil {
+		t.Fatal(err)
+	}
+
+	writes[0].data = registers(2)
+	if _, err := s.transaction(writes); !errors.Is(err, ErrWriteRejected) {
+		t.Fatalf("err = %v, want ErrWriteRejected", err)
+	}
+	if len(client.writes) != 1 {
+		t.Errorf("made %d writes, want 1", len(client.writes))
+	}
+}
+
+func TestTransactionGuardsEveryRegister(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, time.Hour, 10)
+
+	if _, err := s.transaction([]registerWrite{{name: "block", address: 0x9000, quantity: 3, data: registers(1, 2, 3)}}); err != nil {
+		t.Fatal(err)
+	}
+	stats := s.guard.Statistics()
+	if stats.WritesToday != 3 || stats.Writes["0x9002"] != 1 {
+		t.Errorf("stats = %+v, want each of the 3 registers counted", stats)
+	}
+
+	// A write starting elsewhere that overlaps the block is held to its
+	// interval.
+	_, err := s.transaction([]registerWrite{{name: "overlap", address: 0x9002, quantity: 2, data: registers(4, 5)}})
+	if !errors.Is(err, ErrWriteRejected) {
+		t.Errorf("err = %v, want ErrWriteRejected", err)
+	}
+}
+
+func TestTransactionVolatileNotGuarded(t *testing.T) {
+	client := newFakeModbus()
+	s := newTestService(t, client, time.Hour, 1)
+
+	for i := uint16(1); i <= 3; i++ {
+		writes := []registerWrite{{name: "clock", address: 0x9013, quantity: 1, data: registers(i), volatile: true}}
+		if _, err := s.transaction(writes); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	if got := s.guard.Statistics().WritesToday; got != 0 {
+		t.Errorf("writes today = %d, want 0", got)
+	}
+}
@@ -0,0 +1,205 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrWriteRejected = errors.New("write rejected")
+
+// WriteRejectedError is returned when a write is refused to protect the
+// controller's EEPROM.
+type WriteRejectedError struct {
+	Address uint16
+	Reason  string
+}
+
+func (e *WriteRejectedError) Error() string {
+	return fmt.Sprintf("write to register 0x%04x rejected: %s", e.Address, e.Reason)
+}
+
+func (e *WriteRejectedError) Is(target error) bool {
+	return target == ErrWriteRejected
+}
+
+// ErrorCode identifies the error to callers over the transport.
+func (e *WriteRejectedError) ErrorCode() string {
+	return "writeRejected"
+}
+
+// OpenWriteGuard creates a WriteGuard allowing each register to be written at
+// most once every minInterval, and at most dailyBudget writes in total per
+// UTC day. The counts are kept in path, so restarting doesn't reset them.
+func OpenWriteGuard(path string, minInterval time.Duration, dailyBudget int) (*WriteGuard, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	g := &WriteGuard{
+		path:        path,
+		minInterval: minInterval,
+		dailyBudget: dailyBudget,
+		state: writeGuardState{
+			Last:   make(map[Address]time.Time),
+			Writes: make(map[Address]uint64),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &g.state); err != nil {
+		return nil, fmt.Errorf("invalid write counts in %s: %w", path, err)
+	}
+	if g.state.Last == nil {
+		g.state.Last = make(map[Address]time.Time)
+	}
+	if g.state.Writes == nil {
+		g.state.Writes = make(map[Address]uint64)
+	}
+	return g, nil
+}
+
+// WriteGuard limits how often the controller's settings are written.
+type WriteGuard struct {
+	mu sync.Mutex
+
+	path        string
+	minInterval time.Duration
+	dailyBudget int
+
+	state writeGuardState
+}
+
+// writeGuardState is what's kept in the WriteGuard's file.
+type writeGuardState struct {
+	Day        time.Time             `json:"day"`
+	DayWrites  int                   `json:"dayWrites"`
+	Last       map[Address]time.Time `json:"last"`
+	Writes     map[Address]uint64    `json:"writes"`
+	Suppressed uint64                `json:"suppressed"`
+	Rejected   uint64                `json:"rejected"`
+}
+
+// reserve checks whether all of addresses, every register the writes cover,
+// may be written now and, if so, counts the writes before they're made, so
+// they're remembered even if the controller restarts part way through.
+func (g *WriteGuard) reserve(addresses []uint16, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rollover(now)
+
+	for _, address := range addresses {
+		if g.state.DayWrites+len(addresses) > g.dailyBudget {
+			g.state.Rejected++
+			return &WriteRejectedError{Address: address, Reason: fmt.Sprintf("daily budget of %d writes used", g.dailyBudget)}
+		}
+
+		if last, ok := g.state.Last[Address(address)]; ok && now.Sub(last) < g.minInterval {
+			g.state.Rejected++
+			return &WriteRejectedError{Address: address, Reason: fmt.Sprintf("written less than %s ago", g.minInterval)}
+		}
+	}
+
+	saved := g.state
+	saved.Last = copyMap(g.state.Last)
+	saved.Writes = copyMap(g.state.Writes)
+
+	for _, address := range addresses {
+		g.count(address, now)
+	}
+
+	if err := g.save(); err != nil {
+		// Refuse rather than write without a record of it.
+		g.state = saved
+		return fmt.Errorf("saving write counts: %w", err)
+	}
+	return nil
+}
+
+// record counts a write to addresses that isn't subject to the limits, such
+// as restoring registers after a failed transaction.
+func (g *WriteGuard) record(addresses []uint16, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rollover(now)
+	for _, address := range addresses {
+		g.count(address, now)
+	}
+	return g.save()
+}
+
+// count must be called with g.mu held.
+func (g *WriteGuard) count(address uint16, now time.Time) {
+	g.state.DayWrites++
+	g.state.Last[Address(address)] = now
+	g.state.Writes[Address(address)]++
+}
+
+// suppress counts n writes skipped because they wouldn't change anything.
+func (g *WriteGuard) suppress(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.state.Suppressed += uint64(n)
+}
+
+func (g *WriteGuard) rollover(now time.Time) {
+	day := now.UTC().Truncate(24 * time.Hour)
+	if !day.Equal(g.state.Day) {
+		g.state.Day = day
+		g.state.DayWrites = 0
+	}
+}
+
+// save must be called with g.mu held.
+func (g *WriteGuard) save() error {
+	data, err := json.Marshal(&g.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := g.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, g.path)
+}
+
+func (g *WriteGuard) Statistics() WriteStatistics {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.rollover(time.Now())
+
+	stats := WriteStatistics{
+		Writes:      make(map[string]uint64),
+		WritesToday: g.state.DayWrites,
+		DailyBudget: g.dailyBudget,
+		Suppressed:  g.state.Suppressed,
+		Rejected:    g.state.Rejected,
+	}
+	for address, n := range g.state.Writes {
+		stats.Writes[fmt.Sprintf("0x%04x", uint16(address))] = n
+	}
+	return stats
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteGuardInterval(t *testing.T) {
+	g, err := OpenWriteGuard(t.TempDir()+"/write-counts.json", time.Minute, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := g.reserve([]uint16{0x9000}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.reserve([]uint16{0x9000}, now.Add(30*time.Second)); !errors.Is(err, ErrWriteRejected) {
+		t.Errorf("err = %v, want ErrWriteRejected", err)
+	}
+	if err := g.reserve([]uint16{0x9001}, now.Add(30*time.Second)); err != nil {
+		t.Errorf("other register: %v", err)
+	}
+	if err := g.reserve([]uint16{0x9000}, now.Add(time.Minute)); err != nil {
+		t.Errorf("after interval: %v", err)
+	}
+}
+
+func TestWriteGuardBudget(t *testing.T) {
+	g, err := OpenWriteGuard(t.TempDir()+"/write-counts.json", 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC)
+	if err := g.reserve([]uint16{0x9000, 0x9001}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// All or nothing: two more would exceed the budget, so neither is made.
+	if err := g.reserve([]uint16{0x9002, 0x9003}, now); !errors.Is(err, ErrWriteRejected) {
+		t.Fatalf("err = %v, want ErrWriteRejected", err)
+	}
+	if err := g.reserve([]uint16{0x9002}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The budget is per UTC day.
+	if err := g.reserve([]uint16{0x9003}, now.Add(2*time.Hour)); err != nil {
+		t.Errorf("next day: %v", err)
+	}
+}
+
+func TestWriteGuardPersists(t *testing.T) {
+	path := t.TempDir() + "/write-counts.json"
+	g, err := OpenWriteGuard(path, time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if err := g.reserve([]uint16{0x9000, 0x9001}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.record([]uint16{0x9002}, now); err != nil {
+		t.Fatal(err)
+	}
+	g.suppress(1)
+	if err := g.reserve([]uint16{0x9000}, now); err == nil {
+		t.Fatal("expected rejection")
+	}
+
+	reopened, err := OpenWriteGuard(path, time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Suppressed and rejected counts aren't saved by themselves, only with
+	// the next write.
+	stats := reopened.Statistics()
+	if stats.WritesToday != 3 || stats.Writes["0x9000"] != 1 || stats.Writes["0x9002"] != 1 {
+		t.Errorf("stats = %+v, want 3 writes today", stats)
+	}
+	if err := reopened.reserve([]uint16{0x9000}, now.Add(time.Minute)); !errors.Is(err, ErrWriteRejected) {
+		t.Errorf("err = %v, want the interval to survive reopening", err)
+	}
+}
+
+func TestWriteGuardSaveFailure(t *testing.T) {
+	dir := t.TempDir()
+	g, err := OpenWriteGuard(dir+"/write-counts.json", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory where the temporary file would go makes saving fail.
+	if err := os.Mkdir(dir+"/write-counts.json.tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.reserve([]uint16{0x9000}, time.Now()); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := g.Statistics().WritesToday; got != 0 {
+		t.Errorf("writes today = %d, want the reservation undone", got)
+	}
+}
+
+func TestOpenWriteGuardInvalid(t *testing.T) {
+	path := t.TempDir() + "/write-counts.json"
+	if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWriteGuard(path, 0, 100); err == nil {
+		t.Fatal("expected error")
+	}
+}
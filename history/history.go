@@ -0,0 +1,131 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// InvalidQueryError is returned when a query can't be run as given.
+type InvalidQueryError struct {
+	Reason string
+}
+
+func (e *InvalidQueryError) Error() string {
+	return "invalid query: " + e.Reason
+}
+
+func (e *InvalidQueryError) Is(target error) bool {
+	return target == ErrInvalidQuery
+}
+
+type Bucket string
+
+const (
+	BucketRaw    Bucket = "raw"
+	BucketMinute Bucket = "1m"
+	BucketHour   Bucket = "1h"
+	BucketDay    Bucket = "1d"
+)
+
+type Aggregate string
+
+const (
+	AggregateAvg  Aggregate = "avg"
+	AggregateMin  Aggregate = "min"
+	AggregateMax  Aggregate = "max"
+	AggregateLast Aggregate = "last"
+)
+
+const DefaultLimit = 10000
+const MaxLimit = 100000
+
+// Query selects fields between From and To. Unless Bucket is raw, rows are
+// grouped into buckets and each field reduced with Aggregate.
+type Query struct {
+	From      time.Time
+	To        time.Time
+	Fields    []string
+	Bucket    Bucket
+	Aggregate Aggregate
+	Limit     int
+}
+
+// Result holds one row per reading or bucket, in time order. Values line up
+// with Fields and are nil where there is no data.
+type Result struct {
+	Fields []string `json:"fields"`
+	Rows   []Row    `json:"rows"`
+	// Truncated is set when there were more rows than the limit.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type Row struct {
+	Time   time.Time  `json:"time"`
+	Values []*float64 `json:"values"`
+}
+
+// Store queries stored readings.
+type Store interface {
+	Readings(ctx context.Context, q *Query) (*Result, error)
+	DailyEnergy(ctx context.Context, q *Query) (*Result, error)
+}
+
+// normalize applies defaults to q and checks it against the fields
+// available.
+func (q *Query) normalize(available map[string]string) error {
+	if q.To.IsZero() {
+		q.To = time.Now()
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-24 * time.Hour)
+	}
+	if !q.From.Before(q.To) {
+		return &InvalidQueryError{Reason: "from must be before to"}
+	}
+
+	if len(q.Fields) == 0 {
+		return &InvalidQueryError{Reason: "no fields selected"}
+	}
+	for _, f := range q.Fields {
+		if _, ok := available[f]; !ok {
+			return &InvalidQueryError{Reason: fmt.Sprintf("unknown field %q", f)}
+		}
+	}
+
+	switch q.Bucket {
+	case "":
+		q.Bucket = BucketRaw
+	case BucketRaw, BucketMinute, BucketHour, BucketDay:
+	default:
+		return &InvalidQueryError{Reason: fmt.Sprintf("unknown bucket %q", q.Bucket)}
+	}
+
+	switch q.Aggregate {
+	case "":
+		q.Aggregate = AggregateAvg
+	case AggregateAvg, AggregateMin, AggregateMax, AggregateLast:
+	default:
+		return &InvalidQueryError{Reason: fmt.Sprintf("unknown aggregate %q", q.Aggregate)}
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit > MaxLimit {
+		return &InvalidQueryError{Reason: fmt.Sprintf("limit must be at most %d", MaxLimit)}
+	}
+
+	return nil
+}
+
+// truncate cuts r down to limit rows, marking it if any were cut.
+func (r *Result) truncate(limit int) {
+	if len(r.Rows) > limit {
+		r.Rows = r.Rows[:limit]
+		r.Truncated = true
+	}
+}
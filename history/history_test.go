@@ -0,0 +1,115 @@
+package history
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	available := map[string]string{"batteryVoltage": "battery_voltage"}
+
+	q := &Query{Fields: []string{"batteryVoltage"}}
+	if err := q.normalize(available); err != nil {
+		t.Fatal(err)
+	}
+	if q.Bucket != BucketRaw || q.Aggregate != AggregateAvg || q.Limit != DefaultLimit || q.To.Sub(q.From) != 24*time.Hour {
+		t.Errorf("defaults = %+v", q)
+	}
+
+	// Times are left in the zone they were given in, for the store to
+	// convert.
+	zone := time.FixedZone("test", 3600)
+	from := time.Date(2024, 6, 1, 0, 0, 0, 0, zone)
+	q = &Query{From: from, To: from.Add(time.Hour), Fields: []string{"batteryVoltage"}}
+	if err := q.normalize(available); err != nil {
+		t.Fatal(err)
+	}
+	if q.From.Location() != zone {
+		t.Errorf("from = %s, want it left in its zone", q.From)
+	}
+
+	invalid := []*Query{
+		{Fields: []string{"batteryVoltage"}, From: from, To: from},
+		{},
+		{Fields: []string{"nope"}},
+		{Fields: []string{"batteryVoltage"}, Bucket: "2h"},
+		{Fields: []string{"batteryVoltage"}, Aggregate: "sum"},
+		{Fields: []string{"batteryVoltage"}, Limit: MaxLimit + 1},
+	}
+	for _, q := range invalid {
+		if err := q.normalize(available); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%+v: err = %v, want ErrInvalidQuery", q, err)
+		}
+	}
+}
+
+func TestResultTruncate(t *testing.T) {
+	r := &Result{Rows: make([]Row, 3)}
+	r.truncate(3)
+	if len(r.Rows) != 3 || r.Truncated {
+		t.Errorf("got %d rows, truncated %v, want 3 and false", len(r.Rows), r.Truncated)
+	}
+
+	r.truncate(2)
+	if len(r.Rows) != 2 || !r.Truncated {
+		t.Errorf("got %d rows, truncated %v, want 2 and true", len(r.Rows), r.Truncated)
+	}
+}
+
+func TestBuildQuery(t *testing.T) {
+	tests := []struct {
+		q    Query
+		want []string
+	}{
+		{
+			Query{Fields: []string{"batteryVoltage", "overTemperature"}, Bucket: BucketRaw},
+			[]string{"SELECT time, (battery_voltage)::float8, (over_temperature::int)::float8 FROM readings", "ORDER BY time LIMIT $3"},
+		},
+		{
+			Query{Fields: []string{"batteryVoltage"}, Bucket: BucketHour, Aggregate: AggregateMax},
+			[]string{"date_trunc('hour', time) AS bucket", "(max(battery_voltage))::float8", "GROUP BY bucket"},
+		},
+		{
+			Query{Fields: []string{"batteryVoltage"}, Bucket: BucketDay, Aggregate: AggregateLast},
+			[]string{"(array_agg(battery_voltage ORDER BY time DESC))[1]"},
+		},
+	}
+	for _, tt := range tests {
+		sql := buildQuery("readings", readingColumns, &tt.q)
+		for _, want := range tt.want {
+			if !strings.Contains(sql, want) {
+				t.Errorf("%s\nwant it to contain %s", sql, want)
+			}
+		}
+	}
+}
+
+func TestBuildSQLiteQuery(t *testing.T) {
+	tests := []struct {
+		q    Query
+		want []string
+	}{
+		{
+			Query{Fields: []string{"batteryVoltage", "overTemperature", "duration"}, Bucket: BucketRaw},
+			[]string{"SELECT time, CAST(battery_voltage AS REAL), CAST(over_temperature AS REAL), CAST(read_duration AS REAL) FROM readings", "WHERE time >= ? AND time < ? ORDER BY time LIMIT ?"},
+		},
+		{
+			Query{Fields: []string{"batteryVoltage"}, Bucket: BucketHour, Aggregate: AggregateMax},
+			[]string{"strftime('%Y-%m-%d %H:00:00', time) AS bucket", "CAST(max(battery_voltage) AS REAL)", "GROUP BY bucket ORDER BY bucket LIMIT ?"},
+		},
+		{
+			Query{Fields: []string{"batteryVoltage"}, Bucket: BucketDay, Aggregate: AggregateLast},
+			[]string{"strftime('%Y-%m-%d 00:00:00', time) AS bucket, max(time), CAST(battery_voltage AS REAL)"},
+		},
+	}
+	for _, tt := range tests {
+		sql := buildSQLiteQuery("readings", sqliteReadingColumns, &tt.q)
+		for _, want := range tt.want {
+			if !strings.Contains(sql, want) {
+				t.Errorf("%s\nwant it to contain %s", sql, want)
+			}
+		}
+	}
+}
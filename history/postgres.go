@@ -0,0 +1,159 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// readingColumns maps reading fields, named as in JSON, to the SQL
+// expressions selecting them as numbers. Booleans become 0 or 1 so they can
+// be averaged.
+var readingColumns = map[string]string{
+	"overTemperature":            "over_temperature::int",
+	"day":                        "day::int",
+	"solarVoltage":               "solar_voltage",
+	"solarCurrent":               "solar_current",
+	"solarPower":                 "solar_power",
+	"loadVoltage":                "load_voltage",
+	"loadCurrent":                "load_current",
+	"loadPower":                  "load_power",
+	"batteryTemperature":         "battery_temperature",
+	"deviceTemperature":          "device_temperature",
+	"batterySOC":                 "battery_soc",
+	"batteryRatedVoltage":        "battery_rated_voltage",
+	"maximumBatteryVoltageToday": "maximum_battery_voltage_today",
+	"minimumBatteryVoltageToday": "minimum_battery_voltage_today",
+	"consumedEnergyToday":        "consumed_energy_today",
+	"consumedEnergyMonth":        "consumed_energy_month",
+	"consumedEnergyYear":         "consumed_energy_year",
+	"consumedEnergyTotal":        "consumed_energy_total",
+	"generatedEnergyToday":       "generated_energy_today",
+	"generatedEnergyMonth":       "generated_energy_month",
+	"generatedEnergyYear":        "generated_energy_year",
+	"generatedEnergyTotal":       "generated_energy_total",
+	"batteryVoltage":             "battery_voltage",
+	"batteryCurrent":             "battery_current",
+	"duration":                   "extract(epoch from read_duration) * 1e9",
+}
+
+var dailyEnergyColumns = map[string]string{
+	"generatedEnergy": "generated_energy",
+	"consumedEnergy":  "consumed_energy",
+}
+
+var truncUnits = map[Bucket]string{
+	BucketMinute: "minute",
+	BucketHour:   "hour",
+	BucketDay:    "day",
+}
+
+// ReadingFields lists the fields that can be queried from readings.
+func ReadingFields() []string {
+	return keys(readingColumns)
+}
+
+// DailyEnergyFields lists the fields that can be queried from daily energy.
+func DailyEnergyFields() []string {
+	return keys(dailyEnergyColumns)
+}
+
+func NewPostgresStore(pool *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{pool: pool}
+}
+
+// PostgresStore queries the tables written by tracer-writer.
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+func (s *PostgresStore) Readings(ctx context.Context, q *Query) (*Result, error) {
+	if err := q.normalize(readingColumns); err != nil {
+		return nil, err
+	}
+	return s.query(ctx, "readings", readingColumns, q)
+}
+
+// DailyEnergy queries the daily totals. Rows are already a day apart, so
+// only raw and 1d buckets are accepted.
+func (s *PostgresStore) DailyEnergy(ctx context.Context, q *Query) (*Result, error) {
+	if err := q.normalize(dailyEnergyColumns); err != nil {
+		return nil, err
+	}
+	if q.Bucket != BucketRaw && q.Bucket != BucketDay {
+		return nil, &InvalidQueryError{Reason: "daily energy can only be bucketed by day"}
+	}
+	q.Bucket = BucketRaw
+	return s.query(ctx, "daily_energy", dailyEnergyColumns, q)
+}
+
+// query runs q against table. The time columns hold the UTC wall clock time
+// without a zone, so the range is passed as UTC. One row more than the limit
+// is asked for to tell if the result was truncated.
+func (s *PostgresStore) query(ctx context.Context, table string, columns map[string]string, q *Query) (*Result, error) {
+	rows, err := s.pool.Query(ctx, buildQuery(table, columns, q), q.From.UTC(), q.To.UTC(), q.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &Result{Fields: q.Fields, Rows: []Row{}}
+	for rows.Next() {
+		row := Row{Values: make([]*float64, len(q.Fields))}
+		dest := []any{&row.Time}
+		for i := range row.Values {
+			dest = append(dest, &row.Values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result.truncate(q.Limit)
+	return result, nil
+}
+
+// buildQuery builds the SQL for q. Only column expressions from columns are
+// interpolated; the time range and limit are parameters.
+func buildQuery(table string, columns map[string]string, q *Query) string {
+	var selects []string
+
+	if q.Bucket == BucketRaw {
+		selects = append(selects, "time")
+		for _, f := range q.Fields {
+			selects = append(selects, fmt.Sprintf("(%s)::float8", columns[f]))
+		}
+		return fmt.Sprintf(`SELECT %s FROM %s WHERE time >= $1 AND time < $2 ORDER BY time LIMIT $3`,
+			strings.Join(selects, ", "), table)
+	}
+
+	selects = append(selects, fmt.Sprintf("date_trunc('%s', time) AS bucket", truncUnits[q.Bucket]))
+	for _, f := range q.Fields {
+		selects = append(selects, aggregate(q.Aggregate, columns[f]))
+	}
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE time >= $1 AND time < $2 GROUP BY bucket ORDER BY bucket LIMIT $3`,
+		strings.Join(selects, ", "), table)
+}
+
+func aggregate(agg Aggregate, column string) string {
+	if agg == AggregateLast {
+		return fmt.Sprintf("((array_agg(%s ORDER BY time DESC))[1])::float8", column)
+	}
+	return fmt.Sprintf("(%s(%s))::float8", agg, column)
+}
+
+func keys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
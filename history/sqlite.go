@@ -0,0 +1,126 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/alxyng/tracer/internal/sqlite"
+)
+
+// sqliteReadingColumns are readingColumns for SQLite, which stores booleans
+// as 0 or 1 and the read duration in nanoseconds.
+var sqliteReadingColumns = func() map[string]string {
+	columns := make(map[string]string, len(readingColumns))
+	for f, column := range readingColumns {
+		columns[f] = column
+	}
+	columns["overTemperature"] = "over_temperature"
+	columns["day"] = "day"
+	columns["duration"] = "read_duration"
+	return columns
+}()
+
+// strftimeFormats truncate the stored UTC times, so buckets are UTC, as they
+// are in PostgreSQL.
+var strftimeFormats = map[Bucket]string{
+	BucketMinute: "%Y-%m-%d %H:%M:00",
+	BucketHour:   "%Y-%m-%d %H:00:00",
+	BucketDay:    "%Y-%m-%d 00:00:00",
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// SQLiteStore queries the tables written by tracer-writer to SQLite.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func (s *SQLiteStore) Readings(ctx context.Context, q *Query) (*Result, error) {
+	if err := q.normalize(sqliteReadingColumns); err != nil {
+		return nil, err
+	}
+	return s.query(ctx, "readings", sqliteReadingColumns, q)
+}
+
+// DailyEnergy queries the daily totals. Rows are already a day apart, so
+// only raw and 1d buckets are accepted.
+func (s *SQLiteStore) DailyEnergy(ctx context.Context, q *Query) (*Result, error) {
+	if err := q.normalize(dailyEnergyColumns); err != nil {
+		return nil, err
+	}
+	if q.Bucket != BucketRaw && q.Bucket != BucketDay {
+		return nil, &InvalidQueryError{Reason: "daily energy can only be bucketed by day"}
+	}
+	q.Bucket = BucketRaw
+	return s.query(ctx, "daily_energy", dailyEnergyColumns, q)
+}
+
+func (s *SQLiteStore) query(ctx context.Context, table string, columns map[string]string, q *Query) (*Result, error) {
+	rows, err := s.db.QueryContext(ctx, buildSQLiteQuery(table, columns, q), sqlite.FormatTime(q.From), sqlite.FormatTime(q.To), q.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// The last aggregate selects the time of each bucket's last row too.
+	var lastTime string
+	result := &Result{Fields: q.Fields, Rows: []Row{}}
+	for rows.Next() {
+		var t string
+		row := Row{Values: make([]*float64, len(q.Fields))}
+		dest := []any{&t}
+		if q.Aggregate == AggregateLast && q.Bucket != BucketRaw {
+			dest = append(dest, &lastTime)
+		}
+		for i := range row.Values {
+			dest = append(dest, &row.Values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if row.Time, err = sqlite.ParseTime(t); err != nil {
+			return nil, err
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result.truncate(q.Limit)
+	return result, nil
+}
+
+// buildSQLiteQuery builds the SQL for q, as buildQuery does for PostgreSQL.
+func buildSQLiteQuery(table string, columns map[string]string, q *Query) string {
+	var selects []string
+
+	if q.Bucket == BucketRaw {
+		selects = append(selects, "time")
+		for _, f := range q.Fields {
+			selects = append(selects, fmt.Sprintf("CAST(%s AS REAL)", columns[f]))
+		}
+		return fmt.Sprintf(`SELECT %s FROM %s WHERE time >= ? AND time < ? ORDER BY time LIMIT ?`,
+			strings.Join(selects, ", "), table)
+	}
+
+	selects = append(selects, fmt.Sprintf("strftime('%s', time) AS bucket", strftimeFormats[q.Bucket]))
+	if q.Aggregate == AggregateLast {
+		// With a single max aggregate, SQLite takes the other columns from
+		// the row with the maximum.
+		selects = append(selects, "max(time)")
+		for _, f := range q.Fields {
+			selects = append(selects, fmt.Sprintf("CAST(%s AS REAL)", columns[f]))
+		}
+	} else {
+		for _, f := range q.Fields {
+			selects = append(selects, fmt.Sprintf("CAST(%s(%s) AS REAL)", q.Aggregate, columns[f]))
+		}
+	}
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE time >= ? AND time < ? GROUP BY bucket ORDER BY bucket LIMIT ?`,
+		strings.Join(selects, ", "), table)
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriterTimescale(t *testing.T) {
+	cfg, err := Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Writer.Timescale || cfg.Writer.CompressAfter != defaultWriterCompressAfter || cfg.Writer.Retention != 0 {
+		t.Errorf("defaults = %t %s %s", cfg.Writer.Timescale, cfg.Writer.CompressAfter, cfg.Writer.Retention)
+	}
+
+	t.Setenv("TRACER_WRITER_TIMESCALE", "true")
+	t.Setenv("TRACER_WRITER_COMPRESS_AFTER", "0")
+	t.Setenv("TRACER_WRITER_RETENTION", "720h")
+	cfg, err = Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Writer.Timescale || cfg.Writer.CompressAfter != 0 || cfg.Writer.Retention != 30*24*time.Hour {
+		t.Errorf("got %t %s %s", cfg.Writer.Timescale, cfg.Writer.CompressAfter, cfg.Writer.Retention)
+	}
+
+	for name, value := range map[string]string{
+		"TRACER_WRITER_TIMESCALE":      "maybe",
+		"TRACER_WRITER_COMPRESS_AFTER": "-1h",
+		"TRACER_WRITER_RETENTION":      "24h",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := Get(); err == nil {
+				t.Errorf("%s=%s accepted", name, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+// Package metrics exposes counters, gauges and histograms in the OpenMetrics
+// text format for Prometheus to scrape.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// DefaultBuckets are histogram bounds, in seconds, suited to request
+// latencies.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+
+	// fn, if set, is called for the family's only value when scraped.
+	fn func() float64
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Registry holds metric families and serves them over HTTP.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func (r *Registry) add(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.families {
+		if existing.name == f.name {
+			panic("metrics: duplicate metric " + f.name)
+		}
+	}
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	return f
+}
+
+// Counter registers a counter. name is given without the _total suffix.
+func (r *Registry) Counter(name, help string, labels ...string) *Vec {
+	return &Vec{r.add(&family{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+// Gauge registers a gauge.
+func (r *Registry) Gauge(name, help string, labels ...string) *Vec {
+	return &Vec{r.add(&family{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+// Histogram registers a histogram with the given upper bounds.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.add(&family{name: name, help: help, kind: kindHistogram, labels: labels, buckets: buckets})}
+}
+
+// CounterFunc registers a counter whose value is read from f when scraped.
+func (r *Registry) CounterFunc(name, help string, f func() float64) {
+	r.add(&family{name: name, help: help, kind: kindCounter, fn: f})
+}
+
+// GaugeFunc registers a gauge whose value is read from f when scraped.
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.add(&family{name: name, help: help, kind: kindGauge, fn: f})
+}
+
+// Vec is a counter or gauge family with one value per combination of label
+// values.
+type Vec struct {
+	f *family
+}
+
+// With returns the value for labelValues, given in the order the labels were
+// registered.
+func (v *Vec) With(labelValues ...string) *Value {
+	return &Value{f: v.f, s: v.f.get(labelValues)}
+}
+
+type Value struct {
+	f *family
+	s *series
+}
+
+func (v *Value) Set(value float64) {
+	v.f.mu.Lock()
+	v.s.value = value
+	v.f.mu.Unlock()
+}
+
+func (v *Value) Add(delta float64) {
+	v.f.mu.Lock()
+	v.s.value += delta
+	v.f.mu.Unlock()
+}
+
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{f: v.f, s: v.f.get(labelValues)}
+}
+
+type Histogram struct {
+	f *family
+	s *series
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	h.s.count++
+	h.s.sum += value
+	for i, le := range h.f.buckets {
+		if value <= le {
+			h.s.counts[i]++
+		}
+	}
+}
+
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	bw := bufio.NewWriter(w)
+	r.Write(bw)
+	bw.Flush()
+}
+
+// Write writes every metric in the OpenMetrics text format.
+func (r *Registry) Write(w *bufio.Writer) {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	for _, f := range families {
+		f.write(w)
+	}
+	w.WriteString("# EOF\n")
+}
+
+func (f *family) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	if f.help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	}
+
+	suffix := ""
+	if f.kind == kindCounter {
+		suffix = "_total"
+	}
+
+	if f.fn != nil {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, suffix, formatFloat(f.fn()))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := f.series[k]
+		if f.kind != kindHistogram {
+			fmt.Fprintf(w, "%s%s%s %s\n", f.name, suffix, f.labelString(s, ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, le := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelString(s, formatFloat(le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelString(s, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelString(s, ""), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelString(s, ""), formatFloat(s.sum))
+	}
+}
+
+// labelString formats the labels of s, adding le for histogram buckets.
+func (f *family) labelString(s *series, le string) string {
+	var pairs []string
+	for i, name := range f.labels {
+		pairs = append(pairs, name+`="`+escapeLabel(s.labelValues[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return escaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return escaper.Replace(s)
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("test_requests", "Requests made", "method")
+	temperature := r.Gauge("test_temperature_celsius", `Temperature "inside"`)
+	duration := r.Histogram("test_duration_seconds", "", []float64{0.1, 1}, "method")
+	r.GaugeFunc("test_in_flight", "", func() float64 { return 3 })
+
+	requests.With("get").Inc()
+	requests.With("get").Add(2)
+	requests.With("set\n\"x\"").Inc()
+	temperature.With().Set(21.5)
+	duration.With("get").Observe(0.05)
+	duration.With("get").Observe(0.5)
+	duration.With("get").Observe(5)
+
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	r.Write(w)
+	w.Flush()
+
+	want := `# TYPE test_requests counter
+# HELP test_requests Requests made
+test_requests_total{method="get"} 3
+test_requests_total{method="set\n\"x\""} 1
+# TYPE test_temperature_celsius gauge
+# HELP test_temperature_celsius Temperature \"inside\"
+test_temperature_celsius 21.5
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{method="get",le="0.1"} 1
+test_duration_seconds_bucket{method="get",le="1"} 2
+test_duration_seconds_bucket{method="get",le="+Inf"} 3
+test_duration_seconds_count{method="get"} 3
+test_duration_seconds_sum{method="get"} 5.55
+# TYPE test_in_flight gauge
+test_in_flight 3
+# EOF
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_requests", "").With().Inc()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "test_requests_total 1\n") {
+		t.Errorf("body = %s", rec.Body)
+	}
+}
+
+func TestPanics(t *testing.T) {
+	r := NewRegistry()
+	v := r.Counter("test_requests", "", "method")
+
+	for name, f := range map[string]func(){
+		"duplicate":   func() { r.Gauge("test_requests", "") },
+		"label count": func() { v.With("get", "extra") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("didn't panic")
+				}
+			}()
+			f()
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package modbus
+
+import (
+	"time"
+
+	"github.com/alxyng/tracer/internal/metrics"
+	"github.com/goburrow/modbus"
+)
+
+// Instrument wraps client to record the latency and errors of every
+// transaction, labelled with the function and the register group addressed.
+func Instrument(client modbus.Client, registry *metrics.Registry) modbus.Client {
+	return &instrumentedClient{
+		client: client,
+		duration: registry.Histogram("tracer_modbus_request_duration_seconds",
+			"Time taken by Modbus transactions", metrics.DefaultBuckets, "function", "group"),
+		errors: registry.Counter("tracer_modbus_errors",
+			"Modbus transactions that failed", "function", "group"),
+	}
+}
+
+type instrumentedClient struct {
+	client   modbus.Client
+	duration *metrics.HistogramVec
+	errors   *metrics.Vec
+}
+
+// group names the block of the Tracer's register map address is in.
+func group(table string, address uint16) string {
+	switch {
+	case table == "coil":
+		return "switches"
+	case table == "discrete":
+		return "status"
+	case address >= 0x9000:
+		return "settings"
+	case address >= 0x3300:
+		return "statistics"
+	case address >= 0x3200:
+		return "status"
+	case address >= 0x3100:
+		return "realTime"
+	case address >= 0x3000:
+		return "ratedData"
+	}
+	return "other"
+}
+
+func (c *instrumentedClient) observe(function, table string, address uint16, f func() ([]byte, error)) ([]byte, error) {
+	g := group(table, address)
+
+	start := time.Now()
+	results, err := f()
+	c.duration.With(function, g).Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.errors.With(function, g).Inc()
+	}
+	return results, err
+}
+
+func (c *instrumentedClient) ReadCoils(address, quantity uint16) ([]byte, error) {
+	return c.observe("readCoils", "coil", address, func() ([]byte, error) {
+		return c.client.ReadCoils(address, quantity)
+	})
+}
+
+func (c *instrumentedClient) ReadDiscreteInputs(address, quantity uint16) ([]byte, error) {
+	return c.observe("readDiscreteInputs", "discrete", address, func() ([]byte, error) {
+		return c.client.ReadDiscreteInputs(address, quantity)
+	})
+}
+
+func (c *instrumentedClient) WriteSingleCoil(address, value uint16) ([]byte, error) {
+	return c.observe("writeSingleCoil", "coil", address, func() ([]byte, error) {
+		return c.client.WriteSingleCoil(address, value)
+	})
+}
+
+func (c *instrumentedClient) WriteMultipleCoils(address, quantity uint16, value []byte) ([]byte, error) {
+	return c.observe("writeMultipleCoils", "coil", address, func() ([]byte, error) {
+		return c.client.WriteMultipleCoils(address, quantity, value)
+	})
+}
+
+func (c *instrumentedClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return c.observe("readInputRegisters", "register", address, func() ([]byte, error) {
+		return c.client.ReadInputRegisters(address, quantity)
+	})
+}
+
+func (c *instrumentedClient) ReadHoldingRegisters(address, quantity uint16) ([]byte, error) {
+	return c.observe("readHoldingRegisters", "register", address, func() ([]byte, error) {
+		return c.client.ReadHoldingRegisters(address, quantity)
+	})
+}
+
+func (c *instrumentedClient) WriteSingleRegister(address, value uint16) ([]byte, error) {
+	return c.observe("writeSingleRegister", "register", address, func() ([]byte, error) {
+		return c.client.WriteSingleRegister(address, value)
+	})
+}
+
+func (c *instrumentedClient) WriteMultipleRegisters(address, quantity uint16, value []byte) ([]byte, error) {
+	return c.observe("writeMultipleRegisters", "register", address, func() ([]byte, error) {
+		return c.client.WriteMultipleRegisters(address, quantity, value)
+	})
+}
+
+func (c *instrumentedClient) ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity uint16, value []byte) ([]byte, error) {
+	return c.observe("readWriteMultipleRegisters", "register", writeAddress, func() ([]byte, error) {
+		return c.client.ReadWriteMultipleRegisters(readAddress, readQuantity, writeAddress, writeQuantity, value)
+	})
+}
+
+func (c *instrumentedClient) MaskWriteRegister(address, andMask, orMask uint16) ([]byte, error) {
+	return c.observe("maskWriteRegister", "register", address, func() ([]byte, error) {
+		return c.client.MaskWriteRegister(address, andMask, orMask)
+	})
+}
+
+func (c *instrumentedClient) ReadFIFOQueue(address uint16) ([]byte, error) {
+	return c.observe("readFIFOQueue", "register", address, func() ([]byte, error) {
+		return c.client.ReadFIFOQueue(address)
+	})
+}
@@ -0,0 +1,74 @@
+package modbus
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alxyng/tracer/internal/metrics"
+	"github.com/goburrow/modbus"
+)
+
+type failingClient struct {
+	modbus.Client
+	err error
+}
+
+func (c *failingClient) ReadInputRegisters(address, quantity uint16) ([]byte, error) {
+	return make([]byte, quantity*2), c.err
+}
+
+func TestInstrument(t *testing.T) {
+	registry := metrics.NewRegistry()
+	inner := &failingClient{}
+	client := Instrument(inner, registry)
+
+	if _, err := client.ReadInputRegisters(0x3100, 2); err != nil {
+		t.Fatal(err)
+	}
+	inner.err = errors.New("timeout")
+	if _, err := client.ReadInputRegisters(0x3300, 2); err != inner.err {
+		t.Fatalf("err = %v, want the client's error", err)
+	}
+
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	registry.Write(w)
+	w.Flush()
+
+	for _, line := range []string{
+		`tracer_modbus_request_duration_seconds_count{function="readInputRegisters",group="realTime"} 1`,
+		`tracer_modbus_request_duration_seconds_count{function="readInputRegisters",group="statistics"} 1`,
+		`tracer_modbus_errors_total{function="readInputRegisters",group="statistics"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, b.String())
+		}
+	}
+	if strings.Contains(b.String(), `tracer_modbus_errors_total{function="readInputRegisters",group="realTime"}`) {
+		t.Error("counted an error for a successful read")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	tests := []struct {
+		table   string
+		address uint16
+		want    string
+	}{
+		{"coil", 0x0002, "switches"},
+		{"discrete", 0x2000, "status"},
+		{"register", 0x3000, "ratedData"},
+		{"register", 0x3110, "realTime"},
+		{"register", 0x3201, "status"},
+		{"register", 0x3302, "statistics"},
+		{"register", 0x9013, "settings"},
+		{"register", 0x0001, "other"},
+	}
+	for _, tt := range tests {
+		if got := group(tt.table, tt.address); got != tt.want {
+			t.Errorf("group(%s, 0x%04x) = %s, want %s", tt.table, tt.address, got, tt.want)
+		}
+	}
+}
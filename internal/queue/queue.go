@@ -0,0 +1,475 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrEmpty    = errors.New("queue is empty")
+	ErrTooLarge = errors.New("record too large")
+)
+
+const defaultSegmentSize = 4 << 20
+const recordHeaderSize = 8
+const segmentExt = ".seg"
+const cursorFilename = "cursor"
+
+// cursorSyncInterval is the number of pops between cursor writes. Keeping it
+// above one spares the SD card at the cost of replaying up to this many
+// records after a crash.
+const cursorSyncInterval = 64
+
+type segment struct {
+	id      uint64
+	size    int64
+	records int
+}
+
+// Queue is a bounded FIFO of byte records persisted to a directory of segment
+// files. When the total size exceeds the limit, the oldest segment is
+// discarded to make room. It is safe for concurrent use.
+type Queue struct {
+	mu sync.Mutex
+
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+
+	segments []*segment
+	size     int64
+	length   int
+
+	writer *os.File
+
+	reader     *os.File
+	readerID   uint64
+	readOffset int64
+	headPopped int
+	peekedSize int64
+	unsynced   int
+	dropped    uint64
+}
+
+func Open(dir string, maxBytes int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segmentSize := int64(defaultSegmentSize)
+	if maxBytes/4 < segmentSize {
+		segmentSize = maxBytes / 4
+	}
+	if segmentSize < recordHeaderSize {
+		return nil, fmt.Errorf("queue size %d is too small", maxBytes)
+	}
+
+	q := &Queue{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: segmentSize,
+	}
+
+	if err := q.load(); err != nil {
+		q.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Push appends a record to the tail of the queue.
+func (q *Queue) Push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := int64(len(data)) + recordHeaderSize
+	if n > q.segmentSize {
+		return ErrTooLarge
+	}
+
+	tail := q.segments[len(q.segments)-1]
+	if tail.size+n > q.segmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+		tail = q.segments[len(q.segments)-1]
+	}
+
+	buf := make([]byte, n)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[recordHeaderSize:], data)
+
+	if _, err := q.writer.Write(buf); err != nil {
+		return err
+	}
+
+	tail.size += n
+	tail.records++
+	q.size += n
+	q.length++
+
+	for q.size > q.maxBytes && len(q.segments) > 1 {
+		if err := q.dropHead(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Peek returns the record at the head of the queue without removing it. It
+// returns ErrEmpty if there is nothing queued.
+func (q *Queue) Peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.length == 0 {
+			return nil, ErrEmpty
+		}
+
+		head := q.segments[0]
+		if q.headPopped >= head.records {
+			if err := q.dropHead(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if q.reader == nil || q.readerID != head.id {
+			if err := q.openReader(head.id); err != nil {
+				return nil, err
+			}
+		}
+
+		data, err := readRecord(q.reader, q.readOffset, q.segmentSize)
+		if err != nil {
+			// The rest of the segment is unreadable, so skip past it.
+			if err := q.dropHead(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		q.peekedSize = int64(len(data)) + recordHeaderSize
+		return data, nil
+	}
+}
+
+// Pop removes the record most recently returned by Peek.
+func (q *Queue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.peekedSize == 0 {
+		return ErrEmpty
+	}
+
+	q.readOffset += q.peekedSize
+	q.peekedSize = 0
+	q.headPopped++
+	q.length--
+
+	q.unsynced++
+	if q.unsynced >= cursorSyncInterval {
+		return q.writeCursor()
+	}
+	return nil
+}
+
+// Len returns the number of records waiting in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.length
+}
+
+// Size returns the number of bytes the queue occupies on disk.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size
+}
+
+// Dropped returns the number of records discarded to stay within the size
+// limit or because they could not be read back.
+func (q *Queue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.dropped
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var errs []error
+	if q.reader != nil {
+		errs = append(errs, q.reader.Close())
+		q.reader = nil
+	}
+	if q.writer != nil {
+		errs = append(errs, q.writer.Sync(), q.writer.Close())
+		q.writer = nil
+	}
+	if len(q.segments) > 0 {
+		errs = append(errs, q.writeCursor())
+	}
+	return errors.Join(errs...)
+}
+
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	cursorID, cursorOffset, err := q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if id < cursorID {
+			if err := os.Remove(q.segmentPath(id)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		seg, err := q.scanSegment(id)
+		if err != nil {
+			return err
+		}
+		q.segments = append(q.segments, seg)
+		q.size += seg.size
+		q.length += seg.records
+	}
+
+	if len(q.segments) == 0 {
+		next := cursorID
+		if next == 0 {
+			next = 1
+		}
+		q.segments = append(q.segments, &segment{id: next})
+		cursorOffset = 0
+	}
+
+	if head := q.segments[0]; head.id == cursorID && cursorOffset > 0 {
+		popped, offset, err := q.skipRecords(head.id, cursorOffset)
+		if err != nil {
+			return err
+		}
+		q.readOffset = offset
+		q.headPopped = popped
+		q.length -= popped
+	}
+
+	tail := q.segments[len(q.segments)-1]
+	q.writer, err = os.OpenFile(q.segmentPath(tail.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// scanSegment counts the valid records in a segment, truncating any partial
+// record left behind by a crash.
+func (q *Queue) scanSegment(id uint64) (*segment, error) {
+	path := q.segmentPath(id)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seg := &segment{id: id}
+	for {
+		data, err := readRecord(f, seg.size, q.segmentSize)
+		if err != nil {
+			break
+		}
+		seg.size += int64(len(data)) + recordHeaderSize
+		seg.records++
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != seg.size {
+		if err := os.Truncate(path, seg.size); err != nil {
+			return nil, err
+		}
+	}
+
+	return seg, nil
+}
+
+func (q *Queue) roll() error {
+	if err := q.writer.Close(); err != nil {
+		return err
+	}
+
+	id := q.segments[len(q.segments)-1].id + 1
+	f, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	q.writer = f
+	q.segments = append(q.segments, &segment{id: id})
+	return nil
+}
+
+// dropHead removes the oldest segment, discarding any records in it that have
+// not been popped. The tail segment is truncated rather than removed.
+func (q *Queue) dropHead() error {
+	head := q.segments[0]
+	remaining := head.records - q.headPopped
+
+	q.length -= remaining
+	q.dropped += uint64(remaining)
+	q.size -= head.size
+	q.readOffset = 0
+	q.headPopped = 0
+	q.peekedSize = 0
+
+	if q.reader != nil && q.readerID == head.id {
+		q.reader.Close()
+		q.reader = nil
+	}
+
+	if len(q.segments) == 1 {
+		if err := q.writer.Truncate(0); err != nil {
+			return err
+		}
+		head.size = 0
+		head.records = 0
+		return q.writeCursor()
+	}
+
+	q.segments = q.segments[1:]
+	if err := os.Remove(q.segmentPath(head.id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return q.writeCursor()
+}
+
+func (q *Queue) openReader(id uint64) error {
+	if q.reader != nil {
+		q.reader.Close()
+	}
+
+	f, err := os.Open(q.segmentPath(id))
+	if err != nil {
+		return err
+	}
+
+	q.reader = f
+	q.readerID = id
+	return nil
+}
+
+func (q *Queue) readCursor() (uint64, int64, error) {
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFilename))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) != 16 {
+		return 0, 0, nil
+	}
+	return binary.BigEndian.Uint64(data[0:8]), int64(binary.BigEndian.Uint64(data[8:16])), nil
+}
+
+func (q *Queue) writeCursor() error {
+	q.unsynced = 0
+
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data[0:8], q.segments[0].id)
+	binary.BigEndian.PutUint64(data[8:16], uint64(q.readOffset))
+
+	path := filepath.Join(q.dir, cursorFilename)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func readRecord(r io.ReaderAt, offset int64, maxSize int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+
+	n := int64(binary.BigEndian.Uint32(header[0:4]))
+	if n+recordHeaderSize > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	data := make([]byte, n)
+	if _, err := r.ReadAt(data, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	return data, nil
+}
+
+// skipRecords counts the records in a segment that lie before the cursor
+// offset, returning the offset of the first record after them.
+func (q *Queue) skipRecords(id uint64, limit int64) (int, int64, error) {
+	f, err := os.Open(q.segmentPath(id))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+	var n int
+	for offset < limit {
+		data, err := readRecord(f, offset, q.segmentSize)
+		if err != nil {
+			break
+		}
+		offset += int64(len(data)) + recordHeaderSize
+		n++
+	}
+	return n, offset, nil
+}
@@ -0,0 +1,226 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func pushAll(t *testing.T, q *Queue, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		if err := q.Push([]byte(r)); err != nil {
+			t.Fatalf("Push(%q): %v", r, err)
+		}
+	}
+}
+
+func popAll(t *testing.T, q *Queue) []string {
+	t.Helper()
+	var records []string
+	for {
+		data, err := q.Peek()
+		if errors.Is(err, ErrEmpty) {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("Peek: %v", err)
+		}
+		if err := q.Pop(); err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+		records = append(records, string(data))
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q, err := Open(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	pushAll(t, q, "a", "b", "c")
+	if n := q.Len(); n != 3 {
+		t.Fatalf("Len() = %d, want 3", n)
+	}
+
+	// Peek doesn't remove.
+	for i := 0; i < 2; i++ {
+		data, err := q.Peek()
+		if err != nil || string(data) != "a" {
+			t.Fatalf("Peek() = %q, %v, want a", data, err)
+		}
+	}
+
+	if got := fmt.Sprint(popAll(t, q)); got != "[a b c]" {
+		t.Fatalf("popped %s, want [a b c]", got)
+	}
+	if err := q.Pop(); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("Pop() on empty queue = %v, want ErrEmpty", err)
+	}
+}
+
+func TestQueueReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushAll(t, q, "a", "b", "c")
+	if _, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	pushAll(t, q, "d")
+	if got := fmt.Sprint(popAll(t, q)); got != "[b c d]" {
+		t.Fatalf("popped %s after reopening, want [b c d]", got)
+	}
+}
+
+func TestQueueCrashReplaysUnsyncedPops(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushAll(t, q, "a", "b", "c")
+	if _, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash: the cursor isn't written, so the pop is forgotten.
+	q.writer.Close()
+	q.reader.Close()
+
+	q, err = Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if got := fmt.Sprint(popAll(t, q)); got != "[a b c]" {
+		t.Fatalf("popped %s after a crash, want [a b c]", got)
+	}
+}
+
+func TestQueueTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushAll(t, q, "a", "b")
+	path := q.segmentPath(q.segments[0].id)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Half of a third record, as left by a crash mid-write.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	q, err = Open(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	pushAll(t, q, "c")
+	if got := fmt.Sprint(popAll(t, q)); got != "[a b c]" {
+		t.Fatalf("popped %s, want [a b c]", got)
+	}
+}
+
+func TestQueueDropsOldestWhenFull(t *testing.T) {
+	// Segments are a quarter of the limit, so each holds 4 records of 24
+	// bytes and the queue keeps at most 16.
+	q, err := Open(t.TempDir(), 4*4*24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := 0; i < 20; i++ {
+		pushAll(t, q, fmt.Sprintf("record-%08d", i))
+	}
+
+	records := popAll(t, q)
+	if q.Dropped() == 0 {
+		t.Fatal("Dropped() = 0, want the oldest records dropped")
+	}
+	if uint64(len(records))+q.Dropped() != 20 {
+		t.Fatalf("got %d records and %d dropped, want 20 in total", len(records), q.Dropped())
+	}
+	if last := records[len(records)-1]; last != "record-00000019" {
+		t.Fatalf("last record = %s, want the newest", last)
+	}
+	if first := records[0]; first == "record-00000000" {
+		t.Fatal("oldest record wasn't dropped")
+	}
+}
+
+func TestQueueTooLarge(t *testing.T) {
+	q, err := Open(t.TempDir(), 4*64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if err := q.Push(make([]byte, 64)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Push() = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestQueueRemovesPoppedSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := Open(dir, 4*4*24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		pushAll(t, q, fmt.Sprintf("record-%08d", i))
+	}
+	popAll(t, q)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = Open(dir, 4*4*24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if n := q.Len(); n != 0 {
+		t.Fatalf("Len() = %d after reopening a drained queue, want 0", n)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segments) > 1 {
+		t.Fatalf("%d segments left behind, want 1", len(segments))
+	}
+}
@@ -0,0 +1,272 @@
+package sparkplug
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Namespace is the first element of every Sparkplug B topic.
+const Namespace = "spBv1.0"
+
+type MessageType string
+
+const (
+	NBIRTH MessageType = "NBIRTH"
+	NDEATH MessageType = "NDEATH"
+	DBIRTH MessageType = "DBIRTH"
+	DDEATH MessageType = "DDEATH"
+	NDATA  MessageType = "NDATA"
+	DDATA  MessageType = "DDATA"
+	NCMD   MessageType = "NCMD"
+	DCMD   MessageType = "DCMD"
+)
+
+// Topic returns the topic for a message from an edge node, or from one of its
+// devices if deviceID is not empty.
+func Topic(groupID string, typ MessageType, edgeNodeID, deviceID string) string {
+	topic := Namespace + "/" + groupID + "/" + string(typ) + "/" + edgeNodeID
+	if deviceID != "" {
+		topic += "/" + deviceID
+	}
+	return topic
+}
+
+type DataType uint32
+
+const (
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+	Text     DataType = 14
+)
+
+var ErrMalformedPayload = errors.New("malformed sparkplug payload")
+
+// Metric is a single Sparkplug B metric. Value holds a bool, float32,
+// float64, string, uint64 or time.Time depending on DataType. Metrics decoded
+// from a payload hold integers as uint64 regardless of DataType.
+type Metric struct {
+	Name      string
+	Alias     uint64
+	Timestamp time.Time
+	DataType  DataType
+	IsNull    bool
+	Value     any
+}
+
+// Payload is a Sparkplug B payload. Seq is omitted from NDEATH payloads.
+type Payload struct {
+	Timestamp time.Time
+	Metrics   []Metric
+	Seq       *uint64
+}
+
+func (p *Payload) Marshal() []byte {
+	var b []byte
+
+	if !p.Timestamp.IsZero() {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(p.Timestamp.UnixMilli()))
+	}
+
+	for i := range p.Metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Metrics[i].marshal())
+	}
+
+	if p.Seq != nil {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, *p.Seq)
+	}
+
+	return b
+}
+
+func (m *Metric) marshal() []byte {
+	var b []byte
+
+	if m.Name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.Alias != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.Alias)
+	}
+	if !m.Timestamp.IsZero() {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Timestamp.UnixMilli()))
+	}
+	if m.DataType != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.DataType))
+	}
+	if m.IsNull || m.Value == nil {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+		return b
+	}
+
+	switch v := m.Value.(type) {
+	case bool:
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case float32:
+		b = protowire.AppendTag(b, 12, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(v))
+	case float64:
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case string:
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case time.Time:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v.UnixMilli()))
+	case uint64:
+		switch m.DataType {
+		case Int64, UInt64, DateTime:
+			b = protowire.AppendTag(b, 11, protowire.VarintType)
+		default:
+			b = protowire.AppendTag(b, 10, protowire.VarintType)
+		}
+		b = protowire.AppendVarint(b, v)
+	}
+
+	return b
+}
+
+func Unmarshal(b []byte) (*Payload, error) {
+	var p Payload
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, ErrMalformedPayload
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			p.Timestamp = time.UnixMilli(int64(v)).UTC()
+			b = b[n:]
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			m, err := unmarshalMetric(v)
+			if err != nil {
+				return nil, err
+			}
+			p.Metrics = append(p.Metrics, *m)
+			b = b[n:]
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			p.Seq = &v
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			b = b[n:]
+		}
+	}
+
+	return &p, nil
+}
+
+func unmarshalMetric(b []byte) (*Metric, error) {
+	var m Metric
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, ErrMalformedPayload
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			b = b[n:]
+
+			switch num {
+			case 2:
+				m.Alias = v
+			case 3:
+				m.Timestamp = time.UnixMilli(int64(v)).UTC()
+			case 4:
+				m.DataType = DataType(v)
+			case 7:
+				m.IsNull = v != 0
+			case 10, 11:
+				m.Value = v
+			case 14:
+				m.Value = v != 0
+			}
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			b = b[n:]
+			if num == 12 {
+				m.Value = math.Float32frombits(v)
+			}
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			b = b[n:]
+			if num == 13 {
+				m.Value = math.Float64frombits(v)
+			}
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			b = b[n:]
+			switch num {
+			case 1:
+				m.Name = string(v)
+			case 15:
+				m.Value = string(v)
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, ErrMalformedPayload
+			}
+			b = b[n:]
+		}
+	}
+
+	return &m, nil
+}
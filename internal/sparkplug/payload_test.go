@@ -0,0 +1,65 @@
+package sparkplug
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	now := time.UnixMilli(1700000000123).UTC()
+	seq := uint64(7)
+	p := &Payload{
+		Timestamp: now,
+		Seq:       &seq,
+		Metrics: []Metric{
+			{Name: "bdSeq", DataType: UInt64, Value: uint64(3)},
+			{Alias: 2, Timestamp: now, DataType: Boolean, Value: true},
+			{Alias: 3, DataType: Float, Value: float32(12.5)},
+			{Alias: 4, DataType: Double, Value: float64(-1.25)},
+			{Alias: 5, DataType: String, Value: "hello"},
+			{Alias: 6, DataType: UInt16, Value: uint64(100)},
+			{Alias: 7, DataType: DateTime, IsNull: true},
+		},
+	}
+
+	got, err := Unmarshal(p.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Fatalf("round trip = %+v, want %+v", got, p)
+	}
+}
+
+func TestPayloadTimeValue(t *testing.T) {
+	now := time.UnixMilli(1700000000123).UTC()
+	p := &Payload{Metrics: []Metric{{Alias: 1, DataType: DateTime, Value: now}}}
+
+	got, err := Unmarshal(p.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Times are decoded as milliseconds, like other integers.
+	if v := got.Metrics[0].Value; v != uint64(now.UnixMilli()) {
+		t.Fatalf("value = %v, want %d", v, now.UnixMilli())
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	p := &Payload{Metrics: []Metric{{Name: "bdSeq", DataType: UInt64, Value: uint64(3)}}}
+	data := p.Marshal()
+
+	if _, err := Unmarshal(data[:len(data)-1]); err != ErrMalformedPayload {
+		t.Fatalf("Unmarshal() = %v, want ErrMalformedPayload", err)
+	}
+}
+
+func TestTopic(t *testing.T) {
+	if got := Topic("g", NBIRTH, "n", ""); got != "spBv1.0/g/NBIRTH/n" {
+		t.Errorf("node topic = %s", got)
+	}
+	if got := Topic("g", DDATA, "n", "d"); got != "spBv1.0/g/DDATA/n/d" {
+		t.Errorf("device topic = %s", got)
+	}
+}
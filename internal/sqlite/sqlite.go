@@ -0,0 +1,47 @@
+// Package sqlite opens the SQLite database tracer-writer writes readings to
+// and tracer-api reads them from, for installs without a database server.
+package sqlite
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// TimeFormat is how times are stored: in UTC, as SQLite's date and time
+// functions expect, so they sort and can be bucketed with strftime.
+const TimeFormat = "2006-01-02 15:04:05.000"
+
+// pragmas put the database in WAL mode, so tracer-api reading doesn't block
+// tracer-writer writing, and have each side wait rather than fail while the
+// other holds a lock.
+const pragmas = "_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate"
+
+// Open opens the database at path, creating it if needed.
+func Open(path string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+pragmas)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// ParseTime parses a time stored with FormatTime, or truncated by strftime.
+func ParseTime(s string) (time.Time, error) {
+	return time.Parse("2006-01-02 15:04:05.999999999", s)
+}
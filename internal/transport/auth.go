@@ -0,0 +1,195 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorUnauthorized is returned to requests that fail verification.
+const ErrorUnauthorized = "unauthorized"
+
+var (
+	ErrUnsigned         = errors.New("request is not signed")
+	ErrUnknownClient    = errors.New("unknown client")
+	ErrStaleRequest     = errors.New("request timestamp outside allowed skew")
+	ErrReplayedRequest  = errors.New("nonce has already been used")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// SignedRequest is the envelope carrying a signed request. Request holds the
+// exact bytes that were signed.
+type SignedRequest struct {
+	Request json.RawMessage `json:"request"`
+	Auth    *Signature      `json:"auth"`
+}
+
+type Signature struct {
+	ClientID string `json:"clientId"`
+	// Timestamp is in Unix seconds.
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	// Principal is the user the client is acting for, if any.
+	Principal string `json:"principal,omitempty"`
+	Signature string `json:"signature"`
+}
+
+// mac computes the HMAC-SHA256 of the request over the method's topic, so a
+// signed request can't be replayed against a different RPC.
+func mac(key []byte, topic string, sig *Signature, request []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(methodTopic(topic)))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(sig.ClientID))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(strconv.FormatInt(sig.Timestamp, 10)))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(sig.Nonce))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(sig.Principal))
+	h.Write([]byte{'\n'})
+	h.Write(request)
+	return h.Sum(nil)
+}
+
+// methodTopic strips the request ID from a request topic.
+func methodTopic(topic string) string {
+	if i := strings.LastIndex(topic, "/"); i >= 0 {
+		return topic[:i]
+	}
+	return topic
+}
+
+func NewSigner(clientID string, key []byte) *Signer {
+	return &Signer{
+		clientID: clientID,
+		key:      key,
+	}
+}
+
+// Signer wraps requests in a SignedRequest envelope.
+type Signer struct {
+	clientID string
+	key      []byte
+}
+
+// Sign signs request for topic on behalf of principal, which may be empty.
+func (s *Signer) Sign(topic string, principal string, request []byte) ([]byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	if len(request) == 0 {
+		request = []byte("{}")
+	}
+
+	sig := &Signature{
+		ClientID:  s.clientID,
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+		Principal: principal,
+	}
+	sig.Signature = hex.EncodeToString(mac(s.key, topic, sig, request))
+
+	return json.Marshal(&SignedRequest{
+		Request: request,
+		Auth:    sig,
+	})
+}
+
+// NewVerifier creates a Verifier accepting requests signed with keys, a map
+// of client ID to shared key, whose timestamps are within maxSkew of now.
+func NewVerifier(keys map[string][]byte, maxSkew time.Duration) *Verifier {
+	return &Verifier{
+		keys:    keys,
+		maxSkew: maxSkew,
+		nonces:  make(map[int64]map[string]struct{}),
+	}
+}
+
+type Verifier struct {
+	mu sync.Mutex
+
+	keys    map[string][]byte
+	maxSkew time.Duration
+	// nonces holds the nonces seen, bucketed by when they were seen in
+	// windows of maxSkew, so they're expired a bucket at a time.
+	nonces map[int64]map[string]struct{}
+}
+
+// Verify checks the signature of a SignedRequest received on topic, returning
+// the signed request and its signature.
+func (v *Verifier) Verify(topic string, payload []byte) ([]byte, *Signature, error) {
+	var signed SignedRequest
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return nil, nil, err
+	}
+	if signed.Auth == nil || signed.Request == nil {
+		return nil, nil, ErrUnsigned
+	}
+
+	sig := signed.Auth
+	key, ok := v.keys[sig.ClientID]
+	if !ok {
+		return nil, nil, ErrUnknownClient
+	}
+
+	expected := mac(key, topic, sig, signed.Request)
+	actual, err := hex.DecodeString(sig.Signature)
+	if err != nil || !hmac.Equal(expected, actual) {
+		return nil, nil, ErrInvalidSignature
+	}
+
+	now := time.Now()
+	ts := time.Unix(sig.Timestamp, 0)
+	if ts.Before(now.Add(-v.maxSkew)) || ts.After(now.Add(v.maxSkew)) {
+		return nil, nil, ErrStaleRequest
+	}
+
+	if err := v.useNonce(sig.ClientID+"/"+sig.Nonce, now); err != nil {
+		return nil, nil, err
+	}
+
+	return signed.Request, sig, nil
+}
+
+// useNonce records a nonce, failing if it has been seen within the window in
+// which its timestamp would be accepted.
+func (v *Verifier) useNonce(nonce string, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	width := v.maxSkew
+	if width <= 0 {
+		width = time.Second
+	}
+	bucket := now.UnixNano() / int64(width)
+
+	// A timestamp is accepted for up to twice maxSkew, so a nonce is kept
+	// until two whole buckets have passed since the one it was seen in.
+	for b, nonces := range v.nonces {
+		if b < bucket-2 {
+			delete(v.nonces, b)
+			continue
+		}
+		if _, ok := nonces[nonce]; ok {
+			return ErrReplayedRequest
+		}
+	}
+
+	nonces, ok := v.nonces[bucket]
+	if !ok {
+		nonces = make(map[string]struct{})
+		v.nonces[bucket] = nonces
+	}
+	nonces[nonce] = struct{}{}
+	return nil
+}
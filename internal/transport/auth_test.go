@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testTopic = "tracer/controller/setBatteryCapacity/request/abc"
+
+func testVerifier() *Verifier {
+	return NewVerifier(map[string][]byte{"api": []byte("secret")}, 30*time.Second)
+}
+
+func TestVerifySigned(t *testing.T) {
+	v := testVerifier()
+	payload, err := NewSigner("api", []byte("secret")).Sign(testTopic, "alice", []byte(`{"capacity":100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed for the method, so the request ID can differ.
+	request, sig, err := v.Verify("tracer/controller/setBatteryCapacity/request/other", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != `{"capacity":100}` || sig.ClientID != "api" || sig.Principal != "alice" {
+		t.Fatalf("Verify() = %s, %+v", request, sig)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	signer := NewSigner("api", []byte("secret"))
+
+	tamper := func(f func(*SignedRequest)) []byte {
+		payload, err := signer.Sign(testTopic, "", []byte(`{"capacity":100}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var signed SignedRequest
+		if err := json.Unmarshal(payload, &signed); err != nil {
+			t.Fatal(err)
+		}
+		f(&signed)
+		payload, _ = json.Marshal(&signed)
+		return payload
+	}
+
+	tests := []struct {
+		name    string
+		topic   string
+		payload []byte
+		want    error
+	}{
+		{"unsigned", testTopic, []byte(`{"capacity":100}`), ErrUnsigned},
+		{"unknown client", testTopic, tamper(func(s *SignedRequest) { s.Auth.ClientID = "mallory" }), ErrUnknownClient},
+		{"changed request", testTopic, tamper(func(s *SignedRequest) { s.Request = json.RawMessage(`{"capacity":1}`) }), ErrInvalidSignature},
+		{"changed principal", testTopic, tamper(func(s *SignedRequest) { s.Auth.Principal = "admin" }), ErrInvalidSignature},
+		{"bad signature", testTopic, tamper(func(s *SignedRequest) { s.Auth.Signature = "zz" }), ErrInvalidSignature},
+		{"other method", "tracer/controller/setSystemTime/request/abc", tamper(func(s *SignedRequest) {}), ErrInvalidSignature},
+		{"wrong key", testTopic, func() []byte {
+			payload, _ := NewSigner("api", []byte("guess")).Sign(testTopic, "", []byte(`{}`))
+			return payload
+		}(), ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := testVerifier().Verify(tt.topic, tt.payload); !errors.Is(err, tt.want) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyStale(t *testing.T) {
+	v := testVerifier()
+	key := []byte("secret")
+
+	for _, offset := range []time.Duration{-time.Minute, time.Minute} {
+		sig := &Signature{ClientID: "api", Timestamp: time.Now().Add(offset).Unix(), Nonce: "n"}
+		request := []byte(`{}`)
+		sig.Signature = hex.EncodeToString(mac(key, testTopic, sig, request))
+		payload, _ := json.Marshal(&SignedRequest{Request: request, Auth: sig})
+
+		if _, _, err := v.Verify(testTopic, payload); !errors.Is(err, ErrStaleRequest) {
+			t.Fatalf("Verify() %s off = %v, want ErrStaleRequest", offset, err)
+		}
+	}
+}
+
+func TestVerifyReplayed(t *testing.T) {
+	v := testVerifier()
+	payload, err := NewSigner("api", []byte("secret")).Sign(testTopic, "", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := v.Verify(testTopic, payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := v.Verify(testTopic, payload); !errors.Is(err, ErrReplayedRequest) {
+		t.Fatalf("Verify() replayed = %v, want ErrReplayedRequest", err)
+	}
+}
+
+func TestNonceExpiry(t *testing.T) {
+	v := testVerifier()
+	start := time.Unix(1700000000, 0)
+
+	if err := v.useNonce("a", start); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remembered for as long as its timestamp could be accepted.
+	for _, d := range []time.Duration{time.Second, 30 * time.Second, 59 * time.Second} {
+		if err := v.useNonce("a", start.Add(d)); !errors.Is(err, ErrReplayedRequest) {
+			t.Fatalf("nonce reused after %s = %v, want ErrReplayedRequest", d, err)
+		}
+	}
+
+	// Then forgotten a bucket at a time.
+	if err := v.useNonce("a", start.Add(2*time.Minute)); err != nil {
+		t.Fatalf("nonce reused after 2m = %v, want it expired", err)
+	}
+	if len(v.nonces) != 1 {
+		t.Fatalf("%d buckets kept, want only the current one", len(v.nonces))
+	}
+}
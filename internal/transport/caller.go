@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	SourceMQTT      = "mqtt"
+	SourceSparkplug = "sparkplug"
+	SourceHTTP      = "http"
+)
+
+// Caller describes who made a request.
+type Caller struct {
+	// Source is the transport the request arrived on.
+	Source string
+	// ClientID is the verified ID of the client that signed the request.
+	ClientID string
+	// Principal is the user the client acted for, as reported by the client.
+	Principal string
+	RequestID string
+}
+
+type callerKey struct{}
+
+type principalKey struct{}
+
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom returns the caller of the request being handled with ctx.
+func CallerFrom(ctx context.Context) Caller {
+	caller, _ := ctx.Value(callerKey{}).(Caller)
+	return caller
+}
+
+// WithPrincipal sets the user that requests made with ctx are signed on
+// behalf of.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func PrincipalFrom(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// requestID returns the request ID at the end of a request topic.
+func requestID(topic string) string {
+	if i := strings.LastIndex(topic, "/"); i >= 0 {
+		return topic[i+1:]
+	}
+	return ""
+}
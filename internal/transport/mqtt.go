@@ -3,44 +3,159 @@ package transport
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strings"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"go.uber.org/zap"
 )
 
+// ErrorBusy is returned to requests that couldn't be served before their
+// deadline.
+const ErrorBusy = "busy"
+
+// ErrorHandlingRequest is returned for errors that have no code of their own.
+const ErrorHandlingRequest = "error handling request"
+
+// coder is implemented by errors that should be reported to the caller
+// rather than hidden behind a generic message.
+type coder interface {
+	ErrorCode() string
+}
+
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
 type ServiceHandler[Req, Res any] func(context.Context, *Req) (*Res, error)
 
-func MQTT[Req, Res any](c mqtt.Client, logger *zap.Logger, handler ServiceHandler[Req, Res]) mqtt.MessageHandler {
+type Option func(*options)
+
+type options struct {
+	pool     *Pool
+	verifier *Verifier
+	timeout  time.Duration
+}
+
+// WithPool runs requests on pool rather than in the MQTT client's callback.
+func WithPool(pool *Pool) Option {
+	return func(o *options) {
+		o.pool = pool
+	}
+}
+
+// WithVerifier rejects requests that aren't signed by a client known to
+// verifier. A nil verifier accepts all requests.
+func WithVerifier(verifier *Verifier) Option {
+	return func(o *options) {
+		o.verifier = verifier
+	}
+}
+
+// WithTimeout allows requests that don't set timeoutMs timeout, rather than
+// the pool's default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// requestOptions are read from every request alongside the request itself.
+type requestOptions struct {
+	// TimeoutMs is how long the caller is prepared to wait for a response.
+	TimeoutMs int64 `json:"timeoutMs"`
+}
+
+func MQTT[Req, Res any](c mqtt.Client, logger *zap.Logger, handler ServiceHandler[Req, Res], opts ...Option) mqtt.MessageHandler {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	return func(client mqtt.Client, msg mqtt.Message) {
-		var err error
 		var req Req
-		var res *Res
+		var reqOpts requestOptions
+
+		caller := Caller{Source: SourceMQTT, RequestID: requestID(msg.Topic())}
+
+		payload := msg.Payload()
+		if o.verifier != nil {
+			request, sig, err := o.verifier.Verify(msg.Topic(), payload)
+			if err != nil {
+				logger.Warn("rejecting request", zap.String("topic", msg.Topic()), zap.Error(err))
+				publishError(c, logger, msg.Topic(), ErrorUnauthorized)
+				return
+			}
+			logger.Info("verified request", zap.String("topic", msg.Topic()), zap.String("clientId", sig.ClientID))
+			payload = request
+			caller.ClientID = sig.ClientID
+			caller.Principal = sig.Principal
+		}
 
-		if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+		if err := json.Unmarshal(payload, &req); err != nil {
 			logger.Error("error unmarshalling request", zap.Error(err))
 			publishError(c, logger, msg.Topic(), "error unmarshalling request")
 			return
 		}
 
-		res, err = handler(context.Background(), &req)
-		if err != nil {
-			logger.Error("error handling request", zap.Error(err))
-			publishError(c, logger, msg.Topic(), "eerror handling request")
+		if err := json.Unmarshal(payload, &reqOpts); err != nil {
+			logger.Error("error unmarshalling request options", zap.Error(err))
+			publishError(c, logger, msg.Topic(), "error unmarshalling request")
 			return
 		}
 
-		payload, err := json.Marshal(&res)
-		if err != nil {
-			logger.Error("error marshalling response", zap.Error(err))
-			publishError(c, logger, msg.Topic(), "error marshalling response")
+		run := func(ctx context.Context) {
+			handle(WithCaller(ctx, caller), c, logger, msg.Topic(), handler, &req)
+		}
+
+		if o.pool == nil {
+			run(context.Background())
 			return
 		}
 
-		publishData(c, logger, msg.Topic(), payload)
+		timeout := time.Duration(reqOpts.TimeoutMs) * time.Millisecond
+		if timeout <= 0 {
+			timeout = o.timeout
+		}
+
+		o.pool.submit(timeout, run, func() {
+			logger.Warn("rejecting request", zap.String("topic", msg.Topic()), zap.String("reason", ErrorBusy))
+			publishError(c, logger, msg.Topic(), ErrorBusy)
+		})
 	}
 }
 
+func handle[Req, Res any](ctx context.Context, c mqtt.Client, logger *zap.Logger, topic string, handler ServiceHandler[Req, Res], req *Req) {
+	res, err := handler(ctx, req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Warn("request deadline exceeded", zap.String("topic", topic))
+		publishError(c, logger, topic, ErrorBusy)
+		return
+	}
+	var coded coder
+	if errors.As(err, &coded) {
+		logger.Warn("error handling request", zap.Error(err))
+		publishErrorMessage(c, logger, topic, coded.ErrorCode(), err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("error handling request", zap.Error(err))
+		publishError(c, logger, topic, ErrorHandlingRequest)
+		return
+	}
+
+	payload, err := json.Marshal(&res)
+	if err != nil {
+		logger.Error("error marshalling response", zap.Error(err))
+		publishError(c, logger, topic, "error marshalling response")
+		return
+	}
+
+	publishData(c, logger, topic, payload)
+}
+
 func publishData(c mqtt.Client, logger *zap.Logger, topic string, data []byte) error {
 	topic = strings.Replace(topic, "request", "response", 1)
 	if token := c.Publish(topic, 0, false, data); token.Wait() && token.Error() != nil {
@@ -51,7 +166,11 @@ func publishData(c mqtt.Client, logger *zap.Logger, topic string, data []byte) e
 }
 
 func publishError(c mqtt.Client, logger *zap.Logger, topic string, err string) error {
-	res := `{"error": "` + err + `"}`
+	return publishErrorMessage(c, logger, topic, err, "")
+}
+
+func publishErrorMessage(c mqtt.Client, logger *zap.Logger, topic string, err string, message string) error {
+	res, _ := json.Marshal(&errorResponse{Error: err, Message: message})
 	topic = strings.Replace(topic, "request", "response", 1)
 	if token := c.Publish(topic, 0, false, res); token.Wait() && token.Error() != nil {
 		logger.Error("error publishing error", zap.String("topic", topic), zap.Error(token.Error()))
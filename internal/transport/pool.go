@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// queueLength is the number of requests per worker that may wait for a free
+// worker before new requests are rejected as busy.
+const queueLength = 16
+
+type job struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	run    func(context.Context)
+	reject func()
+}
+
+// Pool runs requests on a fixed number of workers so a slow request doesn't
+// hold up the delivery of others.
+func NewPool(workers int, defaultTimeout time.Duration) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool{
+		jobs:           make(chan job, workers*queueLength),
+		defaultTimeout: defaultTimeout,
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+type Pool struct {
+	mu     sync.Mutex
+	closed bool
+
+	jobs           chan job
+	defaultTimeout time.Duration
+	wg             sync.WaitGroup
+}
+
+// submit queues run to be called with a context that expires after timeout,
+// or the pool's default timeout if it is zero. reject is called instead if
+// the pool is closed, the queue is full or the deadline passes before a
+// worker is free.
+func (p *Pool) submit(timeout time.Duration, run func(context.Context), reject func()) {
+	if timeout <= 0 {
+		timeout = p.defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	j := job{ctx: ctx, cancel: cancel, run: run, reject: reject}
+
+	p.mu.Lock()
+	queued := false
+	if !p.closed {
+		select {
+		case p.jobs <- j:
+			queued = true
+		default:
+		}
+	}
+	p.mu.Unlock()
+
+	if !queued {
+		cancel()
+		reject()
+	}
+}
+
+// Close stops the workers once the queued requests have been handled.
+// Requests submitted after Close are rejected.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+
+	for j := range p.jobs {
+		if j.ctx.Err() != nil {
+			j.reject()
+		} else {
+			j.run(j.ctx)
+		}
+		j.cancel()
+	}
+}
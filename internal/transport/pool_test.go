@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolRuns(t *testing.T) {
+	p := NewPool(2, time.Second)
+
+	var ran, rejected int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		p.submit(0, func(ctx context.Context) {
+			defer wg.Done()
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("run without a deadline")
+			}
+			atomic.AddInt32(&ran, 1)
+		}, func() {
+			defer wg.Done()
+			atomic.AddInt32(&rejected, 1)
+		})
+	}
+	wg.Wait()
+	p.Close()
+
+	if ran != 10 || rejected != 0 {
+		t.Fatalf("ran %d and rejected %d, want all 10 run", ran, rejected)
+	}
+}
+
+func TestPoolRejectsWhenFull(t *testing.T) {
+	p := NewPool(1, time.Second)
+	defer p.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	p.submit(0, func(ctx context.Context) {
+		close(started)
+		<-release
+	}, func() { t.Error("first request rejected") })
+	<-started
+
+	// Fill the queue behind the busy worker.
+	for i := 0; i < queueLength; i++ {
+		p.submit(0, func(ctx context.Context) {}, func() {})
+	}
+
+	rejected := false
+	p.submit(0, func(ctx context.Context) { t.Error("ran a request past the queue length") }, func() { rejected = true })
+	if !rejected {
+		t.Fatal("request past the queue length wasn't rejected")
+	}
+	close(release)
+}
+
+func TestPoolRejectsExpired(t *testing.T) {
+	p := NewPool(1, time.Second)
+	defer p.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	p.submit(0, func(ctx context.Context) {
+		close(started)
+		<-release
+	}, func() {})
+	<-started
+
+	rejected := make(chan struct{})
+	p.submit(time.Millisecond, func(ctx context.Context) { t.Error("ran an expired request") }, func() { close(rejected) })
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-rejected:
+	case <-time.After(time.Second):
+		t.Fatal("expired request wasn't rejected")
+	}
+}
+
+func TestPoolSubmitAfterClose(t *testing.T) {
+	p := NewPool(1, time.Second)
+	p.Close()
+	// Closing twice is harmless.
+	p.Close()
+
+	rejected := false
+	p.submit(0, func(ctx context.Context) { t.Error("ran a request after Close") }, func() { rejected = true })
+	if !rejected {
+		t.Fatal("request after Close wasn't rejected")
+	}
+}
+
+func TestPoolSubmitDuringClose(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		p := NewPool(2, time.Second)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				p.submit(0, func(ctx context.Context) {}, func() {})
+			}
+		}()
+		p.Close()
+		wg.Wait()
+	}
+}
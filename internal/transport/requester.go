@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alxyng/tracer/internal/metrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrTimeout       = errors.New("timed out waiting for response")
+	ErrNotSubscribed = errors.New("not subscribed to responses")
+)
+
+// NewRequester creates a Requester for the RPCs on topics, request topics such
+// as "tracer/controller/getReading/request/#". Request counts and latencies
+// are recorded in registry.
+func NewRequester(topics []string, registry *metrics.Registry, logger *zap.Logger) *Requester {
+	r := &Requester{
+		topics:  topics,
+		methods: make(map[string]bool),
+		pending: make(map[string]chan []byte),
+		requests: registry.Counter("tracer_api_rpc_requests",
+			"Requests made to the controller", "method"),
+		timeouts: registry.Counter("tracer_api_rpc_timeouts",
+			"Requests to the controller that timed out", "method"),
+		duration: registry.Histogram("tracer_api_rpc_duration_seconds",
+			"Time taken by the controller to answer requests", metrics.DefaultBuckets, "method"),
+		logger: logger,
+	}
+	for _, topic := range topics {
+		r.methods[method(topic)] = true
+	}
+	registry.GaugeFunc("tracer_api_rpc_in_flight", "Requests waiting for a response", func() float64 {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return float64(len(r.pending))
+	})
+	return r
+}
+
+// Requester makes requests over MQTT, receiving every response through one
+// wildcard subscription per RPC rather than subscribing for each request.
+type Requester struct {
+	topics   []string
+	methods  map[string]bool
+	requests *metrics.Vec
+	timeouts *metrics.Vec
+	duration *metrics.HistogramVec
+	logger   *zap.Logger
+
+	mu         sync.Mutex
+	subscribed bool
+	pending    map[string]chan []byte
+}
+
+// Subscribe subscribes to the responses of every RPC. The subscriptions don't
+// survive a reconnect with a clean session, so it should be called from the
+// client's OnConnect handler.
+func (r *Requester) Subscribe(c mqtt.Client) error {
+	for _, topic := range r.topics {
+		responseTopic := strings.Replace(topic, "request/#", "response/+", 1)
+		if token := c.Subscribe(responseTopic, 0, r.handleResponse); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+
+	r.mu.Lock()
+	r.subscribed = true
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *Requester) handleResponse(c mqtt.Client, msg mqtt.Message) {
+	requestID := requestID(msg.Topic())
+
+	r.mu.Lock()
+	done, ok := r.pending[requestID]
+	delete(r.pending, requestID)
+	r.mu.Unlock()
+
+	if !ok {
+		// The request has already timed out.
+		r.logger.Debug("discarding response", zap.String("topic", msg.Topic()))
+		return
+	}
+
+	done <- msg.Payload()
+}
+
+// Request publishes payload to topic and waits for the response. If signer is
+// not nil the request is signed, on behalf of the principal in ctx.
+func (r *Requester) Request(ctx context.Context, c mqtt.Client, topic string, payload []byte, signer *Signer) ([]byte, error) {
+	requestID := uuid.NewString()
+	done := make(chan []byte, 1)
+
+	m := method(topic)
+
+	r.mu.Lock()
+	if !r.methods[m] || !r.subscribed {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrNotSubscribed, topic)
+	}
+	r.pending[requestID] = done
+	r.mu.Unlock()
+
+	r.requests.With(m).Inc()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, requestID)
+		r.mu.Unlock()
+	}()
+
+	requestTopic := strings.Replace(topic, "#", requestID, -1)
+	if signer != nil {
+		var err error
+		payload, err = signer.Sign(requestTopic, PrincipalFrom(ctx), payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	if token := c.Publish(requestTopic, 0, false, payload); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	select {
+	case data := <-done:
+		r.duration.With(m).Observe(time.Since(start).Seconds())
+		return data, nil
+	case <-ctx.Done():
+		r.timeouts.With(m).Inc()
+		return nil, ErrTimeout
+	}
+}
+
+// method returns the RPC's name from a request topic.
+func method(topic string) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 {
+		return topic
+	}
+	return parts[2]
+}
@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alxyng/tracer/internal/metrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+type doneToken struct {
+	mqtt.Token
+}
+
+func (doneToken) Wait() bool   { return true }
+func (doneToken) Error() error { return nil }
+
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Topic() string   { return m.topic }
+func (m *testMessage) Payload() []byte { return m.payload }
+
+// echoClient answers every request published with respond, unless respond
+// is nil.
+type echoClient struct {
+	mqtt.Client
+
+	mu         sync.Mutex
+	subscribed []string
+	handler    mqtt.MessageHandler
+	published  [][]byte
+	respond    func(payload []byte) []byte
+}
+
+func (c *echoClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscribed = append(c.subscribed, topic)
+	c.handler = callback
+	return doneToken{}
+}
+
+func (c *echoClient) Publish(topic string, qos byte, retained bool, payload any) mqtt.Token {
+	c.mu.Lock()
+	c.published = append(c.published, payload.([]byte))
+	handler, respond := c.handler, c.respond
+	c.mu.Unlock()
+
+	if respond != nil {
+		responseTopic := strings.Replace(topic, "/request/", "/response/", 1)
+		go handler(c, &testMessage{topic: responseTopic, payload: respond(payload.([]byte))})
+	}
+	return doneToken{}
+}
+
+const rpcTopic = "tracer/controller/getReading/request/#"
+
+func TestRequester(t *testing.T) {
+	r := NewRequester([]string{rpcTopic}, metrics.NewRegistry(), zap.NewNop())
+	c := &echoClient{respond: func(payload []byte) []byte { return append([]byte("re: "), payload...) }}
+
+	if _, err := r.Request(context.Background(), c, rpcTopic, []byte("{}"), nil); !errors.Is(err, ErrNotSubscribed) {
+		t.Fatalf("err = %v, want ErrNotSubscribed before subscribing", err)
+	}
+
+	if err := r.Subscribe(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.subscribed) != 1 || c.subscribed[0] != "tracer/controller/getReading/response/+" {
+		t.Fatalf("subscribed to %v", c.subscribed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := r.Request(ctx, c, rpcTopic, []byte(`{"a":1}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `re: {"a":1}` {
+		t.Errorf("response = %s", data)
+	}
+
+	if _, err := r.Request(ctx, c, "tracer/controller/other/request/#", []byte("{}"), nil); !errors.Is(err, ErrNotSubscribed) {
+		t.Errorf("err = %v, want ErrNotSubscribed for an unknown RPC", err)
+	}
+}
+
+func TestRequesterTimeout(t *testing.T) {
+	r := NewRequester([]string{rpcTopic}, metrics.NewRegistry(), zap.NewNop())
+	c := &echoClient{}
+	if err := r.Subscribe(c); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := r.Request(ctx, c, rpcTopic, []byte("{}"), nil); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("err = %v, want ErrTimeout", err)
+	}
+
+	// A late response is discarded rather than delivered to anyone.
+	r.handleResponse(c, &testMessage{topic: "tracer/controller/getReading/response/late", payload: []byte("{}")})
+	if len(r.pending) != 0 {
+		t.Errorf("%d requests still pending", len(r.pending))
+	}
+}
+
+func TestRequesterSigns(t *testing.T) {
+	r := NewRequester([]string{rpcTopic}, metrics.NewRegistry(), zap.NewNop())
+	c := &echoClient{respond: func([]byte) []byte { return []byte("{}") }}
+	if err := r.Subscribe(c); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := NewSigner("api", []byte("secret"))
+	ctx := WithPrincipal(context.Background(), "alex")
+	if _, err := r.Request(ctx, c, rpcTopic, []byte(`{"a":1}`), signer); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.published) != 1 || !bytes.Contains(c.published[0], []byte(`"principal":"alex"`)) {
+		t.Errorf("published %s, want a signed envelope for alex", c.published)
+	}
+}